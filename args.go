@@ -0,0 +1,400 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Types an argument can be coerced to before it reaches a command function
+type argType int
+
+const (
+	argString argType = iota // a single word or "quoted phrase"
+	argInt                   // a whole number
+	argBool                  // true/false, yes/no, on/off
+	argRest                  // everything left on the line, exactly as typed
+)
+
+// describes one argument a command accepts; commands list these in their 'arguments' field
+type argument struct {
+	name         string   // name shown in the usage line and used to look the value up
+	description  string   // shown by the help command
+	kind         argType  // what the value is coerced to
+	required     bool     // is the user required to give this argument?
+	defaultValue string   // used when an optional argument is not given
+	choices      []string // if not empty, the value must be one of these (case-insensitive)
+	flag         bool     // given as --name=value rather than by position
+}
+
+// a single word from the message, keeping what the user actually typed
+type token struct {
+	text   string // unquoted, unescaped value
+	raw    string // the exact text as it appeared in the message
+	quoted bool   // did any part of it come from quotes?
+	start  int    // byte offset of raw in line
+	line   string // the whole input it came from, so the rest of the line can be cut out exactly (see restOfLine)
+}
+
+// validated and coerced arguments handed to a command function
+type commandArgs struct {
+	raw    []string               // positional words, unquoted, in order
+	values map[string]interface{} // coerced value of each argument by name
+	given  map[string]bool        // which arguments the user actually supplied
+}
+
+// error returned when the user's input doesn't fit a command's argument schema
+type argError struct {
+	message string
+}
+
+func (e *argError) Error() string {
+	return e.message
+}
+
+// Splits a message into words, honouring 'single' and "double" quotes and backslash escapes.
+// Any amount of whitespace separates words, so double spaces no longer produce empty arguments.
+func tokenize(input string) ([]token, error) {
+	tokens := []token{}
+
+	var (
+		current  strings.Builder
+		inToken  bool
+		quoted   bool
+		quote    rune
+		escaped  bool
+		startPos int
+	)
+
+	finish := func(end int) {
+		if inToken {
+			tokens = append(tokens, token{text: current.String(), raw: input[startPos:end], quoted: quoted, start: startPos, line: input})
+		}
+		current.Reset()
+		inToken = false
+		quoted = false
+	}
+
+	for pos, char := range input {
+		switch {
+		case escaped:
+			current.WriteRune(char)
+			escaped = false
+		case char == '\\' && quote != '\'':
+			if !inToken {
+				inToken = true
+				startPos = pos
+			}
+			escaped = true
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			} else {
+				current.WriteRune(char)
+			}
+		case char == '"' || char == '\'':
+			if !inToken {
+				inToken = true
+				startPos = pos
+			}
+			quote = char
+			quoted = true
+		case unicode.IsSpace(char):
+			finish(pos)
+		default:
+			if !inToken {
+				inToken = true
+				startPos = pos
+			}
+			current.WriteRune(char)
+		}
+	}
+
+	if quote != 0 {
+		return nil, &argError{"You have an unclosed " + string(quote) + " quote."}
+	}
+	if escaped {
+		// a trailing backslash is kept as-is
+		current.WriteRune('\\')
+	}
+	finish(len(input))
+
+	return tokens, nil
+}
+
+// Cuts the rest of the line out of the original input, from the given token to the end, keeping newlines and spacing
+// as typed. Flags (and --) found among it are left out along with the space before each
+func restOfLine(first token, removed []token) string {
+	rest := ""
+	from := first.start
+	for _, tok := range removed {
+		if tok.line != first.line || tok.start < from {
+			continue
+		}
+		rest += strings.TrimRightFunc(first.line[from:tok.start], unicode.IsSpace)
+		from = tok.start + len(tok.raw)
+	}
+	return strings.TrimRightFunc(rest+first.line[from:], unicode.IsSpace)
+}
+
+// Checks the given words against a command's argument schema, filling in defaults and coercing types.
+func parseArgs(cmd *command, tokens []token) (*commandArgs, error) {
+	args := &commandArgs{
+		values: make(map[string]interface{}),
+		given:  make(map[string]bool),
+	}
+
+	positional := []token{}
+	hasFlags := false
+	for _, arg := range cmd.arguments {
+		if arg.flag {
+			hasFlags = true
+		}
+	}
+
+	// pull out --flags; a bare "--" ends flag parsing
+	flagsDone := !hasFlags
+	removed := []token{}
+	for _, tok := range tokens {
+		if flagsDone || tok.quoted || !strings.HasPrefix(tok.text, "--") {
+			positional = append(positional, tok)
+			continue
+		}
+		removed = append(removed, tok)
+		if tok.text == "--" {
+			flagsDone = true
+			continue
+		}
+
+		name := tok.text[2:]
+		value := ""
+		hasValue := false
+		if index := strings.Index(name, "="); index >= 0 {
+			name, value, hasValue = name[:index], name[index+1:], true
+		}
+		name = strings.ToLower(name)
+
+		arg := cmd.flag(name)
+		if arg == nil {
+			return nil, &argError{"I don't know the option `--" + name + "`."}
+		}
+		if !hasValue {
+			if arg.kind != argBool {
+				return nil, &argError{"The option `--" + name + "` needs a value, like `--" + name + "=" + arg.placeholder() + "`."}
+			}
+			value = "true"
+		}
+		if err := args.set(arg, value); err != nil {
+			return nil, err
+		}
+	}
+
+	// fill positional arguments in order
+	index := 0
+	for i := range cmd.arguments {
+		arg := &cmd.arguments[i]
+		if arg.flag {
+			continue
+		}
+		if arg.kind == argRest {
+			if index < len(positional) {
+				rest := restOfLine(positional[index], removed)
+				for _, tok := range positional[index:] {
+					args.raw = append(args.raw, tok.text)
+				}
+				index = len(positional)
+				if err := args.set(arg, rest); err != nil {
+					return nil, err
+				}
+			}
+			break
+		}
+		if index < len(positional) {
+			args.raw = append(args.raw, positional[index].text)
+			if err := args.set(arg, positional[index].text); err != nil {
+				return nil, err
+			}
+			index++
+		}
+	}
+
+	if index < len(positional) {
+		return nil, &argError{"Too many arguments; I didn't expect `" + positional[index].text + "`."}
+	}
+
+	// check required arguments and apply defaults
+	for i := range cmd.arguments {
+		arg := &cmd.arguments[i]
+		if args.given[arg.name] {
+			continue
+		}
+		if arg.required {
+			if arg.flag {
+				return nil, &argError{"The option `--" + arg.name + "` is required."}
+			}
+			return nil, &argError{"Missing required argument `" + arg.name + "`."}
+		}
+		if err := args.set(arg, arg.defaultValue); err != nil {
+			return nil, err
+		}
+		args.given[arg.name] = false
+	}
+
+	return args, nil
+}
+
+// coerces a value according to its argument definition and stores it
+func (args *commandArgs) set(arg *argument, value string) error {
+	args.given[arg.name] = true
+
+	if len(arg.choices) > 0 && value != "" {
+		found := false
+		for _, choice := range arg.choices {
+			if strings.EqualFold(choice, value) {
+				value = choice
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &argError{"`" + value + "` isn't a valid choice for `" + arg.name + "`. Pick one of: `" + strings.Join(arg.choices, "`, `") + "`."}
+		}
+	}
+
+	switch arg.kind {
+	case argInt:
+		if value == "" {
+			args.values[arg.name] = 0
+			return nil
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return &argError{"`" + arg.name + "` should be a whole number, not `" + value + "`."}
+		}
+		args.values[arg.name] = number
+	case argBool:
+		if value == "" {
+			args.values[arg.name] = false
+			return nil
+		}
+		switch strings.ToLower(value) {
+		case "true", "yes", "on", "1", "y":
+			args.values[arg.name] = true
+		case "false", "no", "off", "0", "n":
+			args.values[arg.name] = false
+		default:
+			return &argError{"`" + arg.name + "` should be yes or no, not `" + value + "`."}
+		}
+	default:
+		args.values[arg.name] = value
+	}
+	return nil
+}
+
+// String returns the value of a string or rest argument
+func (args *commandArgs) String(name string) string {
+	value, _ := args.values[name].(string)
+	return value
+}
+
+// Int returns the value of a whole number argument
+func (args *commandArgs) Int(name string) int {
+	value, _ := args.values[name].(int)
+	return value
+}
+
+// Bool returns the value of a yes/no argument
+func (args *commandArgs) Bool(name string) bool {
+	value, _ := args.values[name].(bool)
+	return value
+}
+
+// Has reports whether the user supplied the argument, rather than it falling back to its default
+func (args *commandArgs) Has(name string) bool {
+	return args.given[name]
+}
+
+// looks up a flag argument by name
+func (cmd *command) flag(name string) *argument {
+	for i := range cmd.arguments {
+		if cmd.arguments[i].flag && cmd.arguments[i].name == name {
+			return &cmd.arguments[i]
+		}
+	}
+	return nil
+}
+
+// what to show in place of an argument's value in usage lines
+func (arg *argument) placeholder() string {
+	if len(arg.choices) > 0 {
+		return strings.Join(arg.choices, "|")
+	}
+	switch arg.kind {
+	case argInt:
+		return "number"
+	case argBool:
+		return "yes|no"
+	}
+	return arg.name
+}
+
+// Builds the usage line for a command from its argument schema, without the prefix
+// [] for optional arguments, <> for required arguments
+func (cmd *command) usage() string {
+	usage := cmd.verbs[0]
+
+	for _, arg := range cmd.arguments {
+		if arg.flag {
+			continue
+		}
+		text := arg.name
+		if len(arg.choices) > 0 {
+			text = arg.placeholder()
+		}
+		if arg.kind == argRest {
+			text += "..."
+		}
+		if arg.required {
+			usage += " <" + text + ">"
+		} else {
+			usage += " [" + text + "]"
+		}
+	}
+
+	for _, arg := range cmd.arguments {
+		if !arg.flag {
+			continue
+		}
+		text := "--" + arg.name
+		if arg.kind != argBool {
+			text += "=<" + arg.placeholder() + ">"
+		}
+		if arg.required {
+			usage += " " + text
+		} else {
+			usage += " [" + text + "]"
+		}
+	}
+
+	return usage
+}
+
+// Lists each argument that has a description, for the help command
+func (cmd *command) argumentHelp() string {
+	output := ""
+	for _, arg := range cmd.arguments {
+		if arg.description == "" {
+			continue
+		}
+		name := "`" + arg.name + "`"
+		if arg.flag {
+			name = "`--" + arg.name + "`"
+		}
+		line := name + " - " + arg.description
+		if arg.defaultValue != "" {
+			line += " (default `" + arg.defaultValue + "`)"
+		}
+		output += line + "\n"
+	}
+	return output
+}
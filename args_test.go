@@ -0,0 +1,166 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		input string
+		texts []string
+		raws  []string
+	}{
+		{"", []string{}, []string{}},
+		{"   ", []string{}, []string{}},
+		{"a  b\tc", []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{`"hello world" x`, []string{"hello world", "x"}, []string{`"hello world"`, "x"}},
+		{`a"b c"d`, []string{"ab cd"}, []string{`a"b c"d`}},
+		{`'it''s'`, []string{"its"}, []string{`'it''s'`}},
+		{`""`, []string{""}, []string{`""`}},
+		{`don\'t`, []string{"don't"}, []string{`don\'t`}},
+		{`"a\"b"`, []string{`a"b`}, []string{`"a\"b"`}},
+		{`a\ b`, []string{"a b"}, []string{`a\ b`}},
+		// backslashes mean nothing in single quotes
+		{`'a\b'`, []string{`a\b`}, []string{`'a\b'`}},
+		// a trailing backslash is kept
+		{`foo\`, []string{`foo\`}, []string{`foo\`}},
+		{`\`, []string{`\`}, []string{`\`}},
+		{"--flag=value rest", []string{"--flag=value", "rest"}, []string{"--flag=value", "rest"}},
+	}
+
+	for _, test := range tests {
+		tokens, err := tokenize(test.input)
+		if err != nil {
+			t.Errorf("tokenize(%q) failed: %v", test.input, err)
+			continue
+		}
+		texts, raws := []string{}, []string{}
+		for _, tok := range tokens {
+			texts = append(texts, tok.text)
+			raws = append(raws, tok.raw)
+		}
+		if !reflect.DeepEqual(texts, test.texts) {
+			t.Errorf("tokenize(%q) = %q, want %q", test.input, texts, test.texts)
+		}
+		if !reflect.DeepEqual(raws, test.raws) {
+			t.Errorf("tokenize(%q) raw = %q, want %q", test.input, raws, test.raws)
+		}
+	}
+}
+
+func TestTokenizeUnclosedQuote(t *testing.T) {
+	for _, input := range []string{`"abc`, `'abc`, `a "b c`, `"a\"`} {
+		if tokens, err := tokenize(input); err == nil {
+			t.Errorf("tokenize(%q) = %v, want an unclosed quote error", input, tokens)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	withFlags := &command{arguments: []argument{
+		{name: "count", kind: argInt, defaultValue: "3"},
+		{name: "query", kind: argRest},
+		{name: "channel", kind: argBool, flag: true},
+		{name: "limit", kind: argInt, flag: true, defaultValue: "10"},
+	}}
+	withoutFlags := &command{arguments: []argument{
+		{name: "word", required: true},
+		{name: "mode", choices: []string{"on", "off"}},
+	}}
+
+	tests := []struct {
+		cmd   *command
+		input string
+		want  map[string]interface{}
+		given []string
+	}{
+		{withFlags, "", map[string]interface{}{"count": 3, "query": "", "channel": false, "limit": 10}, nil},
+		{withFlags, "5 pony cute", map[string]interface{}{"count": 5, "query": "pony cute", "channel": false, "limit": 10}, []string{"count", "query"}},
+		{withFlags, "5 --channel pony", map[string]interface{}{"count": 5, "query": "pony", "channel": true, "limit": 10}, []string{"count", "query", "channel"}},
+		{withFlags, "--CHANNEL 5", map[string]interface{}{"count": 5, "query": "", "channel": true, "limit": 10}, []string{"count", "channel"}},
+		{withFlags, "--channel=no 4", map[string]interface{}{"count": 4, "query": "", "channel": false, "limit": 10}, []string{"count", "channel"}},
+
+		// flags can go anywhere, even in the middle of the rest of the line
+		{withFlags, "5 pony --limit=2 cute", map[string]interface{}{"count": 5, "query": "pony cute", "channel": false, "limit": 2}, []string{"count", "query", "limit"}},
+
+		// the rest of the line keeps quotes, spacing and newlines exactly as typed
+		{withFlags, `5 pony   "a  b"`, map[string]interface{}{"count": 5, "query": `pony   "a  b"`, "channel": false, "limit": 10}, []string{"count", "query"}},
+		{withFlags, "5 first  line\n\n  second\tline  \n", map[string]interface{}{"count": 5, "query": "first  line\n\n  second\tline", "channel": false, "limit": 10}, []string{"count", "query"}},
+		{withFlags, "5 a  --limit=2\nb  c", map[string]interface{}{"count": 5, "query": "a\nb  c", "channel": false, "limit": 2}, []string{"count", "query", "limit"}},
+
+		// quoted words and anything after -- aren't flags
+		{withFlags, `5 "--channel"`, map[string]interface{}{"count": 5, "query": `"--channel"`, "channel": false, "limit": 10}, []string{"count", "query"}},
+		{withFlags, "5 pony -- --channel", map[string]interface{}{"count": 5, "query": "pony --channel", "channel": false, "limit": 10}, []string{"count", "query"}},
+
+		// without flags in the schema, -- is just text
+		{withoutFlags, "--x", map[string]interface{}{"word": "--x", "mode": ""}, []string{"word"}},
+		{withoutFlags, "hi ON", map[string]interface{}{"word": "hi", "mode": "on"}, []string{"word", "mode"}},
+	}
+
+	for _, test := range tests {
+		tokens, err := tokenize(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args, err := parseArgs(test.cmd, tokens)
+		if err != nil {
+			t.Errorf("parseArgs(%q) failed: %v", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(args.values, test.want) {
+			t.Errorf("parseArgs(%q) = %v, want %v", test.input, args.values, test.want)
+		}
+		for _, arg := range test.cmd.arguments {
+			want := false
+			for _, name := range test.given {
+				want = want || name == arg.name
+			}
+			if args.Has(arg.name) != want {
+				t.Errorf("parseArgs(%q).Has(%q) = %v, want %v", test.input, arg.name, args.Has(arg.name), want)
+			}
+		}
+	}
+}
+
+func TestParseArgsErrors(t *testing.T) {
+	withFlags := &command{arguments: []argument{
+		{name: "count", kind: argInt},
+		{name: "channel", kind: argBool, flag: true},
+		{name: "limit", kind: argInt, flag: true},
+		{name: "site", flag: true, required: true},
+	}}
+	withoutFlags := &command{arguments: []argument{
+		{name: "word", required: true},
+		{name: "mode", choices: []string{"on", "off"}},
+	}}
+
+	tests := []struct {
+		cmd   *command
+		input string
+	}{
+		{withFlags, "--site=a --limit"},
+		{withFlags, "--site=a --nope"},
+		{withFlags, "--site=a --limit=x"},
+		{withFlags, "--site=a --channel=maybe"},
+		{withFlags, "--site=a many"},
+		{withFlags, "--site=a 1 2"},
+		{withFlags, "1"},
+		{withoutFlags, ""},
+		{withoutFlags, "hi maybe"},
+		{withoutFlags, "a b c"},
+	}
+
+	for _, test := range tests {
+		tokens, err := tokenize(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args, err := parseArgs(test.cmd, tokens)
+		if err == nil {
+			t.Errorf("parseArgs(%q) = %v, want an error", test.input, args.values)
+		} else if _, ok := err.(*argError); !ok {
+			t.Errorf("parseArgs(%q) gave %T, want an *argError", test.input, err)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of the backup format; bump it if the format changes in a way older versions can't read
+const backupFormat = 1
+
+// Everything Sunbot keeps, or everything belonging to one guild, in a form any backend can be restored from
+type backup struct {
+	Format        int                       `json:"format"`          // backupFormat
+	SchemaVersion int                       `json:"schemaVersion"`   // database schema version the keys are laid out for
+	ExportedAt    time.Time                 `json:"exportedAt"`      // when the backup was made
+	Guild         string                    `json:"guild,omitempty"` // guild ID if only one guild was exported
+	Keys          map[string]*storeEntry    `json:"keys"`            // database keys and their values
+	Settings      map[string]*guildSettings `json:"settings"`        // guild ID -> settings
+	Watches       []derpiWatch              `json:"watches"`         // Derpibooru watches (see watches.go)
+	Schedules     []derpiSchedule           `json:"schedules"`       // daily posts (see schedules.go)
+}
+
+// Database keys belonging to a guild: everything under guild:<id>:, plus the global details of its members
+// Without a guild, every key except cached searches (see cache.go)
+func backupKeys(store Store, guildID string) ([]string, error) {
+	if guildID == "" {
+		all, err := store.Keys("*")
+		if err != nil {
+			return nil, err
+		}
+		keys := []string{}
+		for _, key := range all {
+			if !strings.HasPrefix(key, storeCachePrefix) {
+				keys = append(keys, key)
+			}
+		}
+		return keys, nil
+	}
+
+	keys, err := store.Keys(guildKey(guildID) + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	for userID := range guildMembers(guildID, keys) {
+		if _, err := store.Type(userKey(userID)); err == nil {
+			keys = append(keys, userKey(userID))
+		}
+	}
+	return keys, nil
+}
+
+// IDs of the users with data in a guild, going by its keys
+func guildMembers(guildID string, keys []string) map[string]bool {
+	memberPrefix := memberKey(guildID, "")
+	members := make(map[string]bool)
+	for _, key := range keys {
+		if strings.HasPrefix(key, memberPrefix) {
+			userID := strings.SplitN(strings.TrimPrefix(key, memberPrefix), ":", 2)[0]
+			members[userID] = true
+		}
+	}
+	return members
+}
+
+// Reads one key's value and expiry; found is false if it disappeared in the meantime
+func exportKey(store Store, key string) (entry *storeEntry, found bool, err error) {
+	kind, err := store.Type(key)
+	if err == ErrNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	entry = &storeEntry{Kind: kind}
+	switch kind {
+	case storeString:
+		entry.Value, err = store.Get(key)
+	case storeHash:
+		entry.Hash, err = store.HGetAll(key)
+	case storeZSet:
+		var members []ScoredMember
+		members, err = store.ZRange(key, 0, -1, false)
+		entry.ZSet = make(map[string]float64)
+		for _, member := range members {
+			entry.ZSet[member.Member] = member.Score
+		}
+	}
+	if err == ErrNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	ttl, err := store.TTL(key)
+	if err == ErrNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if ttl > 0 {
+		entry.Expires = time.Now().Add(ttl)
+	}
+	return entry, true, nil
+}
+
+// Writes a backup of everything, or just one guild, as JSON
+// The store may be nil, in which case only the settings, watches and daily posts are exported
+func exportData(store Store, guildID string, output io.Writer) error {
+	data := backup{
+		Format:     backupFormat,
+		ExportedAt: time.Now().UTC(),
+		Guild:      guildID,
+		Keys:       make(map[string]*storeEntry),
+		Settings:   make(map[string]*guildSettings),
+		Watches:    watches.forGuild(guildID),
+		Schedules:  schedules.forGuild(guildID),
+	}
+
+	if store != nil {
+		var err error
+		data.SchemaVersion, err = schemaVersion(store)
+		if err != nil {
+			return err
+		}
+
+		keys, err := backupKeys(store, guildID)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			entry, found, err := exportKey(store, key)
+			if err != nil {
+				return fmt.Errorf("exporting %s: %v", key, err)
+			}
+			if found {
+				data.Keys[key] = entry
+			}
+		}
+	}
+
+	settings.RLock()
+	for id, guild := range settings.Guilds {
+		if guildID == "" || id == guildID {
+			copied := *guild
+			data.Settings[id] = &copied
+		}
+	}
+	settings.RUnlock()
+
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(data)
+}
+
+// Replaces one key with a value from a backup
+func importKey(store Store, key string, entry *storeEntry) error {
+	ttl := time.Duration(0)
+	if !entry.Expires.IsZero() {
+		ttl = time.Until(entry.Expires)
+		if ttl <= 0 {
+			// expired since the backup was made
+			return nil
+		}
+	}
+
+	err := store.Delete(key)
+	if err != nil {
+		return err
+	}
+
+	switch entry.Kind {
+	case storeString:
+		return store.Set(key, entry.Value, ttl)
+	case storeHash:
+		err = store.HSet(key, entry.Hash)
+	case storeZSet:
+		for member, score := range entry.ZSet {
+			err = store.ZAdd(key, member, score)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown kind of value %q", entry.Kind)
+	}
+
+	if err == nil && ttl > 0 {
+		err = store.Expire(key, ttl)
+	}
+	return err
+}
+
+// Restores a backup made by exportData, or just one guild from it
+// Keys, settings, watches and daily posts in the backup replace the ones here, and the guilds in it lose any
+// watches and daily posts the backup doesn't have; anything else is left alone
+// Watches and daily posts get new numbers, since the old ones may be taken here
+func importData(store Store, guildID string, input io.Reader) error {
+	data := backup{}
+	err := json.NewDecoder(input).Decode(&data)
+	if err != nil {
+		return fmt.Errorf("reading the backup: %v", err)
+	}
+	if data.Format != backupFormat {
+		return fmt.Errorf("the backup is in format %d, but this version of Sunbot reads format %d", data.Format, backupFormat)
+	}
+	if guildID != "" && data.Guild != "" && data.Guild != guildID {
+		return fmt.Errorf("the backup only has guild %s", data.Guild)
+	}
+
+	// which guilds' settings, watches and daily posts get replaced
+	guilds := make(map[string]bool)
+	if guildID != "" {
+		guilds[guildID] = true
+	} else {
+		for id := range data.Settings {
+			guilds[id] = true
+		}
+		for _, watch := range data.Watches {
+			guilds[watch.GuildID] = true
+		}
+		for _, schedule := range data.Schedules {
+			guilds[schedule.GuildID] = true
+		}
+	}
+
+	if len(data.Keys) > 0 {
+		if store == nil {
+			return fmt.Errorf("the backup has database keys, but no database is set up (see REDIS_URL and DATABASE_FILE)")
+		}
+		if data.SchemaVersion > latestSchemaVersion() {
+			return fmt.Errorf("the backup is from schema version %d, but this version of Sunbot only knows up to %d", data.SchemaVersion, latestSchemaVersion())
+		}
+		current, err := schemaVersion(store)
+		if err != nil {
+			return err
+		}
+		if current != latestSchemaVersion() {
+			return fmt.Errorf("the database is at schema version %d; run `sunbot migrate` before importing", current)
+		}
+		if data.SchemaVersion < latestSchemaVersion() {
+			err = migrateBackup(&data)
+			if err != nil {
+				return err
+			}
+		}
+
+		keys := []string{}
+		for key := range data.Keys {
+			keys = append(keys, key)
+		}
+		members := guildMembers(guildID, keys)
+
+		imported := 0
+		for key, entry := range data.Keys {
+			// the database keeps its own version, and a guild's import only touches that guild's keys and its
+			// members' global details
+			if key == schemaVersionKey {
+				continue
+			}
+			if guildID != "" && !strings.HasPrefix(key, guildKey(guildID)) &&
+				!(strings.HasPrefix(key, userKey("")) && members[strings.TrimPrefix(key, userKey(""))]) {
+				continue
+			}
+			err = importKey(store, key, entry)
+			if err != nil {
+				return fmt.Errorf("importing %s: %v", key, err)
+			}
+			imported++
+		}
+		// a database which was empty has no version yet
+		err = store.Set(schemaVersionKey, strconv.Itoa(latestSchemaVersion()), 0)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d database keys.\n", imported)
+	}
+
+	for id := range guilds {
+		if guild, ok := data.Settings[id]; ok {
+			err = settings.update(id, func(settings *guildSettings) {
+				*settings = *guild
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		err = watches.replaceGuild(id, itemsOfGuild(data.Watches, id))
+		if err != nil {
+			return err
+		}
+		err = schedules.replaceGuild(id, itemsOfGuild(data.Schedules, id))
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Imported the settings, watches and daily posts of %d servers.\n", len(guilds))
+
+	return nil
+}
+
+// Brings an older backup's keys up to the current schema by running the migrations on a copy in memory
+func migrateBackup(data *backup) error {
+	store := newMemoryStore()
+	for key, entry := range data.Keys {
+		copied := *entry
+		store.entries[key] = &copied
+	}
+	store.entries[schemaVersionKey] = &storeEntry{Kind: storeString, Value: strconv.Itoa(data.SchemaVersion)}
+
+	fmt.Printf("Migrating the backup from schema version %d.\n", data.SchemaVersion)
+	err := migrate(store, false)
+	if err != nil {
+		return err
+	}
+
+	data.Keys = store.entries
+	data.SchemaVersion = latestSchemaVersion()
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Swaps in empty settings, watches and daily posts saved to a temporary directory, returning a function which puts
+// the old ones back
+func useTestBackupData(t *testing.T) func() {
+	restoreSettings := useTestSettings(t)
+	dir, err := ioutil.TempDir("", "sunbot-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedWatches, savedSchedules := watches, schedules
+	watches, err = loadWatches(filepath.Join(dir, "watches.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedules, err = loadSchedules(filepath.Join(dir, "schedules.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		watches, schedules = savedWatches, savedSchedules
+		os.RemoveAll(dir)
+		restoreSettings()
+	}
+}
+
+// Every key in a store with its value; expiry times are only compared by whether there is one
+func storeSnapshot(t *testing.T, store Store) map[string]storeEntry {
+	keys, err := store.Keys("*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := make(map[string]storeEntry)
+	for _, key := range keys {
+		entry, found, err := exportKey(store, key)
+		if err != nil || !found {
+			t.Fatalf("exportKey(%s) = %v, %v", key, found, err)
+		}
+		if !entry.Expires.IsZero() {
+			entry.Expires = time.Unix(1, 0)
+		}
+		snapshot[key] = *entry
+	}
+	return snapshot
+}
+
+// Watches and daily posts without their numbers, which change on import, in guild and channel order, since guilds
+// are imported in no particular order
+func listSnapshot() ([]derpiWatch, []derpiSchedule) {
+	watchList, scheduleList := watches.forGuild(""), schedules.forGuild("")
+	for i := range watchList {
+		watchList[i].ID = 0
+	}
+	for i := range scheduleList {
+		scheduleList[i].ID = 0
+	}
+	sort.SliceStable(watchList, func(i, j int) bool {
+		return watchList[i].GuildID+" "+watchList[i].ChannelID < watchList[j].GuildID+" "+watchList[j].ChannelID
+	})
+	sort.SliceStable(scheduleList, func(i, j int) bool {
+		return scheduleList[i].GuildID+" "+scheduleList[i].ChannelID < scheduleList[j].GuildID+" "+scheduleList[j].ChannelID
+	})
+	return watchList, scheduleList
+}
+
+// Fills a store, the settings, watches and daily posts with data for guilds 10 and 20
+func fillBackupData(t *testing.T, store Store) {
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(migrate(store, false))
+	check(store.HSet(userKey("1"), map[string]string{"username": "one", "isBot": "false"}))
+	check(store.HSet(userKey("2"), map[string]string{"username": "two", "isBot": "false"}))
+	check(store.HSet(memberKey("10", "1"), map[string]string{"posts": "5"}))
+	check(store.HSet(memberKey("20", "2"), map[string]string{"posts": "7"}))
+	check(store.ZAdd(guildKey("10", "messages"), "1", 5))
+	check(store.ZAdd(guildKey("20", "messages"), "2", 7))
+	check(store.Set(guildKey("10", "user", "1", "xpcooldown"), "1", time.Hour))
+	check(store.Set(storeCachePrefix+"entry:abc", "{}", time.Hour))
+
+	check(settings.update("10", func(guild *guildSettings) {
+		guild.Prefix = "!"
+		guild.Policy = &ratingPolicy{ExcludedTags: []string{"gore"}}
+	}))
+	check(settings.update("20", func(guild *guildSettings) {
+		guild.DefaultBooru = "e621"
+	}))
+	check(watches.add(&derpiWatch{GuildID: "10", ChannelID: "100", Query: "pony", LastSeenID: 4}))
+	check(watches.add(&derpiWatch{GuildID: "20", ChannelID: "200", Query: "cute"}))
+	check(schedules.add(&derpiSchedule{GuildID: "10", ChannelID: "100", Kind: scheduleTop, Query: "pony", Time: "08:30", Timezone: "UTC", Posted: []int{1, 2}}))
+}
+
+// Exporting everything and importing it into an empty database gives back the same data
+func TestBackupRoundTrip(t *testing.T) {
+	defer useTestBackupData(t)()
+	source := newMemoryStore()
+	fillBackupData(t, source)
+
+	wantKeys := storeSnapshot(t, source)
+	delete(wantKeys, storeCachePrefix+"entry:abc")
+	wantSettings := settings.Guilds
+	wantWatches, wantSchedules := listSnapshot()
+
+	exported := &bytes.Buffer{}
+	err := exportData(source, "", exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer useTestBackupData(t)()
+	target := newMemoryStore()
+	err = importData(target, "", exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := storeSnapshot(t, target); !reflect.DeepEqual(keys, wantKeys) {
+		t.Errorf("imported keys = %v, want %v", keys, wantKeys)
+	}
+	if !reflect.DeepEqual(settings.Guilds, wantSettings) {
+		t.Errorf("imported settings = %v, want %v", settings.Guilds, wantSettings)
+	}
+	gotWatches, gotSchedules := listSnapshot()
+	if !reflect.DeepEqual(gotWatches, wantWatches) {
+		t.Errorf("imported watches = %v, want %v", gotWatches, wantWatches)
+	}
+	if !reflect.DeepEqual(gotSchedules, wantSchedules) {
+		t.Errorf("imported daily posts = %v, want %v", gotSchedules, wantSchedules)
+	}
+}
+
+// A guild's backup has only that guild's data and its members' details, and importing it leaves other guilds alone
+func TestBackupOneGuild(t *testing.T) {
+	defer useTestBackupData(t)()
+	source := newMemoryStore()
+	fillBackupData(t, source)
+
+	exported := &bytes.Buffer{}
+	err := exportData(source, "10", exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// guild 10's data changed since the backup, and guild 20's must survive the import
+	err = source.HSet(memberKey("10", "1"), map[string]string{"posts": "50"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = watches.add(&derpiWatch{GuildID: "10", ChannelID: "101", Query: "added later"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = settings.update("10", func(guild *guildSettings) {
+		guild.Prefix = "?"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := storeSnapshot(t, source)
+
+	err = importData(source, "10", exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if posts, _ := source.HGet(memberKey("10", "1"), "posts"); posts != "5" {
+		t.Errorf("guild 10's post count = %q, want 5", posts)
+	}
+	if prefix := settings.guild("10").Prefix; prefix != "!" {
+		t.Errorf("guild 10's prefix = %q, want !", prefix)
+	}
+	if list := watches.forGuild("10"); len(list) != 1 || list[0].Query != "pony" {
+		t.Errorf("guild 10's watches = %v, want just pony", list)
+	}
+	if list := watches.forGuild("20"); len(list) != 1 || list[0].Query != "cute" {
+		t.Errorf("guild 20's watches = %v, want just cute", list)
+	}
+	if booru := settings.guild("20").DefaultBooru; booru != "e621" {
+		t.Errorf("guild 20's settings changed: %v", settings.guild("20"))
+	}
+
+	after := storeSnapshot(t, source)
+	for key, entry := range other {
+		if key == memberKey("10", "1") {
+			continue
+		}
+		if !reflect.DeepEqual(after[key], entry) {
+			t.Errorf("%s = %v after importing guild 10, want %v", key, after[key], entry)
+		}
+	}
+
+	// a guild's backup can't be imported as another guild
+	exported = &bytes.Buffer{}
+	err = exportData(source, "10", exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = importData(source, "20", exported); err == nil {
+		t.Error("imported guild 10's backup as guild 20")
+	}
+}
+
+// A dry run reports what the migrations would do without changing anything
+func TestMigrateDryRun(t *testing.T) {
+	store := newMemoryStore()
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(store.Set(schemaVersionKey, "0", 0))
+	check(store.HSet(userKey("1"), map[string]string{"isBot": "1"}))
+	check(store.HSet(memberKey("10", "1"), map[string]string{"posts": "5"}))
+
+	before := storeSnapshot(t, store)
+	check(migrate(store, true))
+	if after := storeSnapshot(t, store); !reflect.DeepEqual(after, before) {
+		t.Errorf("dry run changed the database to %v, from %v", after, before)
+	}
+
+	// the real thing does change it
+	check(migrate(store, false))
+	if isBot, _ := store.HGet(userKey("1"), "isBot"); isBot != "true" {
+		t.Errorf("isBot = %q after migrating, want true", isBot)
+	}
+	if version, _ := schemaVersion(store); version != latestSchemaVersion() {
+		t.Errorf("schema version = %d after migrating, want %d", version, latestSchemaVersion())
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Somewhere to keep search results; implementations must be safe for concurrent use
+type derpiCacheBackend interface {
+	get(key string) (DerpiResults, bool)
+	set(key string, results DerpiResults, ttl time.Duration)
+	flush() error
+	size() int
+}
+
+// DerpiCache sits in front of the Derpibooru client so repeated searches don't hit the API
+type DerpiCache struct {
+	backend derpiCacheBackend
+	ttl     time.Duration
+	hits    uint64 // read and written atomically
+	misses  uint64 // read and written atomically
+}
+
+// Makes a cache using the given backend, keeping results for ttl
+func newDerpiCache(backend derpiCacheBackend, ttl time.Duration) *DerpiCache {
+	return &DerpiCache{backend: backend, ttl: ttl}
+}
+
+// Looks up cached results, counting the hit or miss
+func (cache *DerpiCache) get(key string) (DerpiResults, bool) {
+	results, ok := cache.backend.get(key)
+	if ok {
+		atomic.AddUint64(&cache.hits, 1)
+	} else {
+		atomic.AddUint64(&cache.misses, 1)
+	}
+	return results, ok
+}
+
+// Stores results for the cache's TTL
+func (cache *DerpiCache) set(key string, results DerpiResults) {
+	cache.backend.set(key, results, cache.ttl)
+}
+
+// Flush empties the cache and resets its counters
+func (cache *DerpiCache) Flush() error {
+	atomic.StoreUint64(&cache.hits, 0)
+	atomic.StoreUint64(&cache.misses, 0)
+	return cache.backend.flush()
+}
+
+// Stats returns the hit and miss counts and how many entries are stored
+func (cache *DerpiCache) Stats() (hits uint64, misses uint64, entries int) {
+	return atomic.LoadUint64(&cache.hits), atomic.LoadUint64(&cache.misses), cache.backend.size()
+}
+
+// Builds a cache key from search options, so trivially different queries share results
+// Tags are compared case-insensitively and without extra spaces, but tag order still matters
+// since reordering a query with ORs or brackets can change its meaning
+// The API key is part of the key because each account's default filter changes what's returned
+func derpiCacheKey(options DerpiSearchOptions, apiKey string) string {
+	terms := strings.Split(strings.ToLower(options.Query), ",")
+	for i, term := range terms {
+		terms[i] = strings.Join(strings.Fields(term), " ")
+	}
+	query := strings.Trim(strings.Join(terms, ","), ",")
+
+	return strings.Join([]string{
+		query,
+		"filter=" + strconv.Itoa(options.FilterID),
+		"sf=" + options.SortField,
+		"sd=" + options.SortDirection,
+		"page=" + strconv.Itoa(options.Page),
+		"per_page=" + strconv.Itoa(options.PerPage),
+		"account=" + hashKey(apiKey),
+	}, "|")
+}
+
+// Short hash of a string, so secrets like API keys aren't written into cache files
+func hashKey(value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha1.Sum([]byte(value))
+	return hex.EncodeToString(sum[:4])
+}
+
+// One cached result set
+type cacheEntry struct {
+	Key     string       `json:"key"`
+	Results DerpiResults `json:"results"`
+	Expires time.Time    `json:"expires"`
+}
+
+// In-memory backend holding a limited number of entries, dropping the least recently used
+type lruCache struct {
+	sync.Mutex
+	capacity int
+	entries  map[string]*list.Element // key -> element holding a *cacheEntry
+	order    *list.List               // most recently used at the front
+}
+
+func newLRUCache(capacity int) *lruCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &lruCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (cache *lruCache) get(key string) (DerpiResults, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return DerpiResults{}, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.Expires) {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return DerpiResults{}, false
+	}
+
+	cache.order.MoveToFront(element)
+	return entry.Results, true
+}
+
+func (cache *lruCache) set(key string, results DerpiResults, ttl time.Duration) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	entry := &cacheEntry{Key: key, Results: results, Expires: time.Now().Add(ttl)}
+
+	if element, ok := cache.entries[key]; ok {
+		element.Value = entry
+		cache.order.MoveToFront(element)
+		return
+	}
+
+	cache.entries[key] = cache.order.PushFront(entry)
+
+	for cache.order.Len() > cache.capacity {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).Key)
+	}
+}
+
+func (cache *lruCache) flush() error {
+	cache.Lock()
+	defer cache.Unlock()
+
+	cache.entries = make(map[string]*list.Element)
+	cache.order.Init()
+	return nil
+}
+
+func (cache *lruCache) size() int {
+	cache.Lock()
+	defer cache.Unlock()
+	return cache.order.Len()
+}
+
+// Prefix of the database keys the Derpibooru cache uses; backups leave these out (see backup.go)
+const storeCachePrefix = "derpicache:"
+
+// Sorted set of cached entries' keys, scored by when each was last used in milliseconds
+const storeCacheUsedKey = storeCachePrefix + "used"
+
+// Backend keeping results in the database, so several instances sharing Redis also share results
+// Each entry is a key which expires along with its results; when there are more than 'capacity',
+// the least recently used are found through storeCacheUsedKey and removed
+type storeCache struct {
+	store    Store
+	capacity int
+}
+
+func newStoreCache(store Store, capacity int) *storeCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &storeCache{store: store, capacity: capacity}
+}
+
+// Database key for a cache key; cache keys can be long and contain anything
+func (cache *storeCache) entryKey(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return storeCachePrefix + "entry:" + hex.EncodeToString(sum[:])
+}
+
+// Score recording a use in storeCacheUsedKey
+func cacheUseScore(now time.Time) float64 {
+	return float64(now.UnixNano() / int64(time.Millisecond))
+}
+
+func (cache *storeCache) get(key string) (DerpiResults, bool) {
+	entryKey := cache.entryKey(key)
+	data, err := cache.store.Get(entryKey)
+	if err == ErrNotFound {
+		// expired, so it no longer needs evicting
+		cache.store.ZRem(storeCacheUsedKey, entryKey)
+		return DerpiResults{}, false
+	}
+	if err != nil {
+		fmt.Println(err)
+		return DerpiResults{}, false
+	}
+
+	entry := cacheEntry{}
+	if json.Unmarshal([]byte(data), &entry) != nil || entry.Key != key {
+		return DerpiResults{}, false
+	}
+
+	err = cache.store.ZAdd(storeCacheUsedKey, entryKey, cacheUseScore(time.Now()))
+	if err != nil {
+		fmt.Println(err)
+	}
+	return entry.Results, true
+}
+
+func (cache *storeCache) set(key string, results DerpiResults, ttl time.Duration) {
+	data, err := json.Marshal(cacheEntry{Key: key, Results: results, Expires: time.Now().Add(ttl)})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	entryKey := cache.entryKey(key)
+	err = cache.store.Set(entryKey, string(data), ttl)
+	if err == nil {
+		err = cache.store.ZAdd(storeCacheUsedKey, entryKey, cacheUseScore(time.Now()))
+	}
+	if err == nil {
+		err = cache.evict()
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Removes the least recently used entries until there are at most 'capacity'
+func (cache *storeCache) evict() error {
+	count, err := cache.store.ZCard(storeCacheUsedKey)
+	if err != nil || count <= int64(cache.capacity) {
+		return err
+	}
+
+	oldest, err := cache.store.ZRange(storeCacheUsedKey, 0, count-int64(cache.capacity)-1, false)
+	if err != nil {
+		return err
+	}
+	entryKeys := []string{}
+	for _, member := range oldest {
+		entryKeys = append(entryKeys, member.Member)
+	}
+	err = cache.store.Delete(entryKeys...)
+	if err != nil {
+		return err
+	}
+	return cache.store.ZRem(storeCacheUsedKey, entryKeys...)
+}
+
+func (cache *storeCache) flush() error {
+	keys, err := cache.store.Keys(storeCachePrefix + "*")
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	return cache.store.Delete(keys...)
+}
+
+// Counts entries which expired without being looked up again too, until they're evicted
+func (cache *storeCache) size() int {
+	count, err := cache.store.ZCard(storeCacheUsedKey)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return int(count)
+}
+
+// Sets up the Derpibooru cache from the environment; a TTL of 0 turns caching off
+// Results are kept in the database if there is one, otherwise in memory
+func initDerpiCache() *DerpiCache {
+	if cfg.DerpiCacheTTL <= 0 {
+		DebugPrint("Derpibooru cache disabled.")
+		return nil
+	}
+
+	if db != nil {
+		DebugPrint("Derpibooru results are cached in the database.")
+		return newDerpiCache(newStoreCache(db, cfg.DerpiCacheSize), cfg.DerpiCacheTTL)
+	}
+
+	return newDerpiCache(newLRUCache(cfg.DerpiCacheSize), cfg.DerpiCacheTTL)
+}
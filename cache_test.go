@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStoreCache(t *testing.T) {
+	store := newMemoryStore()
+	cache := newStoreCache(store, 2)
+	results := func(total int) DerpiResults {
+		return DerpiResults{Total: total}
+	}
+
+	cache.set("a", results(1), time.Minute)
+	time.Sleep(2 * time.Millisecond)
+	cache.set("b", results(2), time.Minute)
+	time.Sleep(2 * time.Millisecond)
+
+	// using a makes b the least recently used, so it goes when c arrives
+	if got, ok := cache.get("a"); !ok || got.Total != 1 {
+		t.Errorf("get(a) = %v, %v; want 1, true", got.Total, ok)
+	}
+	time.Sleep(2 * time.Millisecond)
+	cache.set("c", results(3), time.Minute)
+
+	if _, ok := cache.get("b"); ok {
+		t.Error("b wasn't evicted")
+	}
+	if got, ok := cache.get("a"); !ok || got.Total != 1 {
+		t.Errorf("get(a) = %v, %v; want 1, true", got.Total, ok)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if got, ok := cache.get("c"); !ok || got.Total != 3 {
+		t.Errorf("get(c) = %v, %v; want 3, true", got.Total, ok)
+	}
+	if size := cache.size(); size != 2 {
+		t.Errorf("size = %d, want 2", size)
+	}
+
+	// expired entries are gone, and stop counting once looked up
+	time.Sleep(2 * time.Millisecond)
+	cache.set("d", results(4), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := cache.get("d"); ok {
+		t.Error("d didn't expire")
+	}
+	if size := cache.size(); size != 1 {
+		t.Errorf("size after expiry = %d, want 1", size)
+	}
+
+	// another instance using the same database sees the same results
+	other := newStoreCache(store, 2)
+	if got, ok := other.get("c"); !ok || got.Total != 3 {
+		t.Errorf("other instance get(c) = %v, %v; want 3, true", got.Total, ok)
+	}
+
+	err := cache.flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := store.Keys("*"); len(keys) != 0 {
+		t.Errorf("flush left %v", keys)
+	}
+}
@@ -1,28 +1,46 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/bwmarrin/discordgo"
-	"io"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // generic command struct which contains name, description, and a function
 type command struct {
-	name             string                                                                                          // human-readable name of the command
-	description      string                                                                                          // description of command's function
-	usage            string                                                                                          // example of how to correctly use command - [] for optional arguments, <> for required arguments
-	verbs            []string                                                                                        // all verbs which are mapped to the same command
-	requiresDatabase bool                                                                                            // does this command require database access?
-	function         func([]string, *discordgo.Channel, *discordgo.MessageCreate, *discordgo.Session) *commandOutput // function which receives a slice of arguments and returns a string to display to the user
+	name             string                                                                                              // human-readable name of the command
+	description      string                                                                                              // description of command's function
+	category         string                                                                                              // which group the help command lists it under
+	arguments        []argument                                                                                          // arguments the command accepts, in order (see args.go); the usage line is built from these
+	verbs            []string                                                                                            // all verbs which are mapped to the same command
+	requiresDatabase bool                                                                                                // does this command require database access?
+	permissions      int                                                                                                 // Discord permissions (discordgo.Permission*) the caller needs in the channel
+	allowRoles       []string                                                                                            // if not empty, the caller needs at least one of these roles (ID or name)
+	denyRoles        []string                                                                                            // callers with any of these roles (ID or name) are refused
+	guildOwnerOnly   bool                                                                                                // only the owner of the guild may run this
+	botOwnerOnly     bool                                                                                                // only the bot's owners (BOT_OWNERS) may run this
+	cooldowns        []cooldown                                                                                          // limits on how often the command can be used (see cooldown.go)
+	rerunOnEdit      func(*commandArgs) bool                                                                             // whether editing the command re-runs it (see replies.go); set only for invocations which don't change anything
+	function         func(*commandArgs, *discordgo.Channel, *discordgo.MessageCreate, *discordgo.Session) *commandOutput // function which receives validated arguments and returns output to display to the user
 }
 
-// output returned by all command functions, can contain a file to be uploaded
+// output returned by all command functions, can contain files to be uploaded
 type commandOutput struct {
-	response string
-	file     io.Reader
-	embed    *discordgo.MessageEmbed
+	response  string                    // text of the reply
+	files     []*outputFile             // files to upload with the reply (see output.go)
+	embed     *discordgo.MessageEmbed   // main embed, sent along with the text
+	embeds    []*discordgo.MessageEmbed // any further embeds, each sent as its own message
+	pages     []*discordgo.MessageEmbed // pages flipped through with reactions by the caller, shown before any other embeds (see paginator.go)
+	reactions []string                  // emoji to react to the reply with
+	direct    bool                      // send to the caller's DMs instead of the channel
+	ttl       time.Duration             // if set, the reply is deleted after this long
+	err       error                     // set when the command failed unexpectedly; the user gets a short error ID and the details go to OWNER_LOG_CHANNEL
 }
 
 func initCommands() map[string]*command {
@@ -31,52 +49,132 @@ func initCommands() map[string]*command {
 	commandList = append(commandList,
 
 		// Define all commands here in the order they will be displayed by the help command
-		// The 'usage' field should use the default verb
-		// Do not include the command prefix
+		// The first verb is the default; it is used in the generated usage line
 
 		&command{
 			name:             "Display help",
-			description:      "Lists all commands and their purposes.\nCan also display detailed info about a given command.",
-			usage:            "help [verb]",
+			description:      "Lists all commands and their purposes.\nCan also display detailed info about a given command, list the commands in a category, or search with `help search <words>`.",
+			category:         "General",
+			arguments: []argument{
+				{name: "topic", description: "Command or category to show, or `search`."},
+				{name: "words", kind: argRest, description: "What to look for, after `search`."},
+			},
 			verbs:            []string{"help", "commands"},
 			requiresDatabase: false,
-			function: func(args []string, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+			rerunOnEdit:      rerunAlways,
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
 
 				DebugPrint("Running help command.")
 
-				if len(args) <= 0 {
+				prefix := guildPrefix(channel.GuildID)
+
+				// only list commands the caller is allowed to run here
+				available := []*command{}
+				for _, cmd := range commandList {
+					if canRun(discordSession, cmd, msgEvent.Author.ID, channel) {
+						available = append(available, cmd)
+					}
+				}
+
+				// categories in the order they first appear
+				categories := []string{}
+				for _, cmd := range available {
+					found := false
+					for _, category := range categories {
+						if category == cmd.category {
+							found = true
+						}
+					}
+					if !found {
+						categories = append(categories, cmd.category)
+					}
+				}
+
+				// one field per command, split into pages if there are too many
+				listCommands := func(title string, cmds []*command) *commandOutput {
+					fields := []*discordgo.MessageEmbedField{}
+					for _, cmd := range cmds {
+						summary := strings.SplitN(cmd.description, "\n", 2)[0]
+						fields = append(fields, &discordgo.MessageEmbedField{Name: cmd.name, Value: "`" + prefix + cmd.usage() + "`\n" + summary})
+					}
+					embed := NewEmbed().
+						SetTitle(title).
+						SetDescription("Use `" + prefix + "help <verb>` for details about a command.")
+					return &commandOutput{pages: pagesFromFields(embed.MessageEmbed, fields, 10)}
+				}
+
+				if !args.Has("topic") {
 
 					DebugPrint("No arguments; listing commands.")
 
+					categoryNames := []string{}
+					for _, category := range categories {
+						categoryNames = append(categoryNames, "`"+strings.ToLower(category)+"`")
+					}
+
 					embed := NewEmbed().
 						SetTitle("Source").
-						SetAuthor("Sunbot " + version).
-						//SetDescription("Database enabled: " + strconv.FormatBool(redisEnabled)).
+						SetAuthor("Sunbot "+version).
+						SetDescription("Categories: "+strings.Join(categoryNames, ", ")+"\nUse `"+prefix+"help <category>` to see just one, or `"+prefix+"help search <words>` to search.").
 						SetURL("https://github.com/techniponi/sunbot").
 						SetImage(discordSession.State.User.AvatarURL("128"))
 
-					for _, cmd := range commandList {
-						/*
-						if cmd.requiresDatabase && !redisEnabled {
-							// Database is not enabled, this command needs it
-						} else {
-						*/
-							embed.AddField(cmd.name, "`"+cfg.DefaultPrefix+cmd.usage+"`")
-						//}
+					// one field per category, listing its commands
+					fields := []*discordgo.MessageEmbedField{}
+					for _, category := range categories {
+						list := ""
+						for _, cmd := range available {
+							if cmd.category == category {
+								list += "`" + prefix + cmd.usage() + "` - " + cmd.name + "\n"
+							}
+						}
+						fields = append(fields, &discordgo.MessageEmbedField{Name: category, Value: list})
 					}
 
-					return &commandOutput{embed: embed.MessageEmbed}
+					// too many categories for one embed get split into pages
+					return &commandOutput{pages: pagesFromFields(embed.MessageEmbed, fields, 5)}
+				}
+
+				topic := strings.ToLower(strings.TrimPrefix(args.String("topic"), prefix))
+
+				if topic == "search" {
+					if !args.Has("words") {
+						return &commandOutput{response: "What should I search for? Try `" + prefix + "help search image`."}
+					}
+					DebugPrint("Searching commands.")
+					results := searchCommands(available, args.String("words"))
+					if len(results) == 0 {
+						return &commandOutput{response: "No commands matched `" + args.String("words") + "`."}
+					}
+					return listCommands("Commands matching \""+args.String("words")+"\"", results)
+				}
+
+				for _, category := range categories {
+					if strings.ToLower(category) == topic {
+						DebugPrint("Listing commands in category " + category)
+						inCategory := []*command{}
+						for _, cmd := range available {
+							if cmd.category == category {
+								inCategory = append(inCategory, cmd)
+							}
+						}
+						return listCommands(category+" commands", inCategory)
+					}
 				}
 
 				DebugPrint("Verb was given...")
 
 				// check if command exists
-				if cmd, ok := commands[args[0]]; ok {
+				if cmd, ok := commands[topic]; ok && canRun(discordSession, cmd, msgEvent.Author.ID, channel) {
 
 					embed := NewEmbed().
 						SetTitle(cmd.name).
 						SetDescription(cmd.description).
-						AddField("Usage", "`"+cfg.DefaultPrefix+cmd.usage+"`")
+						AddField("Usage", "`"+prefix+cmd.usage()+"`")
+
+					if argumentHelp := cmd.argumentHelp(); argumentHelp != "" {
+						embed.AddField("Arguments", argumentHelp)
+					}
 
 					DebugPrint("Providing help for given verb.")
 
@@ -85,131 +183,517 @@ func initCommands() map[string]*command {
 					for index, verb := range cmd.verbs {
 						// don't add a comma if it's the last one
 						if index == (len(cmd.verbs) - 1) {
-							verbOutput += "`" + cfg.DefaultPrefix + verb + "`"
+							verbOutput += "`" + prefix + verb + "`"
 						} else {
-							verbOutput += "`" + cfg.DefaultPrefix + verb + "`, "
+							verbOutput += "`" + prefix + verb + "`, "
 						}
 					}
 					embed.AddField("Verbs", verbOutput)
+					embed.AddField("Category", cmd.category)
 					return &commandOutput{embed: embed.MessageEmbed}
 				}
 				DebugPrint("Given verb was not found.")
-				return &commandOutput{response: "That isn't a valid command."}
+				return &commandOutput{response: "That isn't a valid command or category." + didYouMean(discordSession, topic, prefix, msgEvent.Author.ID, channel)}
 			},
 		},
 
 		&command{
 			name:             "Derpibooru search",
-			description:      "Searches Derpibooru with the given tags as the query, chooses a random result to display.\nUse commas to separate tags like you would on the website.",
-			usage:            "derpi <tags>",
+			description:      "Searches Derpibooru with the given tags as the query, chooses a random result to display.\nUse commas to separate tags like you would on the website.\nWith `--sort`, the top result in that order is shown instead.\n`derpi id <number>` shows one image by its number.\n`derpi watch <query>` posts new uploads matching a query to this channel; `derpi watches` lists them and `derpi unwatch <number>` stops one (changing watches needs Manage Channels).",
+			category:         "Images",
+			arguments: []argument{
+				{name: "tags", kind: argRest, required: true, description: "Search query, exactly as you would type it on the website."},
+				{name: "sort", flag: true, choices: []string{DerpiSortScore, DerpiSortRandom, DerpiSortCreated, DerpiSortWilson}, description: "Order to sort results in."},
+				{name: "order", flag: true, choices: []string{"desc", "asc"}, defaultValue: "desc", description: "Sort direction."},
+				{name: "page", flag: true, kind: argInt, defaultValue: "1", description: "Page of results to pick from."},
+				{name: "per-page", flag: true, kind: argInt, defaultValue: "15", description: "Results per page, up to 50."},
+				{name: "filter", flag: true, kind: argInt, description: "ID of a Derpibooru filter to search with."},
+			},
 			verbs:            []string{"derpi", "db", "derpibooru"},
 			requiresDatabase: false,
-			function: func(args []string, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
-				if len(args) < 1 {
-					DebugPrint("User ran derpibooru command with no tags given.")
-					return &commandOutput{response: "Error: no tags specified"}
-				}
+			rerunOnEdit:      rerunUnless("tags", "watch", "unwatch"),
+			cooldowns: []cooldown{
+				{scope: perUser, period: 10 * time.Second, burst: 3},
+				{scope: perChannel, period: 3 * time.Second, burst: 5},
+			},
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
 				DebugPrint("User is running derpibooru command...")
 
-				searchQuery := ""
-
-				for _, arg := range args {
-					searchQuery += arg + " "
+				// subcommands use the first word, like `derpi watch <query>` (see watches.go) or `derpi id <number>` (see derpilinks.go)
+				words := strings.Fields(args.String("tags"))
+				switch words[0] {
+				case "watch", "unwatch", "watches":
+					rest := strings.TrimSpace(strings.TrimPrefix(args.String("tags"), words[0]))
+					return derpiWatchCommand(words[0], rest, channel, msgEvent, discordSession)
+				case "id":
+					return derpiIDCommand(strings.TrimSpace(strings.TrimPrefix(args.String("tags"), words[0])), channel)
 				}
 
-				// enforce 'safe' tag if channel is not nsfw
-				if !channel.NSFW {
-					DebugPrint("Channel #" + channel.Name + " is SFW, adding safe tag...")
-					searchQuery += ",safe"
+				// the channel's policy decides which ratings and tags are allowed (see policy.go)
+				policy := channelPolicy(channel)
+				searchQuery, err := policy.query(args.String("tags"))
+				if err != nil {
+					// caught before asking Derpibooru, which would give a much less helpful error
+					return &commandOutput{response: describeQueryError(err, args.String("tags"))}
 				}
 
 				DebugPrint("Searching with tags:\n" + searchQuery)
 
+				if args.Int("page") < 1 || args.Int("per-page") < 1 || args.Int("per-page") > DerpiMaxPerPage {
+					return &commandOutput{response: "Error: `--page` must be at least 1, and `--per-page` between 1 and " + strconv.Itoa(DerpiMaxPerPage) + "."}
+				}
+
+				ctx, cancel := context.WithTimeout(context.Background(), cfg.DerpiTimeout)
+				defer cancel()
+
 				// use derpibooru.go to perform search
-				results, err := DerpiSearchWithTags(searchQuery, cfg.DerpiApiKey)
+				results, err := derpi.Search(ctx, DerpiSearchOptions{
+					Query:         searchQuery,
+					Page:          args.Int("page"),
+					PerPage:       args.Int("per-page"),
+					SortField:     args.String("sort"),
+					SortDirection: args.String("order"),
+					FilterID:      policy.filter(args.Int("filter")),
+				})
 				if err != nil {
 					fmt.Println(err)
 					return &commandOutput{response: "Error: " + err.Error()}
 				}
 
-				// check for results
-				if len(results.Search) <= 0 {
+				// check for results, in case the query let something through which the policy doesn't allow
+				allowed := policy.filterImages(results.Search)
+				if len(allowed) < len(results.Search) {
+					DebugPrint("Policy removed " + strconv.Itoa(len(results.Search)-len(allowed)) + " results.")
+				}
+				if len(allowed) <= 0 {
 					DebugPrint("Derpibooru returned no results.")
+					if results.Total > 0 {
+						return &commandOutput{response: "Error: no results."}
+					}
+					// nothing matched at all, so a tag is probably misspelled (see derpitags.go)
+					hintCtx, hintCancel := context.WithTimeout(context.Background(), cfg.DerpiTimeout)
+					defer hintCancel()
+					if hint := noResultsHint(hintCtx, args.String("tags")); hint != "" {
+						return &commandOutput{response: "Error: no results.\n" + hint}
+					}
 					return &commandOutput{response: "Error: no results."}
 				}
 				DebugPrint("Derpibooru returned results; parsed successfully.")
-				// pick one randomly
-				output := "http:" + results.Search[RandomRange(0, len(results.Search))].Image
+				// pick one randomly, unless the user asked for a particular order
+				choice := RandomRange(0, len(allowed))
+				if args.Has("sort") {
+					choice = 0
+				}
+				return derpiImageOutput(allowed[choice], derpiSearchFooter(args.String("tags"), results.Total))
+			},
+		},
+
+		&command{
+			name:             "Daily image",
+			description:      "Posts an image here every day: Derpibooru's featured image, or the top scoring image of the last 24 hours for a query.\n`daily featured <time> [timezone]` or `daily top <time> [timezone] [query]` sets one up (times are 24-hour, like `08:30`, and the timezone is a name like `Europe/London`, UTC if left out).\n`daily list` shows them and `daily remove <number>` removes one. Changing them needs Manage Channels.",
+			category:         "Images",
+			arguments: []argument{
+				{name: "action", kind: argRest, description: "`featured`, `top`, `list` or `remove`, followed by its details."},
+			},
+			verbs:            []string{"daily"},
+			requiresDatabase: false,
+			rerunOnEdit:      rerunWhen("action", "", "list"),
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
 
-				return &commandOutput{response: output}
+				// see schedules.go
+				return dailyCommand(args.String("action"), channel, msgEvent, discordSession)
 			},
 		},
 
 		&command{
-			name: "Exec",
-			description: "Execute a shell command on my server.\nRequires admin permissions.",
-			usage: "exec <command>",
-			verbs: []string{"exec"},
+			name:             "Derpibooru tag",
+			description:      "Shows a Derpibooru tag's description, image count, aliases and implied tags.\nIf there's no such tag, close names are suggested instead.",
+			category:         "Images",
+			arguments: []argument{
+				{name: "name", kind: argRest, required: true, description: "Name of the tag, like `artist:foo` or `twilight sparkle`."},
+			},
+			verbs:            []string{"tag"},
+			requiresDatabase: false,
+			rerunOnEdit:      rerunAlways,
+			cooldowns: []cooldown{
+				{scope: perUser, period: 10 * time.Second, burst: 3},
+			},
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+
+				ctx, cancel := context.WithTimeout(context.Background(), cfg.DerpiTimeout)
+				defer cancel()
+
+				// lookups are cached (see derpitags.go)
+				return tagOutput(ctx, strings.Join(strings.Fields(args.String("name")), " "))
+			},
+		},
+
+		&command{
+			name:             "Image board search",
+			description:      "Searches an image board with the given query and shows a random result.\nSites are " + strings.Join(boardSites, ", ") + "; leave the site out to use this server's default. Queries use each site's own syntax.\n`booru sites` lists the sites, and members with Manage Server can change the default with `booru default <site>`.",
+			category:         "Images",
+			arguments: []argument{
+				{name: "query", kind: argRest, required: true, description: "Site (optional), then the search query, like `e621 pony solo`."},
+			},
+			verbs:            []string{"booru"},
 			requiresDatabase: false,
-			function: func(args []string, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+			rerunOnEdit:      rerunUnless("query", "default"),
+			cooldowns: []cooldown{
+				{scope: perUser, period: 10 * time.Second, burst: 3},
+				{scope: perChannel, period: 3 * time.Second, burst: 5},
+			},
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+
+				query := args.String("query")
+				word := strings.Fields(query)[0]
+				first := strings.ToLower(word)
+				rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(query), word))
+
+				switch first {
+				case "sites":
+					return &commandOutput{response: "I can search " + strings.Join(boardSites, ", ") + ".\nThe default here is " + defaultBoard(channel.GuildID) + "."}
+				case "default":
+					return setDefaultBoard(rest, channel, msgEvent, discordSession)
+				}
 
-				hasPermission := false
+				site := defaultBoard(channel.GuildID)
+				if name, ok := boardSiteName(first); ok {
+					site = name
+					query = rest
+				}
+				board := boards[site]
+				if query == "" {
+					return &commandOutput{response: "What should I search " + board.Name() + " for?"}
+				}
+
+				ctx, cancel := context.WithTimeout(context.Background(), cfg.DerpiTimeout)
+				defer cancel()
 
-				// get user object
-				DebugPrint("Getting user object")
-				user, err := discordSession.State.Member(channel.GuildID, msgEvent.Author.ID)
+				// each board adds the channel's policy in its own syntax (see imageboard.go)
+				policy := channelPolicy(channel)
+				if site != "derpibooru" && len(policy.excludedTagIDs()) > 0 {
+					return &commandOutput{response: "This channel's image policy excludes tags by Derpibooru tag ID (" + strings.Join(policy.excludedTagIDs(), ", ") + "), which " + board.Name() + " can't be checked against. Ask an admin to exclude them by name instead."}
+				}
+				results, err := board.Search(ctx, query, policy)
+				if _, ok := err.(*querySyntaxError); ok {
+					return &commandOutput{response: describeQueryError(err, query)}
+				}
 				if err != nil {
 					fmt.Println(err)
-					return &commandOutput{response: "Error getting user from exec command"}
+					return &commandOutput{response: "Error: " + err.Error()}
 				}
 
-				// get roles from that user
-				DebugPrint("Getting user's roles")
-				for _, roleID := range user.Roles {
-					role, err := discordSession.State.Role(channel.GuildID, roleID)
-					if err != nil {
-						fmt.Println(err)
-						return &commandOutput{response: "Error getting roles from user"}
+				// check every result ourselves too, since each site maps ratings differently
+				allowed := []BoardImage{}
+				for _, image := range results.Images {
+					if ok, _ := policy.allowsBoardImage(image); ok {
+						allowed = append(allowed, image)
 					}
+				}
+				if len(allowed) == 0 {
+					return &commandOutput{response: "Error: no results."}
+				}
+
+				footer := board.Name() + " search: " + query + " • " + strconv.Itoa(results.Total) + " results"
+				return boardImageOutput(allowed[RandomRange(0, len(allowed))], footer)
+			},
+		},
+
+		&command{
+			name:             "Find source",
+			description:      "Looks for an image on Derpibooru and shows where it came from.\nAttach the image, give a link to it, reply to it, or use this right after someone posts it.",
+			category:         "Images",
+			arguments: []argument{
+				{name: "url", description: "Link to the image; leave out to use an attachment or a recent image."},
+			},
+			verbs:            []string{"source", "sauce"},
+			requiresDatabase: false,
+			rerunOnEdit:      rerunAlways,
+			cooldowns: []cooldown{
+				{scope: perUser, period: 15 * time.Second, burst: 2},
+			},
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
 
-					DebugPrint("Checking for admin permission")
-					if role.Permissions&discordgo.PermissionAdministrator != 0 {
-						hasPermission = true
+				imageURL, err := sourceImageURL(discordSession, args.String("url"), msgEvent)
+				if err != nil {
+					return &commandOutput{response: err.Error()}
+				}
+				DebugPrint("Reverse searching " + imageURL)
+
+				ctx, cancel := context.WithTimeout(context.Background(), cfg.DerpiTimeout)
+				defer cancel()
+
+				matches, err := derpi.ReverseSearch(ctx, imageURL, 0)
+				if err != nil {
+					fmt.Println(err)
+					return &commandOutput{response: "Error: " + err.Error()}
+				}
+				return sourceOutput(matches, channel)
+			},
+		},
+
+		&command{
+			name:             "Automatic source finding",
+			description:      "Sets whether images posted in this channel without a link are looked up on Derpibooru.\nI only reply when I'm confident of a match.",
+			category:         "Admin",
+			arguments: []argument{
+				{name: "mode", required: true, choices: []string{"on", "off"}},
+			},
+			verbs:            []string{"autosource"},
+			requiresDatabase: false,
+			permissions:      discordgo.PermissionManageChannels,
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+
+				enable := args.String("mode") == "on"
+				err := settings.update(channel.GuildID, func(guild *guildSettings) {
+					channels := []string{}
+					for _, id := range guild.AutoSourceChannels {
+						if id != channel.ID {
+							channels = append(channels, id)
+						}
 					}
+					if enable {
+						channels = append(channels, channel.ID)
+					}
+					guild.AutoSourceChannels = channels
+				})
+				if err != nil {
+					fmt.Println(err)
+					return &commandOutput{response: "Error saving settings"}
 				}
 
-				if hasPermission {
+				if enable {
+					return &commandOutput{response: "Okay, I'll look for the source of images posted here without a link."}
+				}
+				return &commandOutput{response: "Okay, I'll stop looking for sources here."}
+			},
+		},
 
-					// convert slice to single string
-					fullCommand := ""
-					for _, arg := range args {
-						fullCommand += arg + " "
+		&command{
+			name: "Exec",
+			description: "Execute a shell command on my server.\nOnly the bot's owners can use this.",
+			category:         "Admin",
+			arguments: []argument{
+				{name: "command", kind: argRest, required: true, description: "Shell command to run, passed to bash as typed."},
+			},
+			verbs: []string{"exec"},
+			requiresDatabase: false,
+			botOwnerOnly: true,
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+
+				cmd := exec.Command("/bin/bash", "-c", args.String("command"))
+				stdout, err := cmd.Output()
+
+				if err != nil {
+					fmt.Println(err)
+					return &commandOutput{response: "Error running command"}
+				}
+
+				// long output won't fit in a message, so upload it instead
+				if len(stdout)+len("```sh\n\n```") > messageLimit {
+					return &commandOutput{
+						files: []*outputFile{{name: "output.txt", reader: bytes.NewReader(stdout)}},
 					}
+				}
+
+				return &commandOutput{
+					response: "```sh\n" + string(stdout) + "\n```",
+				}
+			},
+		},
+
+		&command{
+			name:             "Prefix",
+			description:      "Shows the command prefix used in this server.\nMembers with Manage Server can change it, or use `reset` to go back to the default.\nMentioning me works as a prefix everywhere.",
+			category:         "Admin",
+			arguments: []argument{
+				{name: "prefix", description: "New prefix to use in this server, or `reset`."},
+			},
+			verbs:            []string{"prefix"},
+			requiresDatabase: false,
+			rerunOnEdit:      rerunWhen("prefix", ""),
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+
+				if !args.Has("prefix") {
+					return &commandOutput{response: "The prefix here is `" + guildPrefix(channel.GuildID) + "`."}
+				}
 
-					cmd := exec.Command("/bin/bash", "-c", fullCommand)
-					stdout, err := cmd.Output()
+				if channel.GuildID == "" {
+					return &commandOutput{response: "The prefix can only be changed in a server."}
+				}
+
+				if denied := requirePermission(discordSession, msgEvent, channel, discordgo.PermissionManageServer, "change the prefix"); denied != nil {
+					return denied
+				}
+
+				newPrefix := args.String("prefix")
+				if newPrefix == "reset" {
+					newPrefix = ""
+				} else if err := validatePrefix(newPrefix); err != nil {
+					return &commandOutput{response: err.Error()}
+				}
+
+				err := settings.update(channel.GuildID, func(guild *guildSettings) {
+					guild.Prefix = newPrefix
+				})
+				if err != nil {
+					fmt.Println(err)
+					return &commandOutput{response: "Error saving settings"}
+				}
 
+				DebugPrint("Prefix for guild " + channel.GuildID + " changed to '" + newPrefix + "'")
+				return &commandOutput{response: "Done! The prefix here is now `" + guildPrefix(channel.GuildID) + "`."}
+			},
+		},
+
+		&command{
+			name:             "Unknown command replies",
+			description:      "Sets whether I reply when someone uses a command that doesn't exist in this server.\n`silent` is useful if another bot shares my prefix.",
+			category:         "Admin",
+			arguments: []argument{
+				{name: "mode", required: true, choices: []string{"reply", "silent"}},
+			},
+			verbs:            []string{"unknowncommands"},
+			requiresDatabase: false,
+			permissions:      discordgo.PermissionManageServer,
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+
+				silent := args.String("mode") == "silent"
+				err := settings.update(channel.GuildID, func(guild *guildSettings) {
+					guild.SilentUnknownCommands = silent
+				})
+				if err != nil {
+					fmt.Println(err)
+					return &commandOutput{response: "Error saving settings"}
+				}
+
+				if silent {
+					return &commandOutput{response: "Okay, I'll stay quiet when a command doesn't exist."}
+				}
+				return &commandOutput{response: "Okay, I'll let people know when a command doesn't exist."}
+			},
+		},
+
+		&command{
+			name:             "Silly commands",
+			description:      "Sets whether the silly commands, which don't use the prefix, work in this server.",
+			category:         "Admin",
+			arguments: []argument{
+				{name: "mode", required: true, choices: []string{"on", "off"}},
+			},
+			verbs:            []string{"silly"},
+			requiresDatabase: false,
+			permissions:      discordgo.PermissionManageServer,
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+
+				enabled := args.String("mode") == "on"
+				err := settings.update(channel.GuildID, func(guild *guildSettings) {
+					guild.SillyCommands = &enabled
+				})
+				if err != nil {
+					fmt.Println(err)
+					return &commandOutput{response: "Error saving settings"}
+				}
+
+				if enabled {
+					return &commandOutput{response: "Okay, the silly commands are on here."}
+				}
+				return &commandOutput{response: "Okay, the silly commands are off here."}
+			},
+		},
+
+		&command{
+			name:             "Derpibooru cache",
+			description:      "Shows how well the Derpibooru search cache is working, or empties it with `flush`.\nOnly the bot's owners can use this, since the cache is shared by every server.",
+			category:         "Admin",
+			arguments: []argument{
+				{name: "action", choices: []string{"stats", "flush"}, defaultValue: "stats"},
+			},
+			verbs:            []string{"derpicache"},
+			requiresDatabase: false,
+			rerunOnEdit:      rerunWhen("action", "stats"),
+			botOwnerOnly:     true,
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+
+				if derpi.Cache == nil {
+					return &commandOutput{response: "The Derpibooru cache is turned off (`DERPIBOORU_CACHE_TTL` is 0)."}
+				}
+
+				if args.String("action") == "flush" {
+					err := derpi.Cache.Flush()
 					if err != nil {
 						fmt.Println(err)
-						return &commandOutput{response: "Error running command"}
+						return &commandOutput{response: "Error emptying the cache"}
 					}
+					DebugPrint("Derpibooru cache flushed by " + msgEvent.Author.Username)
+					return &commandOutput{response: "Done! The Derpibooru cache is empty."}
+				}
 
-					return &commandOutput{
-						response: "```sh\n" + string(stdout) + "\n```",
-					}
-				}else{
-					return &commandOutput{response: "Sorry, but only administrators can use that command."}
+				hits, misses, entries := derpi.Cache.Stats()
+				hitRate := "n/a"
+				if hits+misses > 0 {
+					hitRate = strconv.FormatFloat(float64(hits)*100/float64(hits+misses), 'f', 1, 64) + "%"
 				}
+
+				embed := NewEmbed().
+					SetTitle("Derpibooru cache").
+					AddField("Hits", strconv.FormatUint(hits, 10)).
+					AddField("Misses", strconv.FormatUint(misses, 10)).
+					AddField("Hit rate", hitRate).
+					AddField("Entries", strconv.Itoa(entries)+" / "+strconv.Itoa(cfg.DerpiCacheSize)).
+					AddField("Expiry", cfg.DerpiCacheTTL.String()).
+					InlineAllFields()
+				return &commandOutput{embed: embed.MessageEmbed}
+			},
+		},
+
+		&command{
+			name:             "Image policy",
+			description:      "Shows or changes what image searches may show in this server, or with `--channel` just this channel.\n`ratings safe,suggestive` sets the allowed ratings (`default` to clear), `exclude gore,blood` adds tags (or Derpibooru tag IDs, which only work on Derpibooru) that are never shown, `include gore` takes them off the list again (`exclude none` clears it), `filter <id>` forces a Derpibooru filter (`none` to clear), `explicit on|off|default` sets whether NSFW channels may show explicit images, and `reset` clears everything.\nChannels that aren't NSFW never show more than safe and suggestive images.",
+			category:         "Admin",
+			arguments: []argument{
+				{name: "setting", choices: []string{"show", "ratings", "exclude", "include", "filter", "explicit", "reset"}, defaultValue: "show"},
+				{name: "value", kind: argRest, description: "New value for the setting."},
+				{name: "channel", flag: true, kind: argBool, description: "Change this channel's settings instead of the server's."},
+			},
+			verbs:            []string{"policy"},
+			requiresDatabase: false,
+			rerunOnEdit:      rerunWhen("setting", "show"),
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+
+				if channel.GuildID == "" {
+					return &commandOutput{response: "Image policies only apply in servers."}
+				}
+
+				setting := args.String("setting")
+				if setting == "show" {
+					return policyOutput(channel)
+				}
+
+				if denied := requirePermission(discordSession, msgEvent, channel, discordgo.PermissionManageServer, "change the image policy"); denied != nil {
+					return denied
+				}
+
+				value := strings.ToLower(strings.TrimSpace(args.String("value")))
+				if value == "" && setting != "reset" {
+					return &commandOutput{response: "What should `" + setting + "` be set to? See `help policy`."}
+				}
+
+				response, err := updatePolicy(channel, args.Bool("channel"), setting, value)
+				if err != nil {
+					return &commandOutput{response: err.Error()}
+				}
+				return &commandOutput{response: response}
 			},
 		},
 
 		&command{
 			name:             "Join",
 			description:      "I will join the voice channel of the sender.",
-			usage:            "join",
+			category:         "Voice",
 			verbs:            []string{"join"},
 			requiresDatabase: false,
-			function: func(args []string, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
 
 				voiceConnection, err := JoinUserVoiceChannel(discordSession, msgEvent.Author.ID)
 				if err != nil {
@@ -265,10 +749,10 @@ func initCommands() map[string]*command {
 		&command{
 			name:             "Leave",
 			description:      "I will leave the voice channel.",
-			usage:            "leave",
+			category:         "Voice",
 			verbs:            []string{"leave", "disconnect", "quit", "exit"},
 			requiresDatabase: false,
-			function: func(args []string, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
 
 				for _, voiceChannel := range discordSession.VoiceConnections {
 					DebugPrint("Looking for voice channel in this guild...")
@@ -285,56 +769,287 @@ func initCommands() map[string]*command {
 		&command{
 			name:             "Gay",
 			description:      "Posts a very gay image.",
-			usage:            "gay",
+			category:         "Fun",
 			verbs:            []string{"gay"},
 			requiresDatabase: false,
-			function: func(args []string, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+			rerunOnEdit:      rerunAlways,
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
 				file, err := os.Open("img/gaybats.png") // TODO: move this to database; allow users to add images (permission system?)
 				if err != nil {
 					fmt.Println(err)
 					return &commandOutput{response: "Error opening file"}
 
 				}
-				return &commandOutput{file: file}
+				return &commandOutput{files: []*outputFile{{name: "gaybats.png", reader: file}}}
 			},
 		},
 
-	/*
 		&command{
 			name:             "User stats",
-			description:      "Displays the statistics of the user.",
-			usage:            "stats [user]", // TODO: implement pinging users
+			description:      "Shows how much someone (or you) has said in this server: messages, words, attachments, their busiest channels and the last two weeks.",
+			category:         "General",
+			arguments: []argument{
+				{name: "user", description: "Tag the person to look up; leave it out for yourself."},
+			},
 			verbs:            []string{"stats"},
 			requiresDatabase: true,
-			function: func(args []string, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+			rerunOnEdit:      rerunAlways,
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
 
-				if len(args) > 0 {
-					if len(msgEvent.Mentions) > 0 {
-						// User tagged someone else
-						taggedUser := msgEvent.Mentions[0] // only the first one
+				// stats are kept per server (see stats.go)
+				if channel.GuildID == "" {
+					return &commandOutput{response: "Stats are kept per server, so use this in one."}
+				}
 
-						userDb, err := GetUser(taggedUser, false)
-						if err != nil {
-							return &commandOutput{response: "That user doesn't exist in the database yet. They need to chat some!"}
-						}
+				user := msgEvent.Author
+				if args.Has("user") {
+					if len(msgEvent.Mentions) == 0 {
+						// TODO: accept aliases as well as mentions
+						return &commandOutput{response: "To see someone's stats, tag the person directly!"}
+					}
+					user = msgEvent.Mentions[0] // only the first one
+				}
 
-						posts := userDb.Val()["posts"]
-						return &commandOutput{response: taggedUser.Username + " has made " + posts + " posts!"} // TODO: format as embed, show more values
+				embed, err := statsOutput(channel.GuildID, user)
+				if err == ErrNotFound {
+					if user.ID == msgEvent.Author.ID {
+						return &commandOutput{response: "You don't exist in the database yet. You need to chat some!"}
 					}
-					// user didn't tag anyone
-					// TODO: accept aliases as well as mentions
-					return &commandOutput{response: "To see someone's stats, tag the person directly!"}
+					return &commandOutput{response: "That user doesn't exist in the database yet. They need to chat some!"}
+				}
+				if err != nil {
+					return &commandOutput{err: err}
+				}
+				return &commandOutput{embed: embed}
+			},
+		},
+
+		&command{
+			name:             "Leaderboard",
+			description:      "Shows who has sent the most messages in this server today, this week, this month or of all time.",
+			category:         "General",
+			arguments: []argument{
+				{name: "period", choices: []string{"day", "week", "month", "all"}, defaultValue: "all"},
+			},
+			verbs:            []string{"leaderboard", "top"},
+			requiresDatabase: true,
+			rerunOnEdit:      rerunAlways,
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+
+				if channel.GuildID == "" {
+					return &commandOutput{response: "Stats are kept per server, so use this in one."}
+				}
+
+				embed, err := leaderboardOutput(channel.GuildID, args.String("period"))
+				if err != nil {
+					return &commandOutput{err: err}
+				}
+				return &commandOutput{embed: embed}
+			},
+		},
+
+		&command{
+			name:             "Stats channels",
+			description:      "Lists the channels whose messages don't count towards `stats` and the leaderboard, or with `exclude`/`include` stops or starts counting one (this channel if none is given).",
+			category:         "Admin",
+			arguments: []argument{
+				{name: "action", choices: []string{"list", "exclude", "include"}, defaultValue: "list"},
+				{name: "channel", description: "Channel to change, as a #mention or ID."},
+			},
+			verbs:            []string{"statschannels"},
+			requiresDatabase: true,
+			rerunOnEdit:      rerunWhen("action", "list"),
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+
+				if channel.GuildID == "" {
+					return &commandOutput{response: "Stats are kept per server, so use this in one."}
+				}
+
+				action := args.String("action")
+				if action == "list" {
+					return excludedChannelsOutput(channel.GuildID)
+				}
+
+				if denied := requirePermission(discordSession, msgEvent, channel, discordgo.PermissionManageServer, "change which channels are counted"); denied != nil {
+					return denied
+				}
+
+				target := channel
+				if args.Has("channel") {
+					channelID, ok := parseChannelMention(args.String("channel"))
+					if !ok {
+						return &commandOutput{response: "`" + args.String("channel") + "` isn't a channel. Use a #mention or a channel ID."}
+					}
+					found, err := GetChannel(discordSession, channelID)
+					if err != nil || found.GuildID != channel.GuildID {
+						return &commandOutput{response: "I can't find that channel in this server."}
+					}
+					target = found
+				}
+
+				excluded := action == "exclude"
+				err := setStatsExcluded(channel.GuildID, target.ID, excluded)
+				if err != nil {
+					fmt.Println(err)
+					return &commandOutput{response: "Error saving settings"}
+				}
+
+				if excluded {
+					return &commandOutput{response: "Okay, messages in <#" + target.ID + "> won't be counted any more. What's already been counted stays."}
+				}
+				return &commandOutput{response: "Okay, messages in <#" + target.ID + "> will be counted."}
+			},
+		},
+
+		&command{
+			name:             "Rank",
+			description:      "Shows someone's (or your) level and XP in this server.",
+			category:         "General",
+			arguments: []argument{
+				{name: "user", description: "Tag the person to look up; leave it out for yourself."},
+			},
+			verbs:            []string{"rank", "level"},
+			requiresDatabase: true,
+			rerunOnEdit:      rerunAlways,
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+
+				if channel.GuildID == "" {
+					return &commandOutput{response: "Levels are kept per server, so use this in one."}
+				}
+
+				user := msgEvent.Author
+				if args.Has("user") {
+					if len(msgEvent.Mentions) == 0 {
+						return &commandOutput{response: "To see someone's rank, tag the person directly!"}
+					}
+					user = msgEvent.Mentions[0] // only the first one
+				}
+
+				embed, err := rankOutput(channel.GuildID, user)
+				if err != nil {
+					return &commandOutput{err: err}
+				}
+				return &commandOutput{embed: embed}
+			},
+		},
+
+		&command{
+			name:             "Levels",
+			description:      "Shows this server's level settings, or with `top` the highest levels.\n`on`/`off` turns earning XP on or off, `curve a b c` sets how much XP each level takes (a×level² + b×level + c, `default` for 5 50 100), `announce channel|dm|off|#channel` sets where level-ups are announced, and `reward <level> @role` gives a role on reaching a level (`none` instead of the role removes it).",
+			category:         "Admin",
+			arguments: []argument{
+				{name: "setting", choices: []string{"show", "top", "on", "off", "curve", "announce", "reward"}, defaultValue: "show"},
+				{name: "value", kind: argRest, description: "New value for the setting."},
+			},
+			verbs:            []string{"levels"},
+			requiresDatabase: true,
+			rerunOnEdit:      rerunWhen("setting", "show", "top"),
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+
+				if channel.GuildID == "" {
+					return &commandOutput{response: "Levels are kept per server, so use this in one."}
+				}
+
+				setting := args.String("setting")
+				switch setting {
+				case "show":
+					return levelsOutput(channel.GuildID)
+				case "top":
+					embed, err := xpLeaderboardOutput(channel.GuildID)
+					if err != nil {
+						return &commandOutput{err: err}
+					}
+					return &commandOutput{embed: embed}
+				}
+
+				if denied := requirePermission(discordSession, msgEvent, channel, discordgo.PermissionManageServer, "change the level settings"); denied != nil {
+					return denied
+				}
+
+				value := strings.TrimSpace(args.String("value"))
+				if value == "" && setting != "on" && setting != "off" {
+					return &commandOutput{response: "What should `" + setting + "` be set to? See `help levels`."}
+				}
+
+				response, err := updateLevels(discordSession, channel.GuildID, setting, value)
+				if err != nil {
+					return &commandOutput{response: err.Error()}
+				}
+				return &commandOutput{response: response}
+			},
+		},
+
+		&command{
+			name:             "Adjust XP",
+			description:      "Changes someone's XP: `give @user 100`, `take @user 100` or `set @user 500`. `reset @user` takes it all away, though reward roles stay; `reset everyone --confirm` does it for the whole server.\n`import` with a CSV file attached sets everyone in it, from rows of user ID and XP, like an export from another bot.",
+			category:         "Admin",
+			arguments: []argument{
+				{name: "action", required: true, choices: []string{"give", "take", "set", "reset", "import"}},
+				{name: "user", description: "Tag the person to change."},
+				{name: "amount", kind: argInt, description: "How much XP to give, take or set."},
+				{name: "confirm", flag: true, kind: argBool, description: "Needed to reset everyone, since it can't be undone."},
+			},
+			verbs:            []string{"xp"},
+			requiresDatabase: true,
+			permissions:      discordgo.PermissionManageServer,
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, discordSession *discordgo.Session) *commandOutput {
+
+				if channel.GuildID == "" {
+					return &commandOutput{response: "Levels are kept per server, so use this in one."}
+				}
+
+				action := args.String("action")
+				if action == "import" {
+					if len(msgEvent.Attachments) == 0 {
+						return &commandOutput{response: "Attach a CSV file of user IDs and XP to import it."}
+					}
+					imported, skipped, err := importXPAttachment(channel.GuildID, msgEvent.Attachments[0])
+					if err != nil {
+						return &commandOutput{response: err.Error()}
+					}
+					response := "Done! Set the XP of " + strconv.Itoa(imported) + " users."
+					if skipped > 0 {
+						response += " " + strconv.Itoa(skipped) + " rows weren't a user ID and a number, so I skipped them."
+					}
+					return &commandOutput{response: response}
+				}
+
+				// only the plain word, so resetting everyone doesn't ping them all
+				if action == "reset" && strings.EqualFold(args.String("user"), "everyone") {
+					if !args.Bool("confirm") {
+						return &commandOutput{response: "This takes away everyone's XP in the server and can't be undone. If you're sure, use `xp reset everyone --confirm`."}
+					}
+					err := resetXP(channel.GuildID, "")
+					if err != nil {
+						return &commandOutput{err: err}
+					}
+					return &commandOutput{response: "Done! Everyone's XP is back to 0."}
+				}
+
+				if len(msgEvent.Mentions) == 0 {
+					return &commandOutput{response: "Tag the person whose XP to change."}
+				}
+				user := msgEvent.Mentions[0]
+
+				if action == "reset" {
+					err := resetXP(channel.GuildID, user.ID)
+					if err != nil {
+						return &commandOutput{err: err}
+					}
+					return &commandOutput{response: "Done! " + user.Username + "'s XP is back to 0."}
+				}
+
+				amount := args.Int("amount")
+				if !args.Has("amount") || amount < 0 {
+					return &commandOutput{response: "How much XP? Use a positive number, like `xp " + action + " @user 100`."}
 				}
-				// User's own stats
-				userDb, err := GetUser(msgEvent.Author, false)
+				total, err := adjustXP(discordSession, channel.GuildID, user.ID, action, int64(amount))
 				if err != nil {
-					return &commandOutput{response: "You don't exist in the database yet. You need to chat some!"}
+					return &commandOutput{err: err}
 				}
-				posts := userDb.Val()["posts"]
-				return &commandOutput{response: "You have made " + posts + " posts!"} // TODO: format as embed, show more values
+				return &commandOutput{response: "Done! " + user.Username + " has " + strconv.FormatInt(total, 10) + " XP."}
 			},
 		},
-	*/
 	)
 
 	// Map for matching verbs to commands
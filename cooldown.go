@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// What a cooldown is counted against
+type cooldownScope int
+
+const (
+	perUser    cooldownScope = iota // each user has their own cooldown
+	perChannel                      // everyone in a channel shares one cooldown
+	perGuild                        // everyone in a guild shares one cooldown
+)
+
+// A limit on how often a command can be used; commands list these in their 'cooldowns' field
+// Up to 'burst' uses can be made back-to-back, after which one use recharges every 'period'
+type cooldown struct {
+	scope  cooldownScope
+	period time.Duration
+	burst  int
+}
+
+// How long a blocked user has to wait before being told to slow down again
+const cooldownNoticePeriod = 10 * time.Second
+
+// Keeps track of cooldowns; the in-memory backend is always used, and can optionally be saved to a file
+type limiterBackend interface {
+	// take uses up one use for a key, returning how long to wait if there are none left
+	take(key string, period time.Duration, burst int, now time.Time) (time.Duration, error)
+}
+
+// Cooldown state kept in memory, as the time each key will be fully recharged
+// (a "generic cell rate algorithm", which needs only one timestamp per key)
+type memoryLimiter struct {
+	sync.Mutex
+	Recharged map[string]time.Time `json:"recharged"`
+}
+
+func newMemoryLimiter() *memoryLimiter {
+	return &memoryLimiter{Recharged: make(map[string]time.Time)}
+}
+
+func (limiter *memoryLimiter) take(key string, period time.Duration, burst int, now time.Time) (time.Duration, error) {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	recharged := limiter.Recharged[key]
+	if recharged.Before(now) {
+		recharged = now
+	}
+
+	// every use pushes the recharge time back by one period; we only allow 'burst' periods of backlog
+	allowance := time.Duration(burst-1) * period
+	if wait := recharged.Sub(now) - allowance; wait > 0 {
+		return wait, nil
+	}
+
+	limiter.Recharged[key] = recharged.Add(period)
+	return 0, nil
+}
+
+// Forgets keys which have fully recharged, so memory doesn't grow forever
+func (limiter *memoryLimiter) prune(now time.Time) {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	for key, recharged := range limiter.Recharged {
+		if recharged.Before(now) {
+			delete(limiter.Recharged, key)
+		}
+	}
+}
+
+// Cooldown state kept in memory and saved to a file every so often, so restarting doesn't reset cooldowns
+type fileLimiter struct {
+	*memoryLimiter
+	path string
+}
+
+// Loads saved cooldowns from a file; a missing file just means there are none yet
+func newFileLimiter(path string) (*fileLimiter, error) {
+	limiter := &fileLimiter{memoryLimiter: newMemoryLimiter(), path: path}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return limiter, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, limiter.memoryLimiter)
+	if err != nil {
+		return nil, err
+	}
+	if limiter.Recharged == nil {
+		limiter.Recharged = make(map[string]time.Time)
+	}
+	return limiter, nil
+}
+
+// Writes the current cooldowns to the file
+func (limiter *fileLimiter) save() error {
+	limiter.Lock()
+	data, err := json.Marshal(limiter.memoryLimiter)
+	limiter.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(limiter.path, data, 0644)
+}
+
+// Global limiter used by the dispatcher
+var limiter limiterBackend
+
+// Sets up the cooldown backend and the goroutine that tidies it up
+func initCooldowns() error {
+	memory := newMemoryLimiter()
+	var file *fileLimiter
+
+	if cfg.CooldownFile != "" {
+		var err error
+		file, err = newFileLimiter(cfg.CooldownFile)
+		if err != nil {
+			return err
+		}
+		memory = file.memoryLimiter
+		limiter = file
+		DebugPrint("Cooldowns are saved to " + cfg.CooldownFile)
+	} else {
+		limiter = memory
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			func() {
+				defer recoverAndReport(nil, "saving cooldowns")
+				memory.prune(time.Now())
+				if file != nil {
+					if err := file.save(); err != nil {
+						fmt.Println("Error saving cooldowns")
+						fmt.Println(err)
+					}
+				}
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// Checks the global per-user limit and the command's own cooldowns
+// Returns how long the caller has to wait, or 0 if they can go ahead
+// Each check uses up a charge, so a caller blocked by a later cooldown still spends the earlier ones;
+// this keeps spammers from getting extra uses by hammering the command
+func checkCooldowns(session *discordgo.Session, cmd *command, userID string, channel *discordgo.Channel) (time.Duration, error) {
+	if cooldownExempt(session, userID, channel) {
+		return 0, nil
+	}
+
+	now := time.Now()
+
+	if cfg.UserRateLimit > 0 {
+		wait, err := limiter.take("global:user:"+userID, cfg.UserRatePeriod/time.Duration(cfg.UserRateLimit), cfg.UserRateLimit, now)
+		if err != nil || wait > 0 {
+			return wait, err
+		}
+	}
+
+	for _, cd := range cmd.cooldowns {
+		key := "cooldown:" + cmd.verbs[0] + ":"
+		switch cd.scope {
+		case perUser:
+			key += "user:" + userID
+		case perChannel:
+			key += "channel:" + channel.ID
+		case perGuild:
+			// DMs don't have a guild, so treat the DM channel as its own guild
+			if channel.GuildID != "" {
+				key += "guild:" + channel.GuildID
+			} else {
+				key += "guild:" + channel.ID
+			}
+		}
+
+		wait, err := limiter.take(key, cd.period, cd.burst, now)
+		if err != nil || wait > 0 {
+			return wait, err
+		}
+	}
+
+	return 0, nil
+}
+
+// Bot owners and moderators (Manage Messages in the channel) don't have cooldowns
+func cooldownExempt(session *discordgo.Session, userID string, channel *discordgo.Channel) bool {
+	if isBotOwner(userID) {
+		return true
+	}
+	if channel.GuildID == "" {
+		return false
+	}
+
+	permissions, err := UserPermissions(session, userID, channel.ID)
+	if err != nil {
+		DebugPrint("Couldn't check cooldown exemption: " + err.Error())
+		return false
+	}
+	return permissions&discordgo.PermissionManageMessages != 0
+}
+
+// Tells a user to slow down, unless they've already been told recently
+func sendCooldownNotice(session *discordgo.Session, userID string, channelID string, wait time.Duration) {
+	notice, ok := cooldownNotice(userID, wait, time.Now())
+	if !ok {
+		DebugPrint("Already told this user to slow down; staying quiet.")
+		return
+	}
+	session.ChannelMessageSend(channelID, notice)
+}
+
+// What to tell a user who has to wait, or false if they were told less than cooldownNoticePeriod ago
+func cooldownNotice(userID string, wait time.Duration, now time.Time) (string, bool) {
+	noticeWait, err := limiter.take("notice:user:"+userID, cooldownNoticePeriod, 1, now)
+	if err != nil || noticeWait > 0 {
+		return "", false
+	}
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	return "Slow down! Try again in " + strconv.Itoa(seconds) + "s.", true
+}
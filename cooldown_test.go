@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	type attempt struct {
+		at   time.Duration // since the first attempt
+		key  string
+		wait time.Duration // 0 if it should go ahead
+	}
+
+	tests := []struct {
+		name     string
+		period   time.Duration
+		burst    int
+		attempts []attempt
+	}{
+		{"burst then one per period", 10 * time.Second, 3, []attempt{
+			{0, "a", 0},
+			{0, "a", 0},
+			{0, "a", 0},
+			{0, "a", 10 * time.Second},
+			{4 * time.Second, "a", 6 * time.Second},
+			{10 * time.Second, "a", 0},
+			{10 * time.Second, "a", 10 * time.Second},
+			{15 * time.Second, "a", 5 * time.Second},
+			{20 * time.Second, "a", 0},
+		}},
+		{"blocked attempts don't use anything up", 10 * time.Second, 1, []attempt{
+			{0, "a", 0},
+			{time.Second, "a", 9 * time.Second},
+			{2 * time.Second, "a", 8 * time.Second},
+			{3 * time.Second, "a", 7 * time.Second},
+			{10 * time.Second, "a", 0},
+		}},
+		{"refills completely but no further", 10 * time.Second, 2, []attempt{
+			{0, "a", 0},
+			{0, "a", 0},
+			{0, "a", 10 * time.Second},
+			{time.Hour, "a", 0},
+			{time.Hour, "a", 0},
+			{time.Hour, "a", 10 * time.Second},
+		}},
+		{"partial refill", 10 * time.Second, 3, []attempt{
+			{0, "a", 0},
+			{0, "a", 0},
+			{0, "a", 0},
+			{25 * time.Second, "a", 0},
+			{25 * time.Second, "a", 0},
+			{25 * time.Second, "a", 5 * time.Second},
+		}},
+		{"keys are separate", time.Minute, 1, []attempt{
+			{0, "a", 0},
+			{0, "b", 0},
+			{time.Second, "a", 59 * time.Second},
+			{time.Second, "c", 0},
+		}},
+		{"a burst below 1 counts as 1", 5 * time.Second, 0, []attempt{
+			{0, "a", 0},
+			{time.Second, "a", 4 * time.Second},
+			{5 * time.Second, "a", 0},
+		}},
+	}
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		limiter := newMemoryLimiter()
+		for i, attempt := range test.attempts {
+			wait, err := limiter.take(attempt.key, test.period, test.burst, start.Add(attempt.at))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wait != attempt.wait {
+				t.Errorf("%s: attempt %d at %s waits %s, want %s", test.name, i+1, attempt.at, wait, attempt.wait)
+			}
+		}
+	}
+}
+
+func TestMemoryLimiterPrune(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := newMemoryLimiter()
+	limiter.take("short", time.Second, 1, start)
+	limiter.take("long", time.Hour, 1, start)
+
+	limiter.prune(start.Add(time.Minute))
+	if _, ok := limiter.Recharged["short"]; ok {
+		t.Errorf("a recharged key wasn't pruned")
+	}
+	if _, ok := limiter.Recharged["long"]; !ok {
+		t.Errorf("a key still recharging was pruned")
+	}
+}
+
+func TestCooldownNotice(t *testing.T) {
+	saved := limiter
+	limiter = newMemoryLimiter()
+	defer func() {
+		limiter = saved
+	}()
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		at     time.Duration
+		userID string
+		wait   time.Duration
+		want   string
+	}{
+		{0, "1", 1500 * time.Millisecond, "Slow down! Try again in 2s."},
+		// told already, so quiet until cooldownNoticePeriod has passed
+		{time.Second, "1", time.Second, ""},
+		{cooldownNoticePeriod - time.Millisecond, "1", time.Second, ""},
+		{0, "2", 30 * time.Second, "Slow down! Try again in 30s."},
+		{cooldownNoticePeriod, "1", 4 * time.Second, "Slow down! Try again in 4s."},
+	}
+
+	for _, test := range tests {
+		notice, ok := cooldownNotice(test.userID, test.wait, start.Add(test.at))
+		if ok != (test.want != "") || notice != test.want {
+			t.Errorf("cooldownNotice(%s) at %s = %q, %v; want %q", test.userID, test.at, notice, ok, test.want)
+		}
+	}
+}
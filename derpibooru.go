@@ -1,91 +1,285 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// DerpiImage is a single image from Derpibooru's JSON API
+type DerpiImage struct {
+	ID              int       `json:"id"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	FirstSeenAt     time.Time `json:"first_seen_at"`
+	Score           int       `json:"score"`
+	CommentCount    int       `json:"comment_count"`
+	Width           int       `json:"width"`
+	Height          int       `json:"height"`
+	FileName        string    `json:"file_name"`
+	Description     string    `json:"description"`
+	Uploader        string    `json:"uploader"`
+	UploaderID      int       `json:"uploader_id"`
+	Image           string    `json:"image"`
+	Upvotes         int       `json:"upvotes"`
+	Downvotes       int       `json:"downvotes"`
+	Faves           int       `json:"faves"`
+	Tags            string    `json:"tags"`
+	TagIds          []int     `json:"tag_ids"`
+	AspectRatio     float64   `json:"aspect_ratio"`
+	OriginalFormat  string    `json:"original_format"`
+	MimeType        string    `json:"mime_type"`
+	Sha512Hash      string    `json:"sha512_hash"`
+	OrigSha512Hash  string    `json:"orig_sha512_hash"`
+	SourceURL       string    `json:"source_url"`
+	Representations struct {
+		ThumbTiny  string `json:"thumb_tiny"`
+		ThumbSmall string `json:"thumb_small"`
+		Thumb      string `json:"thumb"`
+		Small      string `json:"small"`
+		Medium     string `json:"medium"`
+		Large      string `json:"large"`
+		Tall       string `json:"tall"`
+		Full       string `json:"full"`
+	} `json:"representations"`
+	IsRendered  bool `json:"is_rendered"`
+	IsOptimized bool `json:"is_optimized"`
+}
+
 // DerpiResults is a struct to contain Derpibooru's JSON search results
 type DerpiResults struct {
-	Search []struct {
-		ID              int       `json:"id"`
-		CreatedAt       time.Time `json:"created_at"`
-		UpdatedAt       time.Time `json:"updated_at"`
-		FirstSeenAt     time.Time `json:"first_seen_at"`
-		Score           int       `json:"score"`
-		CommentCount    int       `json:"comment_count"`
-		Width           int       `json:"width"`
-		Height          int       `json:"height"`
-		FileName        string    `json:"file_name"`
-		Description     string    `json:"description"`
-		Uploader        string    `json:"uploader"`
-		UploaderID      int       `json:"uploader_id"`
-		Image           string    `json:"image"`
-		Upvotes         int       `json:"upvotes"`
-		Downvotes       int       `json:"downvotes"`
-		Faves           int       `json:"faves"`
-		Tags            string    `json:"tags"`
-		TagIds          []int     `json:"tag_ids"`
-		AspectRatio     float64   `json:"aspect_ratio"`
-		OriginalFormat  string    `json:"original_format"`
-		MimeType        string    `json:"mime_type"`
-		Sha512Hash      string    `json:"sha512_hash"`
-		OrigSha512Hash  string    `json:"orig_sha512_hash"`
-		SourceURL       string    `json:"source_url"`
-		Representations struct {
-			ThumbTiny  string `json:"thumb_tiny"`
-			ThumbSmall string `json:"thumb_small"`
-			Thumb      string `json:"thumb"`
-			Small      string `json:"small"`
-			Medium     string `json:"medium"`
-			Large      string `json:"large"`
-			Tall       string `json:"tall"`
-			Full       string `json:"full"`
-		} `json:"representations"`
-		IsRendered  bool `json:"is_rendered"`
-		IsOptimized bool `json:"is_optimized"`
-	} `json:"search"`
+	Search       []DerpiImage  `json:"search"`
 	Total        int           `json:"total"`
 	Interactions []interface{} `json:"interactions"`
 }
 
-// Perform a Derpibooru search query with a given string of tags and an API key
-func DerpiSearchWithTags(tags string, key string) (DerpiResults, error) {
+// Sort fields Derpibooru's search understands
+const (
+	DerpiSortCreated = "created_at"
+	DerpiSortScore   = "score"
+	DerpiSortWilson  = "wilson"
+	DerpiSortRandom  = "random"
+)
+
+// Most results Derpibooru will return per page
+const DerpiMaxPerPage = 50
+
+// DerpiClient talks to Derpibooru's JSON API, or anything else which speaks it (like a local stand-in for testing)
+type DerpiClient struct {
+	BaseURL    string       // site to query, without a trailing slash
+	APIKey     string       // sent with every request if not empty
+	HTTPClient *http.Client // used for every request; has a timeout set
+	Cache      *DerpiCache  // search results are kept here if not nil (see cache.go)
+}
+
+// DerpiSearchOptions describes a search; zero values use Derpibooru's defaults
+type DerpiSearchOptions struct {
+	Query         string // search query, exactly as typed on the website
+	Page          int    // page of results, starting at 1
+	PerPage       int    // results per page, up to DerpiMaxPerPage
+	SortField     string // one of the DerpiSort constants
+	SortDirection string // "desc" or "asc"
+	FilterID      int    // ID of a Derpibooru filter to apply instead of the user's default
+	NoCache       bool   // always ask Derpibooru, for when results must be fresh
+}
+
+// Error for a response from Derpibooru other than 200 OK, so callers can tell "not found" from other failures
+type derpiStatusError int
+
+func (status derpiStatusError) Error() string {
+	return fmt.Sprintf("Derpibooru responded with HTTP %d.", int(status))
+}
+
+// NewDerpiClient makes a client for the given site, with a timeout on each request
+func NewDerpiClient(baseURL string, key string, timeout time.Duration) *DerpiClient {
+	return &DerpiClient{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     key,
+		HTTPClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// Performs a GET request to a JSON endpoint and parses the response into target
+func (client *DerpiClient) getJSON(ctx context.Context, path string, params url.Values, target interface{}) error {
+	return client.requestJSON(ctx, "GET", path, params, target)
+}
 
-	// format for URL query
-	derpiTags := strings.Replace(tags, " ", "+", -1)
+// Performs a request to a JSON endpoint and parses the response into target
+// Parameters go in the query string for every method, which is what Derpibooru expects
+func (client *DerpiClient) requestJSON(ctx context.Context, method string, path string, params url.Values, target interface{}) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	if client.APIKey != "" {
+		params.Set("key", client.APIKey)
+	}
 
-	// make URL query
-	urlQuery := "https://derpibooru.org/search.json?q=" + derpiTags
-	if key != "" {
-		urlQuery += "&key=" + key
+	urlQuery := client.BaseURL + path
+	if len(params) > 0 {
+		urlQuery += "?" + params.Encode()
 	}
-	resp, err := http.Get(urlQuery)
+
+	request, err := http.NewRequestWithContext(ctx, method, urlQuery, nil)
 	if err != nil {
 		fmt.Println(err)
-		return DerpiResults{}, fmt.Errorf("Failed with HTTP error.")
+		return fmt.Errorf("Failed to build request.")
+	}
+	request.Header.Set("User-Agent", "Sunbot/"+version)
+
+	resp, err := client.HTTPClient.Do(request)
+	if err != nil {
+		fmt.Println(err)
+		if ctx.Err() != nil {
+			return fmt.Errorf("Derpibooru took too long to respond.")
+		}
+		return fmt.Errorf("Failed with HTTP error.")
 	}
 
 	// read response body
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return derpiStatusError(resp.StatusCode)
+	}
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		fmt.Println(err)
-		return DerpiResults{}, fmt.Errorf("Failed with error reading response body.")
+		return fmt.Errorf("Failed with error reading response body.")
 	}
 
 	// parse json
+	err = json.Unmarshal(respBody, target)
+	if err != nil {
+		fmt.Println(err)
+		return fmt.Errorf("Failed with JSON parsing error.")
+	}
+
+	return nil
+}
+
+// Search performs a Derpibooru search with the given options, using the cache if there is one
+// Randomly sorted searches are never cached, since every request should give different results
+func (client *DerpiClient) Search(ctx context.Context, options DerpiSearchOptions) (DerpiResults, error) {
+	if client.Cache == nil || options.NoCache || options.SortField == DerpiSortRandom {
+		return client.search(ctx, options)
+	}
+
+	key := derpiCacheKey(options, client.APIKey)
+	if results, ok := client.Cache.get(key); ok {
+		DebugPrint("Derpibooru cache hit: " + options.Query)
+		return results, nil
+	}
+
+	results, err := client.search(ctx, options)
+	if err == nil {
+		client.Cache.set(key, results)
+	}
+	return results, err
+}
+
+// Performs a search without looking at the cache
+func (client *DerpiClient) search(ctx context.Context, options DerpiSearchOptions) (DerpiResults, error) {
+	params := url.Values{}
+	params.Set("q", options.Query)
+	if options.Page > 0 {
+		params.Set("page", strconv.Itoa(options.Page))
+	}
+	if options.PerPage > 0 {
+		if options.PerPage > DerpiMaxPerPage {
+			options.PerPage = DerpiMaxPerPage
+		}
+		params.Set("per_page", strconv.Itoa(options.PerPage))
+	}
+	if options.SortField != "" {
+		params.Set("sf", options.SortField)
+	}
+	if options.SortDirection != "" {
+		params.Set("sd", options.SortDirection)
+	}
+	if options.FilterID > 0 {
+		params.Set("filter_id", strconv.Itoa(options.FilterID))
+	}
+
 	results := DerpiResults{}
-	err = json.Unmarshal(respBody, &results)
+	err := client.getJSON(ctx, "/search.json", params, &results)
+	return results, err
+}
+
+// How different an image may be from the one searched for and still match; Derpibooru's default
+const DerpiDefaultFuzziness = 0.25
+
+// ReverseSearch finds images which look like the image at the given URL, most similar first
+// Lower fuzziness only matches closer copies; zero uses DerpiDefaultFuzziness
+func (client *DerpiClient) ReverseSearch(ctx context.Context, imageURL string, fuzziness float64) ([]DerpiImage, error) {
+	if fuzziness <= 0 {
+		fuzziness = DerpiDefaultFuzziness
+	}
+
+	params := url.Values{}
+	params.Set("scraper_url", imageURL)
+	params.Set("fuzziness", strconv.FormatFloat(fuzziness, 'f', -1, 64))
+
+	results := DerpiResults{}
+	err := client.requestJSON(ctx, "POST", "/search/reverse.json", params, &results)
+	return results.Search, err
+}
+
+// Image fetches a single image by its ID
+func (client *DerpiClient) Image(ctx context.Context, id int) (DerpiImage, error) {
+	image := DerpiImage{}
+	err := client.getJSON(ctx, "/"+strconv.Itoa(id)+".json", nil, &image)
+	if err == nil && image.ID == 0 {
+		// deleted and merged images come back without the usual fields
+		return image, fmt.Errorf("Derpibooru has no image #%d.", id)
+	}
+	return image, err
+}
+
+// Featured fetches the image currently featured on Derpibooru's front page
+// Older versions of the API return the image itself, newer ones wrap it in {"image": ...}
+func (client *DerpiClient) Featured(ctx context.Context) (DerpiImage, error) {
+	raw := map[string]json.RawMessage{}
+	err := client.getJSON(ctx, "/images/featured.json", nil, &raw)
+	if err != nil {
+		return DerpiImage{}, err
+	}
+
+	image := DerpiImage{}
+	data, err := json.Marshal(raw)
+	if wrapped, ok := raw["image"]; ok && strings.HasPrefix(strings.TrimSpace(string(wrapped)), "{") {
+		data = wrapped
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &image)
+	}
 	if err != nil {
 		fmt.Println(err)
-		return DerpiResults{}, fmt.Errorf("Failed with JSON parsing error.")
+		return image, fmt.Errorf("Failed with JSON parsing error.")
+	}
+	if image.ID == 0 {
+		return image, fmt.Errorf("Derpibooru isn't featuring an image right now.")
 	}
+	return image, nil
+}
+
+// Perform a Derpibooru search query with a given string of tags and an API key
+// Only fetches the first page, newest first, and always asks Derpibooru rather than the cache
+func DerpiSearchWithTags(tags string, key string) (DerpiResults, error) {
+	client := *derpi
+	client.APIKey = key
 
-	return results, nil
+	ctx, cancel := context.WithTimeout(context.Background(), client.HTTPClient.Timeout)
+	defer cancel()
 
+	return client.Search(ctx, DerpiSearchOptions{
+		Query:         tags,
+		SortField:     DerpiSortCreated,
+		SortDirection: "desc",
+		NoCache:       true,
+	})
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"strconv"
+	"strings"
+)
+
+// Colour used for Derpibooru embeds
+const derpiEmbedColor = 0x618fc3
+
+// Tags that describe an image's rating, from least to most restricted
+var derpiRatingTags = []string{"safe", "suggestive", "questionable", "explicit", "semi-grimdark", "grimdark", "grotesque"}
+
+// TagList splits an image's comma-separated tags
+func (image *DerpiImage) TagList() []string {
+	tags := []string{}
+	for _, tag := range strings.Split(image.Tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Artists lists the names from an image's artist: tags
+func (image *DerpiImage) Artists() []string {
+	artists := []string{}
+	for _, tag := range image.TagList() {
+		if strings.HasPrefix(tag, "artist:") {
+			artists = append(artists, strings.TrimPrefix(tag, "artist:"))
+		}
+	}
+	return artists
+}
+
+// Ratings lists an image's rating tags, like "safe" or "explicit"
+func (image *DerpiImage) Ratings() []string {
+	ratings := []string{}
+	for _, tag := range image.TagList() {
+		for _, rating := range derpiRatingTags {
+			if tag == rating {
+				ratings = append(ratings, tag)
+			}
+		}
+	}
+	return ratings
+}
+
+// IsVideo reports whether the image is actually a WebM video
+func (image *DerpiImage) IsVideo() bool {
+	return image.MimeType == "video/webm" || image.OriginalFormat == "webm"
+}
+
+// IsAnimated reports whether the image is a GIF
+func (image *DerpiImage) IsAnimated() bool {
+	return image.MimeType == "image/gif" || image.OriginalFormat == "gif"
+}
+
+// EmbedImageURL picks the representation that looks best in a Discord embed
+// Embeds are shown fairly small, so the full image is rarely worth the download
+func (image *DerpiImage) EmbedImageURL() string {
+	reps := image.Representations
+
+	switch {
+	case image.IsAnimated():
+		// GIF representations are animated too, and smaller ones load much faster
+		return absoluteURL(firstNonEmpty(reps.Medium, reps.Large, reps.Full, image.Image))
+	case image.AspectRatio > 0 && image.AspectRatio < 0.5:
+		// very tall images get squashed into a sliver unless we use the tall version
+		return absoluteURL(firstNonEmpty(reps.Tall, reps.Large, reps.Full, image.Image))
+	default:
+		return absoluteURL(firstNonEmpty(reps.Large, reps.Medium, reps.Full, image.Image))
+	}
+}
+
+// Derpibooru gives protocol-relative URLs ("//derpicdn.net/..."); Discord wants full ones
+func absoluteURL(link string) string {
+	if strings.HasPrefix(link, "//") {
+		return "https:" + link
+	}
+	return link
+}
+
+// First string which isn't empty
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// PageURL is the link to an image's page on the site
+func (client *DerpiClient) PageURL(id int) string {
+	return client.BaseURL + "/" + strconv.Itoa(id)
+}
+
+// Builds the reply for a single Derpibooru image, with the given footer text
+// WebM videos can't be shown in an embed, so their link goes in the message text where Discord plays it
+func derpiImageOutput(image DerpiImage, footer string) *commandOutput {
+	artists := image.Artists()
+	author := "Unknown artist"
+	if len(artists) > 0 {
+		author = "By " + strings.Join(artists, ", ")
+	}
+
+	uploader := image.Uploader
+	if uploader == "" {
+		uploader = "Anonymous"
+	}
+
+	ratings := image.Ratings()
+	if len(ratings) == 0 {
+		ratings = []string{"unrated"}
+	}
+
+	embed := NewEmbed().
+		SetTitle("Derpibooru #"+strconv.Itoa(image.ID)).
+		SetURL(derpi.PageURL(image.ID)).
+		SetAuthor(author).
+		SetColor(derpiEmbedColor).
+		AddField("Score", strconv.Itoa(image.Score)+" (+"+strconv.Itoa(image.Upvotes)+" / -"+strconv.Itoa(image.Downvotes)+")").
+		AddField("Faves", strconv.Itoa(image.Faves)).
+		AddField("Rating", strings.Join(ratings, ", ")).
+		AddField("Uploader", uploader)
+
+	if image.SourceURL != "" {
+		embed.AddField("Source", image.SourceURL)
+	}
+	if image.Width > 0 && image.Height > 0 {
+		embed.AddField("Size", strconv.Itoa(image.Width)+"×"+strconv.Itoa(image.Height)+" "+strings.ToUpper(image.OriginalFormat))
+	}
+	embed.InlineAllFields()
+
+	if footer != "" {
+		embed.SetFooter(footer)
+	}
+
+	output := &commandOutput{}
+	if image.IsVideo() {
+		output.response = absoluteURL(firstNonEmpty(image.Representations.Full, image.Image))
+	} else {
+		embed.SetImage(image.EmbedImageURL())
+	}
+
+	output.embed = embed.Truncate().MessageEmbed
+	return output
+}
+
+// Footer for a search result, showing the query and how many results there were
+func derpiSearchFooter(query string, total int) string {
+	results := strconv.Itoa(total) + " results"
+	if total == 1 {
+		results = "1 result"
+	}
+	return "Search: " + strings.TrimSpace(query) + " • " + results
+}
+
+// Builds a small info card for an image, used when previewing links
+// Only a thumbnail is shown, since whoever posted the link can already click through to it
+func derpiCompactOutput(image DerpiImage) *commandOutput {
+	artists := image.Artists()
+	if len(artists) == 0 {
+		artists = []string{"unknown"}
+	}
+
+	ratings := image.Ratings()
+	if len(ratings) == 0 {
+		ratings = []string{"unrated"}
+	}
+
+	embed := NewEmbed().
+		SetTitle("Derpibooru #"+strconv.Itoa(image.ID)).
+		SetURL(derpi.PageURL(image.ID)).
+		SetColor(derpiEmbedColor).
+		AddField("Artist", strings.Join(artists, ", ")).
+		AddField("Rating", strings.Join(ratings, ", ")).
+		AddField("Score", strconv.Itoa(image.Score))
+
+	if image.SourceURL != "" {
+		embed.AddField("Source", image.SourceURL)
+	}
+	embed.InlineAllFields()
+
+	thumbnail := absoluteURL(firstNonEmpty(image.Representations.Thumb, image.Representations.Small))
+	if thumbnail != "" && !image.IsVideo() {
+		embed.SetThumbnail(thumbnail)
+	}
+
+	return &commandOutput{embed: embed.Truncate().MessageEmbed}
+}
+
+// Reports whether an image may be shown in a channel, according to the channel's policy (see policy.go)
+func derpiAllowedIn(image DerpiImage, channel *discordgo.Channel) bool {
+	allowed, _ := channelPolicy(channel).allows(image)
+	return allowed
+}
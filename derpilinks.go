@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Most links previewed from a single message
+const maxLinkPreviews = 3
+
+// Links to image pages, like https://derpibooru.org/1234 or https://derpibooru.org/images/1234
+var derpiPageLink = regexp.MustCompile(`https?://(?:www\.)?(?:derpibooru|trixiebooru)\.org/(?:images/)?(\d+)\b`)
+
+// Direct links to image files, like https://derpicdn.net/img/2018/1/4/1234/large.png
+// or https://derpicdn.net/img/view/2018/1/4/1234.png
+var derpiCDNLink = regexp.MustCompile(`https?://derpicdn\.net/img/(?:view/|download/)?\d{4}/\d{1,2}/\d{1,2}/(\d+)`)
+
+// Finds the IDs of linked images, in order and without repeats
+// Links wrapped in <angle brackets> are skipped, since that's how Discord users ask for no preview
+func derpiLinkIDs(msg string) []int {
+	type match struct {
+		start int
+		id    int
+	}
+	matches := []match{}
+
+	for _, pattern := range []*regexp.Regexp{derpiPageLink, derpiCDNLink} {
+		for _, indexes := range pattern.FindAllStringSubmatchIndex(msg, -1) {
+			if indexes[0] > 0 && msg[indexes[0]-1] == '<' {
+				continue
+			}
+			id, err := strconv.Atoi(msg[indexes[2]:indexes[3]])
+			if err == nil {
+				matches = append(matches, match{start: indexes[0], id: id})
+			}
+		}
+	}
+
+	// put page and CDN links back in the order they were written
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].start < matches[j].start
+	})
+
+	ids := []int{}
+	seen := make(map[int]bool)
+	for _, m := range matches {
+		if !seen[m.id] {
+			seen[m.id] = true
+			ids = append(ids, m.id)
+		}
+	}
+	return ids
+}
+
+// Replies to Derpibooru links in a message with an info card for each image
+// Images which can't be shown in the channel are skipped without a word, so nothing about them leaks
+func expandDerpiLinks(session *discordgo.Session, msgEvent *discordgo.MessageCreate, channel *discordgo.Channel) {
+	defer recoverAndReport(session, "Derpibooru link previews")
+
+	ids := derpiLinkIDs(msgEvent.Content)
+	if len(ids) == 0 {
+		return
+	}
+	if len(ids) > maxLinkPreviews {
+		ids = ids[:maxLinkPreviews]
+	}
+
+	// a channel full of links shouldn't become a channel full of previews
+	wait, err := limiter.take("linkpreview:channel:"+channel.ID, 5*time.Second, 5, time.Now())
+	if err != nil || wait > 0 {
+		DebugPrint("Skipping link previews; channel is on cooldown.")
+		return
+	}
+
+	for _, id := range ids {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.DerpiTimeout)
+		image, err := derpi.Image(ctx, id)
+		cancel()
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		if !derpiAllowedIn(image, channel) {
+			DebugPrint("Not previewing Derpibooru #" + strconv.Itoa(id) + " in SFW channel #" + channel.Name)
+			continue
+		}
+
+		_, err = sendOutput(session, derpiCompactOutput(image), channel.ID, msgEvent.Author.ID)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// Handles `.derpi id <number>`
+func derpiIDCommand(rest string, channel *discordgo.Channel) *commandOutput {
+	// accept a pasted link as well as a bare number
+	ids := derpiLinkIDs(rest)
+	id, err := strconv.Atoi(rest)
+	if len(ids) > 0 {
+		id, err = ids[0], nil
+	}
+	if err != nil || id < 0 {
+		return &commandOutput{response: "Which image? Give its number, like `derpi id 1234`."}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DerpiTimeout)
+	defer cancel()
+
+	image, err := derpi.Image(ctx, id)
+	if err != nil {
+		fmt.Println(err)
+		return &commandOutput{response: "Error: " + err.Error()}
+	}
+
+	if allowed, reason := channelPolicy(channel).allows(image); !allowed {
+		return &commandOutput{response: "I can't show that image here, because " + reason + " (see `policy`)."}
+	}
+
+	return derpiImageOutput(image, "")
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Most tags kept in the tag cache; the ones closest to expiring are dropped first
+const tagCacheLimit = 1000
+
+// Most close tag names suggested for a misspelled tag
+const maxTagSuggestions = 5
+
+// DerpiTag is a tag from Derpibooru's tags API
+type DerpiTag struct {
+	ID               int    `json:"id"`
+	Name             string `json:"name"`
+	Slug             string `json:"slug"`
+	Description      string `json:"description"`
+	ShortDescription string `json:"short_description"`
+	Images           int    `json:"images"`
+	Category         string `json:"category"`
+	AliasedTo        string `json:"aliased_to"`
+	ImpliedTags      string `json:"implied_tags"`
+	ImpliedTagIDs    []int  `json:"implied_tag_ids"`
+}
+
+// DerpiTagInfo is a tag along with the names aliased to it
+type DerpiTagInfo struct {
+	Tag     DerpiTag   `json:"tag"`
+	Aliases []DerpiTag `json:"aliases"`
+}
+
+// One autocomplete suggestion
+type derpiAutocompleteResult struct {
+	Label string `json:"label"` // name with the image count, like "twilight sparkle (123456)"
+	Value string `json:"value"` // just the name
+}
+
+// Implications as a list of names
+func (tag *DerpiTag) Implies() []string {
+	implied := []string{}
+	for _, name := range strings.Split(tag.ImpliedTags, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			implied = append(implied, name)
+		}
+	}
+	return implied
+}
+
+// Turns a tag name into the form Derpibooru uses in tag URLs, like "artist-colon-foo" for "artist:foo"
+func derpiTagSlug(name string) string {
+	slug := strings.NewReplacer(
+		"-", "-dash-",
+		"/", "-fwslash-",
+		"\\", "-bwslash-",
+		":", "-colon-",
+		".", "-dot-",
+		"+", "-plus-",
+	).Replace(strings.ToLower(strings.TrimSpace(name)))
+	return strings.Replace(url.QueryEscape(slug), "%20", "+", -1)
+}
+
+// Tag fetches a tag and its aliases; a tag which doesn't exist gives found == false rather than an error
+func (client *DerpiClient) Tag(ctx context.Context, name string) (info DerpiTagInfo, found bool, err error) {
+	err = client.getJSON(ctx, "/tags/"+derpiTagSlug(name)+".json", nil, &info)
+	if status, ok := err.(derpiStatusError); ok && status == http.StatusNotFound {
+		return info, false, nil
+	}
+	if err != nil {
+		return info, false, err
+	}
+	return info, info.Tag.Name != "", nil
+}
+
+// AutocompleteTags suggests tag names starting with or close to the given text, most used first
+func (client *DerpiClient) AutocompleteTags(ctx context.Context, text string) ([]string, error) {
+	params := url.Values{}
+	params.Set("term", strings.ToLower(strings.TrimSpace(text)))
+
+	results := []derpiAutocompleteResult{}
+	err := client.getJSON(ctx, "/tags/autocomplete.json", params, &results)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, result := range results {
+		names = append(names, result.Value)
+	}
+	return names, nil
+}
+
+// A cached tag lookup; found is false for tags which don't exist, so those are cached too
+type tagCacheEntry struct {
+	info    DerpiTagInfo
+	found   bool
+	expires time.Time
+}
+
+// Keeps tag lookups for a while, since tags rarely change
+type tagCache struct {
+	sync.Mutex
+	entries map[string]tagCacheEntry // lower case tag name -> lookup
+}
+
+// Global tag cache used by lookupTag
+var tags = &tagCache{entries: make(map[string]tagCacheEntry)}
+
+func (cache *tagCache) get(name string) (tagCacheEntry, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	entry, ok := cache.entries[name]
+	if !ok || time.Now().After(entry.expires) {
+		return tagCacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (cache *tagCache) set(name string, entry tagCacheEntry) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	// make room by dropping whatever would expire soonest
+	for len(cache.entries) >= tagCacheLimit {
+		oldest := ""
+		for key, existing := range cache.entries {
+			if oldest == "" || existing.expires.Before(cache.entries[oldest].expires) {
+				oldest = key
+			}
+		}
+		delete(cache.entries, oldest)
+	}
+	cache.entries[name] = entry
+}
+
+// Looks a tag up, using the cache where possible
+func lookupTag(ctx context.Context, name string) (DerpiTagInfo, bool, error) {
+	key := strings.ToLower(strings.TrimSpace(name))
+	if entry, ok := tags.get(key); ok {
+		return entry.info, entry.found, nil
+	}
+
+	info, found, err := derpi.Tag(ctx, key)
+	if err != nil {
+		return info, false, err
+	}
+	if cfg.DerpiTagCacheTTL > 0 {
+		tags.set(key, tagCacheEntry{info: info, found: found, expires: time.Now().Add(cfg.DerpiTagCacheTTL)})
+	}
+	return info, found, nil
+}
+
+// Suggests existing tags close to a name which doesn't exist
+// Autocomplete only matches from the start, so if that finds nothing the last word is tried alone
+func suggestTags(ctx context.Context, name string) []string {
+	candidates := []string{name}
+	if words := strings.Fields(name); len(words) > 1 {
+		candidates = append(candidates, words[len(words)-1])
+	}
+
+	for _, candidate := range candidates {
+		suggestions, err := derpi.AutocompleteTags(ctx, candidate)
+		if err != nil {
+			fmt.Println(err)
+			return nil
+		}
+		if len(suggestions) > 0 {
+			if len(suggestions) > maxTagSuggestions {
+				suggestions = suggestions[:maxTagSuggestions]
+			}
+			return suggestions
+		}
+	}
+	return nil
+}
+
+// Formats tag names as a list of `code` names
+func tagList(names []string) string {
+	quoted := []string{}
+	for _, name := range names {
+		quoted = append(quoted, "`"+name+"`")
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// Builds the reply for `.tag`
+func tagOutput(ctx context.Context, name string) *commandOutput {
+	info, found, err := lookupTag(ctx, name)
+	if err != nil {
+		fmt.Println(err)
+		return &commandOutput{response: "Error: " + err.Error()}
+	}
+
+	if !found {
+		response := "There's no tag called `" + name + "`."
+		if suggestions := suggestTags(ctx, name); len(suggestions) > 0 {
+			response += "\nDid you mean " + tagList(suggestions) + "?"
+		}
+		return &commandOutput{response: response}
+	}
+
+	tag := info.Tag
+	note := ""
+	if tag.AliasedTo != "" {
+		// show the tag people should actually use
+		note = "`" + tag.Name + "` is an alias of `" + tag.AliasedTo + "`.\n\n"
+		target, targetFound, err := lookupTag(ctx, tag.AliasedTo)
+		if err == nil && targetFound {
+			info, tag = target, target.Tag
+		}
+	}
+
+	description := firstNonEmpty(tag.Description, tag.ShortDescription, "No description.")
+	embed := NewEmbed().
+		SetTitle(tag.Name).
+		SetURL(derpi.BaseURL+"/tags/"+derpiTagSlug(tag.Name)).
+		SetDescription(note+description).
+		SetColor(derpiEmbedColor).
+		AddField("Images", strconv.Itoa(tag.Images))
+
+	if tag.Category != "" {
+		embed.AddField("Category", tag.Category)
+	}
+	embed.InlineAllFields()
+
+	if len(info.Aliases) > 0 {
+		aliases := []string{}
+		for _, alias := range info.Aliases {
+			aliases = append(aliases, alias.Name)
+		}
+		embed.AddField("Aliases", tagList(aliases))
+	}
+	if implied := tag.Implies(); len(implied) > 0 {
+		embed.AddField("Implies", tagList(implied))
+	}
+
+	return &commandOutput{embed: embed.Truncate().MessageEmbed}
+}
+
+// Positive plain tags in a parsed query, which are the ones worth checking when a search finds nothing
+func queryTags(node queryNode) []string {
+	names := []string{}
+	switch node := node.(type) {
+	case *queryTerm:
+		if node.Op == "" && !strings.ContainsAny(node.Text, "*?") {
+			names = append(names, node.Text)
+		}
+	case *queryAnd:
+		for _, child := range node.Children {
+			names = append(names, queryTags(child)...)
+		}
+	case *queryOr:
+		for _, child := range node.Children {
+			names = append(names, queryTags(child)...)
+		}
+	}
+	return names
+}
+
+// Explains an empty search by pointing out tags which don't exist or are aliases, with suggestions
+// Only the first few tags are checked, so a long query doesn't mean lots of lookups
+func noResultsHint(ctx context.Context, query string) string {
+	node, err := parseQuery(query)
+	if err != nil {
+		return ""
+	}
+
+	hints := []string{}
+	for i, name := range queryTags(node) {
+		if i == 3 {
+			break
+		}
+
+		info, found, err := lookupTag(ctx, name)
+		if err != nil {
+			fmt.Println(err)
+			return ""
+		}
+		if !found {
+			hint := "`" + name + "` isn't a tag."
+			if suggestions := suggestTags(ctx, name); len(suggestions) > 0 {
+				hint += " Did you mean " + tagList(suggestions) + "?"
+			}
+			hints = append(hints, hint)
+		} else if info.Tag.AliasedTo != "" {
+			hints = append(hints, "`"+name+"` is an alias of `"+info.Tag.AliasedTo+"`.")
+		}
+	}
+	return strings.Join(hints, "\n")
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Most tags e621 accepts in one search, including the ones the policy adds
+const e621MaxTags = 40
+
+// e621's ratings mapped onto Derpibooru's rating tags
+// e621 has no "suggestive", so its "safe" can only be allowed where Derpibooru's "safe" is
+var e621Ratings = map[string]string{
+	"s": "safe",
+	"q": "questionable",
+	"e": "explicit",
+}
+
+// A post as returned by e621's JSON API
+type e621Post struct {
+	ID   int `json:"id"`
+	File struct {
+		URL string `json:"url"`
+		Ext string `json:"ext"`
+	} `json:"file"`
+	Sample struct {
+		URL string `json:"url"`
+	} `json:"sample"`
+	Score struct {
+		Total int `json:"total"`
+	} `json:"score"`
+	Rating  string              `json:"rating"`
+	Tags    map[string][]string `json:"tags"` // category (general, artist, species...) -> tags
+	Sources []string            `json:"sources"`
+}
+
+// e621 search results
+type e621Results struct {
+	Posts []e621Post `json:"posts"`
+}
+
+// e621, which uses its own search syntax: tags separated by spaces, -tag to exclude and ~tag for "any of"
+type e621Board struct {
+	baseURL    string       // site to query, without a trailing slash
+	httpClient *http.Client // used for every request
+}
+
+func newE621Board(baseURL string) *e621Board {
+	return &e621Board{baseURL: baseURL, httpClient: &http.Client{Timeout: cfg.DerpiTimeout}}
+}
+
+func (board *e621Board) Name() string {
+	return "e621"
+}
+
+// Adds the policy's restrictions to a query in e621's syntax
+// Every tag in an e621 search must match (except ~ groups, which only OR among themselves),
+// so appending -rating: tags restricts the whole query
+func (board *e621Board) restrict(query string, policy effectivePolicy) (string, error) {
+	tags := strings.Fields(query)
+	if len(tags) == 0 {
+		return "", fmt.Errorf("What should I search for?")
+	}
+
+	allowedAny := false
+	for _, letter := range []string{"s", "q", "e"} {
+		if containsString(policy.ratings, e621Ratings[letter]) {
+			allowedAny = true
+		} else {
+			tags = append(tags, "-rating:"+letter)
+		}
+	}
+	if !allowedAny {
+		return "", fmt.Errorf("This channel's image policy doesn't allow any of e621's ratings.")
+	}
+
+	for _, tag := range policy.excludedTags {
+		if _, err := strconv.Atoi(tag); err != nil {
+			tags = append(tags, "-"+strings.Replace(tag, " ", "_", -1))
+		}
+	}
+
+	if len(tags) > e621MaxTags {
+		return "", fmt.Errorf("That's too many tags for e621, once this channel's image policy is added (the most is %d).", e621MaxTags)
+	}
+	return strings.Join(tags, " "), nil
+}
+
+func (board *e621Board) Search(ctx context.Context, query string, policy effectivePolicy) (BoardResults, error) {
+	restricted, err := board.restrict(query, policy)
+	if err != nil {
+		return BoardResults{}, err
+	}
+
+	params := url.Values{}
+	params.Set("tags", restricted)
+	params.Set("limit", strconv.Itoa(boardPerPage))
+
+	results := e621Results{}
+	err = fetchJSON(ctx, board.httpClient, "e621", board.baseURL+"/posts.json?"+params.Encode(), &results)
+	if err != nil {
+		return BoardResults{}, err
+	}
+
+	images := []BoardImage{}
+	for _, post := range results.Posts {
+		// posts hidden from anonymous users come back without a file
+		if post.File.URL == "" {
+			continue
+		}
+		images = append(images, board.convert(post))
+	}
+	// e621 doesn't say how many results there are in total
+	return BoardResults{Images: images, Total: len(images)}, nil
+}
+
+// Converts an e621 post to the common model
+func (board *e621Board) convert(post e621Post) BoardImage {
+	ratings := []string{}
+	if rating, ok := e621Ratings[post.Rating]; ok {
+		ratings = append(ratings, rating)
+	}
+
+	tags := []string{}
+	for _, category := range post.Tags {
+		tags = append(tags, category...)
+	}
+
+	// e621 tags things like "conditional_dnp" as artists too
+	artists := []string{}
+	for _, artist := range post.Tags["artist"] {
+		if artist != "conditional_dnp" && artist != "sound_warning" && artist != "unknown_artist" {
+			artists = append(artists, artist)
+		}
+	}
+
+	source := ""
+	if len(post.Sources) > 0 {
+		source = post.Sources[0]
+	}
+
+	isVideo := post.File.Ext == "webm" || post.File.Ext == "mp4"
+	imageURL := firstNonEmpty(post.Sample.URL, post.File.URL)
+	if isVideo {
+		imageURL = post.File.URL
+	}
+
+	return BoardImage{
+		ID:        strconv.Itoa(post.ID),
+		Site:      "e621",
+		PageURL:   board.baseURL + "/posts/" + strconv.Itoa(post.ID),
+		ImageURL:  imageURL,
+		IsVideo:   isVideo,
+		Ratings:   ratings,
+		Artists:   artists,
+		Tags:      tags,
+		Score:     post.Score.Total,
+		SourceURL: source,
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestE621Restrict(t *testing.T) {
+	board := &e621Board{baseURL: "https://e621.test"}
+	tests := []struct {
+		query   string
+		ratings []string
+		exclude []string
+		want    string // "" for an error
+	}{
+		{"pony", []string{"safe"}, nil, "pony -rating:q -rating:e"},
+		{"pony", []string{"safe", "suggestive", "questionable"}, nil, "pony -rating:e"},
+		{"pony", []string{"questionable", "explicit"}, nil, "pony -rating:s"},
+		{"pony ~cute ~fluffy", derpiRatingTags, nil, "pony ~cute ~fluffy"},
+		{"pony", derpiRatingTags, []string{"gore", "body horror", "42"}, "pony -gore -body_horror"},
+		// e621 has no suggestive or grimdark ratings, so nothing can be shown
+		{"pony", []string{"suggestive", "grimdark"}, nil, ""},
+		{"   ", derpiRatingTags, nil, ""},
+		{strings.Repeat("tag ", e621MaxTags-1), []string{"safe"}, nil, ""},
+	}
+
+	for _, test := range tests {
+		policy := effectivePolicy{ratings: test.ratings, excludedTags: test.exclude}
+		got, err := board.restrict(test.query, policy)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("restrict(%q, %v) = %q; want an error", test.query, test.ratings, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("restrict(%q, %v) = %q, %v; want %q", test.query, test.ratings, got, err, test.want)
+		}
+	}
+}
+
+// Posts with a rating e621 doesn't document get no rating, so the policy rejects them
+func TestE621ConvertRatings(t *testing.T) {
+	board := &e621Board{baseURL: "https://e621.test"}
+	policy := effectivePolicy{ratings: derpiRatingTags}
+	tests := []struct {
+		rating  string
+		allowed bool
+	}{
+		{"s", true},
+		{"q", true},
+		{"e", true},
+		{"", false},
+		{"x", false},
+	}
+
+	for _, test := range tests {
+		image := board.convert(e621Post{ID: 1, Rating: test.rating})
+		if allowed, reason := policy.allowsBoardImage(image); allowed != test.allowed {
+			t.Errorf("post rated %q: allowed = %v (%s), want %v", test.rating, allowed, reason, test.allowed)
+		}
+	}
+}
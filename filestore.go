@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the file store writes changes to disk; anything newer is lost if the bot crashes
+const fileStoreSaveInterval = 5 * time.Second
+
+// Keeps everything in memory and saves it to a single JSON file, for small deployments without Redis
+// Changes are saved every few seconds rather than on every write, since some are made for every message
+type fileStore struct {
+	*memoryStore
+	path   string
+	dirty  bool          // changed since the last save; guarded by the memory store's lock
+	saving sync.Mutex    // held while writing the file
+	stop   chan struct{} // closed to stop saving in the background
+	done   chan struct{} // closed once the background saver has stopped
+}
+
+// Loads the store from the given file; a missing file just means it's empty so far
+func newFileStore(path string) (*fileStore, error) {
+	store := &fileStore{
+		memoryStore: newMemoryStore(),
+		path:        path,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &store.entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// keys which expired while the bot was down
+	now := time.Now()
+	for key, entry := range store.entries {
+		if entry.expired(now) {
+			delete(store.entries, key)
+		}
+	}
+
+	store.written = func() {
+		store.dirty = true
+	}
+
+	go store.saveInBackground()
+	return store, nil
+}
+
+func (store *fileStore) saveInBackground() {
+	defer close(store.done)
+
+	ticker := time.NewTicker(fileStoreSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			func() {
+				defer recoverAndReport(nil, "saving the database")
+				err := store.save()
+				if err != nil {
+					fmt.Println("Error saving the database to " + store.path + ": " + err.Error())
+				}
+			}()
+		case <-store.stop:
+			return
+		}
+	}
+}
+
+// Writes everything to disk if anything has changed
+func (store *fileStore) save() error {
+	store.saving.Lock()
+	defer store.saving.Unlock()
+
+	store.memoryStore.Lock()
+	if !store.dirty {
+		store.memoryStore.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(store.entries)
+	store.dirty = false
+	store.memoryStore.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(store.path, data)
+	if err != nil {
+		// try again next time
+		store.memoryStore.Lock()
+		store.dirty = true
+		store.memoryStore.Unlock()
+	}
+	return err
+}
+
+// Stops saving in the background and saves one last time
+func (store *fileStore) Close() error {
+	close(store.stop)
+	<-store.done
+	return store.save()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"sync"
+	"time"
+)
+
+// How often guilds the bot has left are checked for data to delete
+const guildSweepInterval = time.Hour
+
+// Old user data only needs moving once per run, however many times Discord reconnects
+var legacyMigration sync.Once
+
+// Called when connected to Discord, with the guilds the bot is in
+func onReady(session *discordgo.Session, event *discordgo.Ready) {
+	defer recoverAndReport(session, "the Ready event handler")
+
+	if db == nil {
+		return
+	}
+
+	legacyMigration.Do(func() {
+		guildIDs := []string{}
+		for _, guild := range event.Guilds {
+			guildIDs = append(guildIDs, guild.ID)
+		}
+		err := migrateLegacyUsers(db, guildIDs)
+		if err != nil {
+			fmt.Println("Error moving old user data: " + err.Error())
+		}
+	})
+}
+
+// Called for each guild when connecting, and when the bot joins a guild
+// Coming back to a guild cancels deleting its data
+func onGuildCreate(session *discordgo.Session, event *discordgo.GuildCreate) {
+	defer recoverAndReport(session, "the GuildCreate event handler")
+
+	if settings.guild(event.ID).LeftAt == nil {
+		return
+	}
+
+	err := settings.update(event.ID, func(guild *guildSettings) {
+		guild.LeftAt = nil
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	DebugPrint("Rejoined guild " + event.ID + "; its data will be kept.")
+}
+
+// Called when the bot is removed from a guild, or the guild becomes unavailable during an outage
+func onGuildDelete(session *discordgo.Session, event *discordgo.GuildDelete) {
+	defer recoverAndReport(session, "the GuildDelete event handler")
+
+	// an outage isn't leaving
+	if event.Unavailable || cfg.GuildDataRetention <= 0 {
+		return
+	}
+
+	now := time.Now()
+	err := settings.update(event.ID, func(guild *guildSettings) {
+		guild.LeftAt = &now
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	DebugPrint("Left guild " + event.ID + "; its data will be deleted after " + cfg.GuildDataRetention.String())
+}
+
+// Deletes the data of guilds the bot left more than GUILD_DATA_RETENTION ago, checking every so often
+func startGuildDataSweeper() {
+	if cfg.GuildDataRetention <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			for guildID, leftAt := range settings.leftGuilds() {
+				if time.Since(leftAt) < cfg.GuildDataRetention {
+					continue
+				}
+				func() {
+					defer recoverAndReport(nil, "deleting the data of guild "+guildID)
+					err := purgeGuildData(guildID)
+					if err != nil {
+						fmt.Println("Error deleting the data of guild " + guildID + ": " + err.Error())
+					}
+				}()
+			}
+			time.Sleep(guildSweepInterval)
+		}
+	}()
+}
+
+// Deletes everything kept for a guild: database keys, watches, daily posts and finally its settings
+// Settings go last, since they record that the guild's data is due to be deleted; if anything fails, it's tried again later
+func purgeGuildData(guildID string) error {
+	DebugPrint("Deleting the data of guild " + guildID)
+
+	if db != nil {
+		keys, err := db.Keys(guildKey(guildID, "*"))
+		if err != nil {
+			return err
+		}
+		err = db.Delete(keys...)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := watches.removeGuild(guildID)
+	if err != nil {
+		return err
+	}
+	err = schedules.removeGuild(guildID)
+	if err != nil {
+		return err
+	}
+
+	return settings.remove(guildID)
+}
@@ -252,6 +252,15 @@ func (e *Embed) TruncateFooter() *Embed {
 	return e
 }
 
+// Gets a channel from the state cache, asking Discord directly if it isn't cached
+func GetChannel(session *discordgo.Session, channelID string) (*discordgo.Channel, error) {
+	channel, err := session.State.Channel(channelID)
+	if err == nil {
+		return channel, nil
+	}
+	return session.Channel(channelID)
+}
+
 // Finds the VoiceState object that a user currently belongs in
 func FindUserVoiceState(session *discordgo.Session, userid string) (*discordgo.VoiceState, error) {
 	for _, guild := range session.State.Guilds {
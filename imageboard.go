@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ImageBoard is a site which can be searched for images, like Derpibooru or e621
+type ImageBoard interface {
+	// Name is the site's name as shown to users
+	Name() string
+	// Search runs a query in the site's own syntax, adding the policy's restrictions in a way the site understands
+	Search(ctx context.Context, query string, policy effectivePolicy) (BoardResults, error)
+}
+
+// BoardImage is one image from any image board, with ratings mapped onto Derpibooru's rating tags
+type BoardImage struct {
+	ID        string   // ID on the site
+	Site      string   // name of the site it came from
+	PageURL   string   // link to the image's page
+	ImageURL  string   // link to a version of the image suitable for embedding
+	IsVideo   bool     // the file is a video, which can't be shown in an embed
+	Ratings   []string // rating tags, from derpiRatingTags
+	Artists   []string // artist names
+	Tags      []string // every tag, as the site spells them
+	TagIDs    []int    // tag IDs, for sites which have them
+	Score     int      // net votes
+	SourceURL string   // where the image was originally posted, if known
+}
+
+// BoardResults is one page of search results from an image board
+type BoardResults struct {
+	Images []BoardImage
+	Total  int // results in total, or just on this page if the site doesn't say
+}
+
+// Image boards by name, including short aliases (see initBoards)
+var boards map[string]ImageBoard
+
+// Full names of the image boards, in the order they're listed to users
+var boardSites = []string{"derpibooru", "twibooru", "manebooru", "ponybooru", "e621"}
+
+// Results requested per search on boards other than Derpibooru
+const boardPerPage = 15
+
+// Sets up the image boards `.booru` can search
+func initBoards() {
+	derpibooru := &derpibooruBoard{client: derpi}
+	twibooru := newPhilomenaBoard("Twibooru", "https://twibooru.org", "/api/v3/search/posts", "/")
+	manebooru := newPhilomenaBoard("Manebooru", "https://manebooru.art", "/api/v1/json/search/images", "/images/")
+	ponybooru := newPhilomenaBoard("Ponybooru", "https://ponybooru.org", "/api/v1/json/search/images", "/images/")
+	e621 := newE621Board("https://e621.net")
+
+	boards = map[string]ImageBoard{
+		"derpibooru": derpibooru,
+		"derpi":      derpibooru,
+		"db":         derpibooru,
+		"twibooru":   twibooru,
+		"twi":        twibooru,
+		"manebooru":  manebooru,
+		"mane":       manebooru,
+		"ponybooru":  ponybooru,
+		"pony":       ponybooru,
+		"e621":       e621,
+		"e6":         e621,
+	}
+}
+
+// Full name of a board from any of its names, like "derpibooru" for "db"
+func boardSiteName(name string) (string, bool) {
+	board, ok := boards[strings.ToLower(name)]
+	if !ok {
+		return "", false
+	}
+	for _, site := range boardSites {
+		if boards[site] == board {
+			return site, true
+		}
+	}
+	return "", false
+}
+
+// The board used when `.booru` isn't given a site: the guild's default, or Derpibooru
+func defaultBoard(guildID string) string {
+	if site := settings.guild(guildID).DefaultBooru; site != "" {
+		if _, ok := boards[site]; ok {
+			return site
+		}
+	}
+	return "derpibooru"
+}
+
+// Excluded tags given as Derpibooru tag IDs rather than names, which only Derpibooru results can be checked against
+func (policy effectivePolicy) excludedTagIDs() []string {
+	ids := []string{}
+	for _, excluded := range policy.excludedTags {
+		if _, err := strconv.Atoi(excluded); err == nil {
+			ids = append(ids, excluded)
+		}
+	}
+	return ids
+}
+
+// Checks an image from any board against the policy, giving the reason if it isn't allowed
+func (policy effectivePolicy) allowsBoardImage(image BoardImage) (bool, string) {
+	if len(image.Ratings) == 0 {
+		return false, "it has no rating"
+	}
+	for _, rating := range image.Ratings {
+		if !containsString(policy.ratings, rating) {
+			return false, "it's rated " + rating
+		}
+	}
+
+	for _, excluded := range policy.excludedTags {
+		if id, err := strconv.Atoi(excluded); err == nil {
+			// tag IDs are Derpibooru's; every other site numbers its tags its own way
+			if image.Site != "Derpibooru" {
+				return false, "excluded tag IDs can only be checked on Derpibooru"
+			}
+			for _, tagID := range image.TagIDs {
+				if tagID == id {
+					return false, "it has an excluded tag"
+				}
+			}
+			continue
+		}
+		// e621 uses underscores where Derpibooru uses spaces
+		if containsString(image.Tags, excluded) || containsString(image.Tags, strings.Replace(excluded, " ", "_", -1)) {
+			return false, "it's tagged " + excluded
+		}
+	}
+
+	return true, ""
+}
+
+// Performs a GET request to a JSON API and parses the response into target
+func fetchJSON(ctx context.Context, client *http.Client, site string, link string, target interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", link, nil)
+	if err != nil {
+		fmt.Println(err)
+		return fmt.Errorf("Failed to build request.")
+	}
+	request.Header.Set("User-Agent", "Sunbot/"+version)
+
+	resp, err := client.Do(request)
+	if err != nil {
+		fmt.Println(err)
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s took too long to respond.", site)
+		}
+		return fmt.Errorf("Failed with HTTP error.")
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with HTTP %d.", site, resp.StatusCode)
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Println(err)
+		return fmt.Errorf("Failed with error reading response body.")
+	}
+
+	err = json.Unmarshal(respBody, target)
+	if err != nil {
+		fmt.Println(err)
+		return fmt.Errorf("Failed with JSON parsing error.")
+	}
+	return nil
+}
+
+// Builds the reply for an image from any board
+// Videos can't be shown in an embed, so their link goes in the message text where Discord plays it
+func boardImageOutput(image BoardImage, footer string) *commandOutput {
+	author := "Unknown artist"
+	if len(image.Artists) > 0 {
+		author = "By " + strings.Join(image.Artists, ", ")
+	}
+
+	ratings := image.Ratings
+	if len(ratings) == 0 {
+		ratings = []string{"unrated"}
+	}
+
+	embed := NewEmbed().
+		SetTitle(image.Site+" #"+image.ID).
+		SetURL(image.PageURL).
+		SetAuthor(author).
+		SetColor(derpiEmbedColor).
+		AddField("Score", strconv.Itoa(image.Score)).
+		AddField("Rating", strings.Join(ratings, ", "))
+	if image.SourceURL != "" {
+		embed.AddField("Source", image.SourceURL)
+	}
+	embed.InlineAllFields()
+
+	if footer != "" {
+		embed.SetFooter(footer)
+	}
+
+	output := &commandOutput{}
+	if image.IsVideo {
+		output.response = image.ImageURL
+	} else {
+		embed.SetImage(image.ImageURL)
+	}
+
+	output.embed = embed.Truncate().MessageEmbed
+	return output
+}
+
+// Derpibooru as an image board, using the client in derpibooru.go so searches share its cache
+type derpibooruBoard struct {
+	client *DerpiClient
+}
+
+func (board *derpibooruBoard) Name() string {
+	return "Derpibooru"
+}
+
+func (board *derpibooruBoard) Search(ctx context.Context, query string, policy effectivePolicy) (BoardResults, error) {
+	restricted, err := policy.query(query)
+	if err != nil {
+		return BoardResults{}, err
+	}
+
+	results, err := board.client.Search(ctx, DerpiSearchOptions{
+		Query:    restricted,
+		PerPage:  boardPerPage,
+		FilterID: policy.filter(0),
+	})
+	if err != nil {
+		return BoardResults{}, err
+	}
+
+	images := []BoardImage{}
+	for _, image := range results.Search {
+		images = append(images, derpiBoardImage(image))
+	}
+	return BoardResults{Images: images, Total: results.Total}, nil
+}
+
+// Converts a Derpibooru image to the common model
+func derpiBoardImage(image DerpiImage) BoardImage {
+	imageURL := image.EmbedImageURL()
+	if image.IsVideo() {
+		imageURL = absoluteURL(firstNonEmpty(image.Representations.Full, image.Image))
+	}
+
+	return BoardImage{
+		ID:        strconv.Itoa(image.ID),
+		Site:      "Derpibooru",
+		PageURL:   derpi.PageURL(image.ID),
+		ImageURL:  imageURL,
+		IsVideo:   image.IsVideo(),
+		Ratings:   image.Ratings(),
+		Artists:   image.Artists(),
+		Tags:      image.TagList(),
+		TagIDs:    image.TagIds,
+		Score:     image.Score,
+		SourceURL: image.SourceURL,
+	}
+}
+
+// Handles `.booru default <site>`
+func setDefaultBoard(name string, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, session *discordgo.Session) *commandOutput {
+	if channel.GuildID == "" {
+		return &commandOutput{response: "The default site can only be changed in a server."}
+	}
+	if name == "" {
+		return &commandOutput{response: "The default site here is " + defaultBoard(channel.GuildID) + "."}
+	}
+
+	if denied := requirePermission(session, msgEvent, channel, discordgo.PermissionManageServer, "change the default site"); denied != nil {
+		return denied
+	}
+
+	site, ok := boardSiteName(name)
+	if !ok {
+		return &commandOutput{response: "I don't know that site. I can search " + strings.Join(boardSites, ", ") + "."}
+	}
+
+	err := settings.update(channel.GuildID, func(guild *guildSettings) {
+		guild.DefaultBooru = site
+	})
+	if err != nil {
+		fmt.Println(err)
+		return &commandOutput{response: "Error saving settings"}
+	}
+	return &commandOutput{response: "Done! `booru` searches " + site + " here unless told otherwise."}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestAllowsBoardImage(t *testing.T) {
+	derpibooru := &derpibooruBoard{}
+	twibooru := &philomenaBoard{name: "Twibooru", baseURL: "https://twibooru.test", pagePath: "/"}
+	policy := effectivePolicy{ratings: []string{"safe", "suggestive"}, excludedTags: []string{"body horror"}}
+	withTagID := effectivePolicy{ratings: []string{"safe"}, excludedTags: []string{"42"}}
+
+	tests := []struct {
+		name    string
+		policy  effectivePolicy
+		image   BoardImage
+		allowed bool
+	}{
+		{"allowed rating", policy, BoardImage{Site: "e621", Ratings: []string{"safe"}}, true},
+		{"forbidden rating", policy, BoardImage{Site: "e621", Ratings: []string{"explicit"}}, false},
+		{"one forbidden rating", policy, BoardImage{Site: "Derpibooru", Ratings: []string{"safe", "grimdark"}}, false},
+		{"unrated", policy, BoardImage{Site: "e621"}, false},
+		{"excluded tag", policy, BoardImage{Site: "Twibooru", Ratings: []string{"safe"}, Tags: []string{"safe", "body horror"}}, false},
+		{"excluded tag with underscores", policy, BoardImage{Site: "e621", Ratings: []string{"safe"}, Tags: []string{"body_horror"}}, false},
+		{"tag ID on Derpibooru", withTagID, BoardImage{Site: "Derpibooru", Ratings: []string{"safe"}, TagIDs: []int{1, 42}}, false},
+		{"other tag IDs on Derpibooru", withTagID, BoardImage{Site: "Derpibooru", Ratings: []string{"safe"}, TagIDs: []int{1, 2}}, true},
+		// other sites number their tags differently, so a tag ID can't be checked and the image isn't shown
+		{"tag ID on Twibooru", withTagID, BoardImage{Site: "Twibooru", Ratings: []string{"safe"}, TagIDs: []int{1, 2}}, false},
+		{"tag ID on e621", withTagID, BoardImage{Site: "e621", Ratings: []string{"safe"}}, false},
+		{"Philomena image without a rating tag", policy, twibooru.convert(philomenaImage{ID: 1, Tags: []string{"pony", "cute"}}), false},
+		{"Philomena image with a rating tag", policy, twibooru.convert(philomenaImage{ID: 2, Tags: []string{"safe", "pony"}}), true},
+	}
+
+	for _, test := range tests {
+		if allowed, reason := test.policy.allowsBoardImage(test.image); allowed != test.allowed {
+			t.Errorf("%s: allowed = %v (%s), want %v", test.name, allowed, reason, test.allowed)
+		}
+	}
+
+	if derpibooru.Name() != "Derpibooru" {
+		t.Errorf("Derpibooru board is named %q, which allowsBoardImage won't check tag IDs for", derpibooru.Name())
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Replaces a file's contents by writing a temporary file next to it and renaming it over the old one,
+// so a crash can't leave half a file behind and nothing reading it ever sees one
+func writeFileAtomic(path string, data []byte) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(data)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), path)
+}
+
+// Something kept in a listStore: it belongs to a guild and gets a number users can refer to it by
+type listItem[T any] interface {
+	*T
+	itemID() int
+	setItemID(id int)
+	itemGuild() string
+}
+
+// A list of numbered things belonging to guilds, like watches and daily posts, saved to a JSON file so they survive
+// restarts. The file looks like {"nextID": 3, "<name>": [...]}
+// Types embed it and add their own methods, holding the lock and calling save as these do
+// It's generic, so building Sunbot needs Go 1.18 or newer
+type listStore[T any, P listItem[T]] struct {
+	sync.Mutex
+	path   string
+	name   string // key the items are saved under
+	nextID int
+	items  []P
+}
+
+// Loads a list from the given file; a missing file just means it's empty so far
+func loadListStore[T any, P listItem[T]](path string, name string) (*listStore[T, P], error) {
+	store := &listStore[T, P]{path: path, name: name, nextID: 1}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	saved := make(map[string]json.RawMessage)
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return nil, err
+	}
+	if nextID, ok := saved["nextID"]; ok {
+		err = json.Unmarshal(nextID, &store.nextID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if items, ok := saved[name]; ok {
+		err = json.Unmarshal(items, &store.items)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// Writes the whole list to disk; the caller must hold the lock
+func (store *listStore[T, P]) save() error {
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"nextID":   store.nextID,
+		store.name: store.items,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(store.path, data)
+}
+
+// Numbers an item, adds it and saves
+func (store *listStore[T, P]) add(item P) error {
+	store.Lock()
+	defer store.Unlock()
+
+	item.setItemID(store.nextID)
+	store.nextID++
+	store.items = append(store.items, item)
+	return store.save()
+}
+
+// Removes the item with the given number from a guild, reporting whether it existed
+func (store *listStore[T, P]) remove(guildID string, id int) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	for i, item := range store.items {
+		if item.itemID() == id && item.itemGuild() == guildID {
+			store.items = append(store.items[:i], store.items[i+1:]...)
+			return true, store.save()
+		}
+	}
+	return false, nil
+}
+
+// Replaces everything a guild has with copies of the given items, numbering them afresh since their old numbers
+// may be taken; with no items, just removes the guild's
+func (store *listStore[T, P]) replaceGuild(guildID string, items []T) error {
+	store.Lock()
+	defer store.Unlock()
+
+	kept := []P{}
+	for _, item := range store.items {
+		if item.itemGuild() != guildID {
+			kept = append(kept, item)
+		}
+	}
+	if len(kept) == len(store.items) && len(items) == 0 {
+		return nil
+	}
+
+	for i := range items {
+		copied := P(new(T))
+		*copied = items[i]
+		copied.setItemID(store.nextID)
+		store.nextID++
+		kept = append(kept, copied)
+	}
+	store.items = kept
+	return store.save()
+}
+
+// Removes all of a guild's items and saves the rest
+func (store *listStore[T, P]) removeGuild(guildID string) error {
+	return store.replaceGuild(guildID, nil)
+}
+
+// Copies of a guild's items, oldest first, or of every guild's with an empty ID
+func (store *listStore[T, P]) forGuild(guildID string) []T {
+	store.Lock()
+	defer store.Unlock()
+
+	list := []T{}
+	for _, item := range store.items {
+		if guildID == "" || item.itemGuild() == guildID {
+			list = append(list, *item)
+		}
+	}
+	return list
+}
+
+// The items in a list belonging to one guild, like the watches in a backup
+func itemsOfGuild[T any, P listItem[T]](items []T, guildID string) []T {
+	list := []T{}
+	for i := range items {
+		if P(&items[i]).itemGuild() == guildID {
+			list = append(list, items[i])
+		}
+	}
+	return list
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Files written before listStore existed still load, and saving keeps the same layout
+func TestListStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sunbot-list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "watches.json")
+
+	err = ioutil.WriteFile(path, []byte(`{"nextID": 4, "watches": [
+		{"id": 1, "guildID": "10", "channelID": "100", "query": "safe"},
+		{"id": 3, "guildID": "20", "channelID": "200", "query": "cute"}
+	]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := loadWatches(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := store.forGuild("10"); len(list) != 1 || list[0].Query != "safe" {
+		t.Errorf("forGuild(10) = %v", list)
+	}
+	if list := store.forGuild(""); len(list) != 2 {
+		t.Errorf("forGuild of every guild has %d watches, want 2", len(list))
+	}
+
+	// new ones carry on from nextID, and removing checks the guild
+	err = store.add(&derpiWatch{GuildID: "10", ChannelID: "101", Query: "solo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed, _ := store.remove("20", 4); removed {
+		t.Errorf("removed another guild's watch")
+	}
+	if removed, _ := store.remove("20", 3); !removed {
+		t.Errorf("didn't remove watch #3")
+	}
+
+	// replacing a guild's watches numbers them afresh
+	err = store.replaceGuild("10", []derpiWatch{{ID: 1, GuildID: "10", Query: "a"}, {ID: 1, GuildID: "10", Query: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := loadWatches(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []int{}
+	for _, watch := range reloaded.forGuild("") {
+		ids = append(ids, watch.ID)
+	}
+	if !reflect.DeepEqual(ids, []int{5, 6}) {
+		t.Errorf("watch IDs after reloading = %v, want [5 6]", ids)
+	}
+
+	err = reloaded.removeGuild("10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty, _ := loadWatches(path); len(empty.forGuild("")) != 0 || empty.nextID != 7 {
+		t.Errorf("after removing the guild: %d watches, next ID %d", len(empty.forGuild("")), empty.nextID)
+	}
+
+	// nothing is left behind from writing
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 {
+		t.Errorf("files in the directory: %v", files)
+	}
+}
+
+func TestItemsOfGuild(t *testing.T) {
+	all := []derpiSchedule{{ID: 1, GuildID: "1"}, {ID: 2, GuildID: "2"}, {ID: 3, GuildID: "1"}}
+	tests := []struct {
+		guildID string
+		want    []int
+	}{
+		{"1", []int{1, 3}},
+		{"2", []int{2}},
+		{"3", []int{}},
+	}
+
+	for _, test := range tests {
+		ids := []int{}
+		for _, schedule := range itemsOfGuild(all, test.guildID) {
+			ids = append(ids, schedule.ID)
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("itemsOfGuild(%s) = %v, want %v", test.guildID, ids, test.want)
+		}
+	}
+}
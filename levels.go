@@ -0,0 +1,530 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// XP is kept per guild, on top of the layout in users.go:
+//   guild:<guild ID>:xp                          sorted set of user ID -> XP
+//   guild:<guild ID>:user:<user ID>:xpcooldown   exists while a user can't earn XP, expiring after XP_COOLDOWN
+// Levels aren't stored; they're worked out from XP with the guild's curve, so changing the curve moves everyone
+
+// Guild settings for the levelling system
+type levelSettings struct {
+	Enabled  bool           `json:"enabled,omitempty"`  // whether messages earn XP in this guild
+	Curve    []int64        `json:"curve,omitempty"`    // a, b, c: going from level n to n+1 takes a*n² + b*n + c XP; empty for defaultLevelCurve
+	Announce string         `json:"announce,omitempty"` // where level-ups are announced: "channel" (the default), "dm", "off" or a channel ID
+	Rewards  map[int]string `json:"rewards,omitempty"`  // level -> role ID given on reaching it
+}
+
+// The same curve Mee6 uses, so imported XP keeps its levels
+var defaultLevelCurve = []int64{5, 50, 100}
+
+// Levels stop here, so a curve can't make working one out take forever
+const maxLevel = 1000
+
+// Largest CSV file the xp command will import
+const maxXPImportSize = 1 << 20
+
+// Used to download CSV files attached to the xp command
+var attachmentClient = &http.Client{Timeout: 30 * time.Second}
+
+// The curve a guild's levels use
+func (levels *levelSettings) curve() []int64 {
+	if len(levels.Curve) == 3 {
+		return levels.Curve
+	}
+	return defaultLevelCurve
+}
+
+// How much XP it takes to go from one level to the next
+func levelStep(curve []int64, level int) int64 {
+	n := int64(level)
+	return curve[0]*n*n + curve[1]*n + curve[2]
+}
+
+// Total XP needed to reach a level
+func xpForLevel(curve []int64, level int) int64 {
+	total := int64(0)
+	for n := 0; n < level && n < maxLevel; n++ {
+		total += levelStep(curve, n)
+	}
+	return total
+}
+
+// The level a total amount of XP reaches
+func levelForXP(curve []int64, xp int64) int {
+	level := 0
+	for level < maxLevel {
+		step := levelStep(curve, level)
+		if xp < step {
+			break
+		}
+		xp -= step
+		level++
+	}
+	return level
+}
+
+// Key of the sorted set holding everyone's XP in a guild
+func xpKey(guildID string) string {
+	return guildKey(guildID, "xp")
+}
+
+// Gives XP for a message, unless the author got some too recently, and announces any level-up
+// The caller has already checked the message should count (see recordMessage)
+func awardXP(session *discordgo.Session, msgEvent *discordgo.MessageCreate, channel *discordgo.Channel) error {
+	levels := settings.guild(channel.GuildID).Levels
+	if levels == nil || !levels.Enabled {
+		return nil
+	}
+	userID := msgEvent.Author.ID
+
+	// only the first message since the cooldown started creates the key, so only it earns XP, however many arrive at once
+	// the key gets its expiry as it's created, so a crash can't leave one which never expires
+	cooldownKey := memberKey(channel.GuildID, userID) + ":xpcooldown"
+	started, err := db.SetNX(cooldownKey, "1", cfg.XPCooldown)
+	if err != nil || !started {
+		return err
+	}
+
+	gained := int64(cfg.XPMin)
+	if cfg.XPMax > cfg.XPMin {
+		gained += rand.Int63n(int64(cfg.XPMax-cfg.XPMin) + 1)
+	}
+	total, err := db.ZIncrBy(xpKey(channel.GuildID), userID, float64(gained))
+	if err != nil {
+		return err
+	}
+
+	curve := levels.curve()
+	before := levelForXP(curve, int64(total)-gained)
+	after := levelForXP(curve, int64(total))
+	if after > before {
+		levelUp(session, channel, msgEvent.Author, levels, after)
+	}
+	return nil
+}
+
+// Gives a user the role rewards for every level they've reached, returning the names of the roles
+// Roles they already have are given again, which does nothing, so XP set by an admin or imported catches up too
+func grantRewards(session *discordgo.Session, guildID string, userID string, levels *levelSettings, level int) []string {
+	granted := []string{}
+	for rewardLevel, roleID := range levels.Rewards {
+		if rewardLevel > level {
+			continue
+		}
+		err := session.GuildMemberRoleAdd(guildID, userID, roleID)
+		if err != nil {
+			fmt.Println("Error giving a level " + strconv.Itoa(rewardLevel) + " reward role: " + err.Error())
+			continue
+		}
+		if role, err := session.State.Role(guildID, roleID); err == nil {
+			granted = append(granted, role.Name)
+		}
+	}
+	sort.Strings(granted)
+	return granted
+}
+
+// Hands out rewards for a new level and announces it wherever the guild wants
+func levelUp(session *discordgo.Session, channel *discordgo.Channel, user *discordgo.User, levels *levelSettings, level int) {
+	roles := grantRewards(session, channel.GuildID, user.ID, levels, level)
+	message := "GG " + user.Mention() + ", you reached level **" + strconv.Itoa(level) + "**!"
+	if len(roles) > 0 {
+		message += " You now have: **" + strings.Join(roles, "**, **") + "**"
+	}
+
+	target := channel.ID
+	switch levels.Announce {
+	case "off":
+		return
+	case "", "channel":
+	case "dm":
+		dm, err := session.UserChannelCreate(user.ID)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		target = dm.ID
+		if guild, err := session.State.Guild(channel.GuildID); err == nil {
+			message = "GG, you reached level **" + strconv.Itoa(level) + "** in " + guild.Name + "!"
+			if len(roles) > 0 {
+				message += " You now have: **" + strings.Join(roles, "**, **") + "**"
+			}
+		}
+	default:
+		target = levels.Announce
+	}
+
+	_, err := session.ChannelMessageSend(target, message)
+	if err != nil {
+		fmt.Println("Error announcing a level-up: " + err.Error())
+	}
+}
+
+// Reads a user's XP in a guild; users who never earned any have 0
+func userXP(guildID string, userID string) (int64, error) {
+	xp, err := db.ZScore(xpKey(guildID), userID)
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	return int64(xp), err
+}
+
+// Changes a user's XP with an admin command: give and take add or remove an amount, set replaces it
+// Returns the new total; XP never goes below 0
+func adjustXP(session *discordgo.Session, guildID string, userID string, action string, amount int64) (int64, error) {
+	var total float64
+	var err error
+	switch action {
+	case "give":
+		total, err = db.ZIncrBy(xpKey(guildID), userID, float64(amount))
+	case "take":
+		total, err = db.ZIncrBy(xpKey(guildID), userID, -float64(amount))
+		if err == nil && total < 0 {
+			total = 0
+			err = db.ZAdd(xpKey(guildID), userID, 0)
+		}
+	case "set":
+		total = float64(amount)
+		err = db.ZAdd(xpKey(guildID), userID, total)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if levels := settings.guild(guildID).Levels; levels != nil {
+		grantRewards(session, guildID, userID, levels, levelForXP(levels.curve(), int64(total)))
+	}
+	return int64(total), nil
+}
+
+// Takes away a user's XP and cooldown, or everyone's if userID is empty; roles they were given are left alone
+func resetXP(guildID string, userID string) error {
+	if userID != "" {
+		err := db.ZRem(xpKey(guildID), userID)
+		if err != nil {
+			return err
+		}
+		return db.Delete(memberKey(guildID, userID) + ":xpcooldown")
+	}
+
+	cooldowns, err := db.Keys(guildKey(guildID, "user", "*", "xpcooldown"))
+	if err != nil {
+		return err
+	}
+	return db.Delete(append(cooldowns, xpKey(guildID))...)
+}
+
+// Sets XP from CSV rows of user (ID or mention) and XP, like an export from another bot
+// A first row whose XP isn't a number is taken as a header; other bad rows are skipped and counted
+func importXP(guildID string, input io.Reader) (imported int, skipped int, err error) {
+	reader := csv.NewReader(io.LimitReader(input, maxXPImportSize))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	for row := 0; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, skipped, fmt.Errorf("That doesn't look like a CSV file: %v", err)
+		}
+		if len(record) < 2 {
+			skipped++
+			continue
+		}
+
+		userID := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(record[0]), "<@"), "!"), ">")
+		xp, xpErr := strconv.ParseInt(strings.TrimSpace(record[1]), 10, 64)
+		_, idErr := strconv.ParseUint(userID, 10, 64)
+		if xpErr != nil || idErr != nil || xp < 0 {
+			if row > 0 {
+				skipped++
+			}
+			continue
+		}
+
+		err = db.ZAdd(xpKey(guildID), userID, float64(xp))
+		if err != nil {
+			return imported, skipped, err
+		}
+		imported++
+	}
+	return imported, skipped, nil
+}
+
+// Downloads a CSV file attached to a message and imports it
+func importXPAttachment(guildID string, attachment *discordgo.MessageAttachment) (imported int, skipped int, err error) {
+	if attachment.Size > maxXPImportSize {
+		return 0, 0, fmt.Errorf("That file is too big; the limit is %d KB.", maxXPImportSize/1024)
+	}
+
+	resp, err := attachmentClient.Get(attachment.URL)
+	if err != nil {
+		fmt.Println(err)
+		return 0, 0, fmt.Errorf("Error downloading the file")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("Discord responded with HTTP %d.", resp.StatusCode)
+	}
+	return importXP(guildID, resp.Body)
+}
+
+// Width of the progress bar in rankOutput, in characters
+const progressBarWidth = 20
+
+// Draws how far some XP is towards the next level, with a label for it
+// At maxLevel there's no next level, so the bar is shown full
+func levelProgress(curve []int64, xp int64) (label string, bar string) {
+	level := levelForXP(curve, xp)
+	if level >= maxLevel {
+		return "Progress", "`" + strings.Repeat("█", progressBarWidth) + "` Max level!"
+	}
+
+	into := xp - xpForLevel(curve, level)
+	step := levelStep(curve, level)
+	filled := int(into * progressBarWidth / step)
+	if filled < 0 {
+		filled = 0
+	}
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+	bar = "`" + strings.Repeat("█", filled) + strings.Repeat("░", progressBarWidth-filled) + "` " +
+		strconv.FormatInt(into, 10) + " / " + strconv.FormatInt(step, 10) + " XP"
+	return "Progress to level " + strconv.Itoa(level+1), bar
+}
+
+// Builds the embed showing a user's level and XP in a guild
+func rankOutput(guildID string, user *discordgo.User) (*discordgo.MessageEmbed, error) {
+	xp, err := userXP(guildID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	levels := settings.guild(guildID).Levels
+	if levels == nil {
+		levels = &levelSettings{}
+	}
+	curve := levels.curve()
+	level := levelForXP(curve, xp)
+	label, progress := levelProgress(curve, xp)
+
+	embed := NewEmbed().
+		SetTitle(user.Username+"'s rank").
+		SetThumbnail(user.AvatarURL("128")).
+		AddField("Level", strconv.Itoa(level)).
+		AddField("XP", strconv.FormatInt(xp, 10))
+
+	rank, err := db.ZRank(xpKey(guildID), user.ID, true)
+	if err == nil {
+		total, err := db.ZCard(xpKey(guildID))
+		if err != nil {
+			return nil, err
+		}
+		embed.AddField("Rank", "#"+strconv.FormatInt(rank+1, 10)+" of "+strconv.FormatInt(total, 10))
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+	embed.InlineAllFields()
+	embed.AddField(label, progress)
+
+	if !levels.Enabled {
+		embed.SetFooter("Levels are turned off in this server, so messages don't earn XP.")
+	}
+	return embed.MessageEmbed, nil
+}
+
+// Builds the embed listing the people with the most XP in a guild
+func xpLeaderboardOutput(guildID string) (*discordgo.MessageEmbed, error) {
+	top, err := db.ZRange(xpKey(guildID), 0, leaderboardSize-1, true)
+	if err != nil {
+		return nil, err
+	}
+
+	embed := NewEmbed().SetTitle("Highest levels")
+	if len(top) == 0 {
+		return embed.SetDescription("Nobody has any XP yet!").MessageEmbed, nil
+	}
+
+	levels := settings.guild(guildID).Levels
+	if levels == nil {
+		levels = &levelSettings{}
+	}
+	lines := []string{}
+	for i, member := range top {
+		name, err := db.HGet(userKey(member.Member), "username")
+		if err == ErrNotFound {
+			name = "<@" + member.Member + ">"
+		} else if err != nil {
+			return nil, err
+		}
+		xp := int64(member.Score)
+		lines = append(lines, "**"+strconv.Itoa(i+1)+".** "+name+" - level "+strconv.Itoa(levelForXP(levels.curve(), xp))+" ("+strconv.FormatInt(xp, 10)+" XP)")
+	}
+	return embed.SetDescription(strings.Join(lines, "\n")).Truncate().MessageEmbed, nil
+}
+
+// Builds the embed showing a guild's level settings
+func levelsOutput(guildID string) *commandOutput {
+	levels := settings.guild(guildID).Levels
+	if levels == nil {
+		levels = &levelSettings{}
+	}
+
+	enabled := "Off"
+	if levels.Enabled {
+		enabled = "On"
+	}
+	curve := levels.curve()
+	announce := "In the channel"
+	switch levels.Announce {
+	case "", "channel":
+	case "dm":
+		announce = "By DM"
+	case "off":
+		announce = "Off"
+	default:
+		announce = "In <#" + levels.Announce + ">"
+	}
+
+	rewardLevels := []int{}
+	for level := range levels.Rewards {
+		rewardLevels = append(rewardLevels, level)
+	}
+	sort.Ints(rewardLevels)
+	rewards := []string{}
+	for _, level := range rewardLevels {
+		rewards = append(rewards, "Level "+strconv.Itoa(level)+": <@&"+levels.Rewards[level]+">")
+	}
+	if len(rewards) == 0 {
+		rewards = append(rewards, "None")
+	}
+
+	embed := NewEmbed().
+		SetTitle("Levels").
+		AddField("Earning XP", enabled).
+		AddField("Announcements", announce).
+		AddField("XP per message", strconv.Itoa(cfg.XPMin)+"-"+strconv.Itoa(cfg.XPMax)+", once every "+cfg.XPCooldown.String()).
+		InlineAllFields().
+		AddField("Curve", fmt.Sprintf("%d×level² + %d×level + %d XP per level (level 10 takes %d XP in all)", curve[0], curve[1], curve[2], xpForLevel(curve, 10))).
+		AddField("Role rewards", strings.Join(rewards, "\n"))
+	return &commandOutput{embed: embed.Truncate().MessageEmbed}
+}
+
+// Changes a guild's level settings from the levels command; the caller checks permissions
+func updateLevels(session *discordgo.Session, guildID string, setting string, value string) (string, error) {
+	change := func(levels *levelSettings) (string, error) {
+		switch setting {
+		case "on":
+			levels.Enabled = true
+			return "Okay, messages here earn XP now.", nil
+		case "off":
+			levels.Enabled = false
+			return "Okay, messages here don't earn XP any more. Everyone keeps what they have.", nil
+		case "curve":
+			if value == "default" {
+				levels.Curve = nil
+				return "Okay, levels use the default curve again.", nil
+			}
+			parts := strings.Fields(strings.Replace(value, ",", " ", -1))
+			curve := []int64{}
+			for _, part := range parts {
+				number, err := strconv.ParseInt(part, 10, 64)
+				if err != nil || number < 0 || number > 1000000 {
+					break
+				}
+				curve = append(curve, number)
+			}
+			if len(parts) != 3 || len(curve) != 3 || curve[2] < 1 {
+				return "", fmt.Errorf("The curve is three numbers `a b c`, where going from level n to n+1 takes a×n² + b×n + c XP, and c is at least 1. The default is `5 50 100`.")
+			}
+			levels.Curve = curve
+			return "Okay, levels use the new curve. Level 10 now takes " + strconv.FormatInt(xpForLevel(curve, 10), 10) + " XP.", nil
+		case "announce":
+			switch value {
+			case "channel", "dm", "off":
+				levels.Announce = value
+				if value == "channel" {
+					levels.Announce = ""
+				}
+			default:
+				channelID, ok := parseChannelMention(value)
+				if !ok {
+					return "", fmt.Errorf("Use `channel`, `dm`, `off` or a #channel.")
+				}
+				target, err := GetChannel(session, channelID)
+				if err != nil || target.GuildID != guildID {
+					return "", fmt.Errorf("I can't find that channel in this server.")
+				}
+				levels.Announce = channelID
+			}
+			return "Okay, level-ups will be announced there.", nil
+		case "reward":
+			parts := strings.Fields(value)
+			if len(parts) != 2 {
+				return "", fmt.Errorf("Use `reward <level> @role`, or `reward <level> none` to remove one.")
+			}
+			level, err := strconv.Atoi(parts[0])
+			if err != nil || level < 1 || level > maxLevel {
+				return "", fmt.Errorf("`%s` isn't a level.", parts[0])
+			}
+
+			rewards := make(map[int]string)
+			for rewardLevel, roleID := range levels.Rewards {
+				rewards[rewardLevel] = roleID
+			}
+			if parts[1] == "none" {
+				delete(rewards, level)
+				levels.Rewards = rewards
+				return "Okay, level " + strconv.Itoa(level) + " doesn't give a role any more.", nil
+			}
+
+			roleID := strings.TrimSuffix(strings.TrimPrefix(parts[1], "<@&"), ">")
+			if _, err := session.State.Role(guildID, roleID); err != nil {
+				return "", fmt.Errorf("I can't find that role in this server. Use a @role mention or a role ID.")
+			}
+			rewards[level] = roleID
+			levels.Rewards = rewards
+			return "Okay, reaching level " + strconv.Itoa(level) + " gives <@&" + roleID + ">. Make sure my role is above it, or I can't give it out.", nil
+		}
+		return "", nil
+	}
+
+	var response string
+	var changeErr error
+	err := settings.update(guildID, func(guild *guildSettings) {
+		levels := guild.Levels
+		if levels == nil {
+			levels = &levelSettings{}
+		}
+
+		// level settings are read without the settings lock, so they're replaced rather than changed in place
+		updated := *levels
+		response, changeErr = change(&updated)
+		if changeErr == nil {
+			guild.Levels = &updated
+		}
+	})
+	if changeErr != nil {
+		return "", changeErr
+	}
+	if err != nil {
+		fmt.Println(err)
+		return "", fmt.Errorf("Error saving settings")
+	}
+	return response, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLevelStep(t *testing.T) {
+	tests := []struct {
+		curve []int64
+		level int
+		want  int64
+	}{
+		{defaultLevelCurve, 0, 100},
+		{defaultLevelCurve, 1, 155},
+		{defaultLevelCurve, 2, 220},
+		{defaultLevelCurve, 10, 1100},
+		{[]int64{0, 0, 1}, 500, 1},
+		{[]int64{1, 2, 3}, 4, 27},
+	}
+
+	for _, test := range tests {
+		if got := levelStep(test.curve, test.level); got != test.want {
+			t.Errorf("levelStep(%v, %d) = %d, want %d", test.curve, test.level, got, test.want)
+		}
+	}
+}
+
+func TestXPForLevel(t *testing.T) {
+	tests := []struct {
+		curve []int64
+		level int
+		want  int64
+	}{
+		{defaultLevelCurve, 0, 0},
+		{defaultLevelCurve, 1, 100},
+		{defaultLevelCurve, 2, 255},
+		{defaultLevelCurve, 3, 475},
+		{defaultLevelCurve, 10, 4675},
+		{[]int64{0, 0, 1}, maxLevel, maxLevel},
+		// levels past the cap cost nothing more
+		{[]int64{0, 0, 1}, maxLevel + 10, maxLevel},
+	}
+
+	for _, test := range tests {
+		if got := xpForLevel(test.curve, test.level); got != test.want {
+			t.Errorf("xpForLevel(%v, %d) = %d, want %d", test.curve, test.level, got, test.want)
+		}
+	}
+}
+
+func TestLevelForXP(t *testing.T) {
+	tests := []struct {
+		curve []int64
+		xp    int64
+		want  int
+	}{
+		{defaultLevelCurve, 0, 0},
+		{defaultLevelCurve, 99, 0},
+		{defaultLevelCurve, 100, 1},
+		{defaultLevelCurve, 254, 1},
+		{defaultLevelCurve, 255, 2},
+		{defaultLevelCurve, 4675, 10},
+		{defaultLevelCurve, -50, 0},
+		{defaultLevelCurve, 1739743500, maxLevel},
+		{[]int64{0, 0, 1}, maxLevel * 5, maxLevel},
+	}
+
+	for _, test := range tests {
+		if got := levelForXP(test.curve, test.xp); got != test.want {
+			t.Errorf("levelForXP(%v, %d) = %d, want %d", test.curve, test.xp, got, test.want)
+		}
+	}
+
+	// every level starts exactly where xpForLevel says
+	for level := 0; level < 50; level++ {
+		start := xpForLevel(defaultLevelCurve, level)
+		if got := levelForXP(defaultLevelCurve, start); got != level {
+			t.Errorf("levelForXP(xpForLevel(%d)) = %d", level, got)
+		}
+		if level > 0 {
+			if got := levelForXP(defaultLevelCurve, start-1); got != level-1 {
+				t.Errorf("levelForXP(xpForLevel(%d)-1) = %d, want %d", level, got, level-1)
+			}
+		}
+	}
+}
+
+func TestLevelProgress(t *testing.T) {
+	tests := []struct {
+		curve  []int64
+		xp     int64
+		label  string
+		filled int
+		suffix string
+	}{
+		{defaultLevelCurve, 0, "Progress to level 1", 0, "0 / 100 XP"},
+		{defaultLevelCurve, 50, "Progress to level 1", 10, "50 / 100 XP"},
+		{defaultLevelCurve, 99, "Progress to level 1", 19, "99 / 100 XP"},
+		{defaultLevelCurve, 100, "Progress to level 2", 0, "0 / 155 XP"},
+		{defaultLevelCurve, -10, "Progress to level 1", 0, "-10 / 100 XP"},
+		{defaultLevelCurve, 1739743500, "Progress", progressBarWidth, "Max level!"},
+		{[]int64{0, 0, 1}, maxLevel, "Progress", progressBarWidth, "Max level!"},
+	}
+
+	for _, test := range tests {
+		label, bar := levelProgress(test.curve, test.xp)
+		if label != test.label {
+			t.Errorf("levelProgress(%v, %d) label = %q, want %q", test.curve, test.xp, label, test.label)
+		}
+		if got := strings.Count(bar, "█"); got != test.filled {
+			t.Errorf("levelProgress(%v, %d) fills %d, want %d", test.curve, test.xp, got, test.filled)
+		}
+		if got := strings.Count(bar, "█") + strings.Count(bar, "░"); got != progressBarWidth {
+			t.Errorf("levelProgress(%v, %d) is %d wide, want %d", test.curve, test.xp, got, progressBarWidth)
+		}
+		if !strings.HasSuffix(bar, test.suffix) {
+			t.Errorf("levelProgress(%v, %d) = %q, want it to end with %q", test.curve, test.xp, bar, test.suffix)
+		}
+	}
+}
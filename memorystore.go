@@ -0,0 +1,457 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kinds of value a key can hold
+const (
+	storeString = "string"
+	storeHash   = "hash"
+	storeZSet   = "zset"
+)
+
+// One key's value in the memory store; only the field matching Kind is used
+type storeEntry struct {
+	Kind    string             `json:"kind"`
+	Value   string             `json:"value,omitempty"`
+	Hash    map[string]string  `json:"hash,omitempty"`
+	ZSet    map[string]float64 `json:"zset,omitempty"`
+	Expires time.Time          `json:"expires"` // zero for never
+}
+
+func (entry *storeEntry) expired(now time.Time) bool {
+	return !entry.Expires.IsZero() && !now.Before(entry.Expires)
+}
+
+// Keeps everything in a map, so nothing survives a restart; the file store builds on it
+type memoryStore struct {
+	sync.Mutex
+	entries map[string]*storeEntry
+	written func() // called with the lock held after every change, if set
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: make(map[string]*storeEntry)}
+}
+
+// Notes a change; the caller must hold the lock
+func (store *memoryStore) changed() {
+	if store.written != nil {
+		store.written()
+	}
+}
+
+// Finds a key of the given kind, dropping it if it has expired; the caller must hold the lock
+// With create, a missing key is made empty rather than giving ErrNotFound
+func (store *memoryStore) lookup(key string, kind string, create bool) (*storeEntry, error) {
+	entry, ok := store.entries[key]
+	if ok && entry.expired(time.Now()) {
+		delete(store.entries, key)
+		ok = false
+	}
+
+	if !ok {
+		if !create {
+			return nil, ErrNotFound
+		}
+		entry = &storeEntry{Kind: kind}
+		switch kind {
+		case storeHash:
+			entry.Hash = make(map[string]string)
+		case storeZSet:
+			entry.ZSet = make(map[string]float64)
+		}
+		store.entries[key] = entry
+		return entry, nil
+	}
+
+	if entry.Kind != kind {
+		return nil, ErrWrongType
+	}
+	return entry, nil
+}
+
+// Removes a hash or sorted set which has become empty, like Redis does; the caller must hold the lock
+func (store *memoryStore) dropIfEmpty(key string, entry *storeEntry) {
+	if (entry.Kind == storeHash && len(entry.Hash) == 0) || (entry.Kind == storeZSet && len(entry.ZSet) == 0) {
+		delete(store.entries, key)
+	}
+}
+
+func (store *memoryStore) Get(key string) (string, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, err := store.lookup(key, storeString, false)
+	if err != nil {
+		return "", err
+	}
+	return entry.Value, nil
+}
+
+func (store *memoryStore) Set(key string, value string, ttl time.Duration) error {
+	store.Lock()
+	defer store.Unlock()
+
+	// setting replaces whatever was there, whatever kind it was
+	entry := &storeEntry{Kind: storeString, Value: value}
+	if ttl > 0 {
+		entry.Expires = time.Now().Add(ttl)
+	}
+	store.entries[key] = entry
+	store.changed()
+	return nil
+}
+
+func (store *memoryStore) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	// any kind of value counts
+	if entry, ok := store.entries[key]; ok && !entry.expired(time.Now()) {
+		return false, nil
+	}
+
+	entry := &storeEntry{Kind: storeString, Value: value}
+	if ttl > 0 {
+		entry.Expires = time.Now().Add(ttl)
+	}
+	store.entries[key] = entry
+	store.changed()
+	return true, nil
+}
+
+func (store *memoryStore) IncrBy(key string, amount int64) (int64, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, err := store.lookup(key, storeString, true)
+	if err != nil {
+		return 0, err
+	}
+	value := int64(0)
+	if entry.Value != "" {
+		value, err = strconv.ParseInt(entry.Value, 10, 64)
+		if err != nil {
+			return 0, ErrWrongType
+		}
+	}
+	value += amount
+	entry.Value = strconv.FormatInt(value, 10)
+	store.changed()
+	return value, nil
+}
+
+func (store *memoryStore) Delete(keys ...string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	for _, key := range keys {
+		delete(store.entries, key)
+	}
+	store.changed()
+	return nil
+}
+
+func (store *memoryStore) Expire(key string, ttl time.Duration) error {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, ok := store.entries[key]
+	if !ok || entry.expired(time.Now()) {
+		return ErrNotFound
+	}
+	entry.Expires = time.Time{}
+	if ttl > 0 {
+		entry.Expires = time.Now().Add(ttl)
+	}
+	store.changed()
+	return nil
+}
+
+func (store *memoryStore) TTL(key string) (time.Duration, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	now := time.Now()
+	entry, ok := store.entries[key]
+	if !ok || entry.expired(now) {
+		return 0, ErrNotFound
+	}
+	if entry.Expires.IsZero() {
+		return 0, nil
+	}
+	return entry.Expires.Sub(now), nil
+}
+
+func (store *memoryStore) Keys(pattern string) ([]string, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	now := time.Now()
+	keys := []string{}
+	for key, entry := range store.entries {
+		if entry.expired(now) {
+			continue
+		}
+		matched, err := path.Match(pattern, key)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (store *memoryStore) Type(key string) (string, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, ok := store.entries[key]
+	if !ok || entry.expired(time.Now()) {
+		return "", ErrNotFound
+	}
+	return entry.Kind, nil
+}
+
+func (store *memoryStore) HGet(key string, field string) (string, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, err := store.lookup(key, storeHash, false)
+	if err != nil {
+		return "", err
+	}
+	value, ok := entry.Hash[field]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (store *memoryStore) HGetAll(key string) (map[string]string, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	fields := make(map[string]string)
+	entry, err := store.lookup(key, storeHash, false)
+	if err == ErrNotFound {
+		return fields, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for field, value := range entry.Hash {
+		fields[field] = value
+	}
+	return fields, nil
+}
+
+func (store *memoryStore) HSet(key string, fields map[string]string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	entry, err := store.lookup(key, storeHash, true)
+	if err != nil {
+		return err
+	}
+	for field, value := range fields {
+		entry.Hash[field] = value
+	}
+	store.changed()
+	return nil
+}
+
+func (store *memoryStore) HDel(key string, fields ...string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, err := store.lookup(key, storeHash, false)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		delete(entry.Hash, field)
+	}
+	store.dropIfEmpty(key, entry)
+	store.changed()
+	return nil
+}
+
+func (store *memoryStore) HIncrBy(key string, field string, amount int64) (int64, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, err := store.lookup(key, storeHash, true)
+	if err != nil {
+		return 0, err
+	}
+	value := int64(0)
+	if existing, ok := entry.Hash[field]; ok {
+		value, err = strconv.ParseInt(existing, 10, 64)
+		if err != nil {
+			return 0, ErrWrongType
+		}
+	}
+	value += amount
+	entry.Hash[field] = strconv.FormatInt(value, 10)
+	store.changed()
+	return value, nil
+}
+
+func (store *memoryStore) ZAdd(key string, member string, score float64) error {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, err := store.lookup(key, storeZSet, true)
+	if err != nil {
+		return err
+	}
+	entry.ZSet[member] = score
+	store.changed()
+	return nil
+}
+
+func (store *memoryStore) ZIncrBy(key string, member string, amount float64) (float64, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, err := store.lookup(key, storeZSet, true)
+	if err != nil {
+		return 0, err
+	}
+	entry.ZSet[member] += amount
+	store.changed()
+	return entry.ZSet[member], nil
+}
+
+func (store *memoryStore) ZScore(key string, member string) (float64, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, err := store.lookup(key, storeZSet, false)
+	if err != nil {
+		return 0, err
+	}
+	score, ok := entry.ZSet[member]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return score, nil
+}
+
+// Members of a sorted set in order, ties broken by member like Redis does; the caller must hold the lock
+func sortedMembers(entry *storeEntry, reverse bool) []ScoredMember {
+	members := []ScoredMember{}
+	for member, score := range entry.ZSet {
+		members = append(members, ScoredMember{Member: member, Score: score})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		less := members[i].Score < members[j].Score ||
+			(members[i].Score == members[j].Score && members[i].Member < members[j].Member)
+		if reverse {
+			return !less
+		}
+		return less
+	})
+	return members
+}
+
+func (store *memoryStore) ZRank(key string, member string, reverse bool) (int64, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, err := store.lookup(key, storeZSet, false)
+	if err != nil {
+		return 0, err
+	}
+	for rank, scored := range sortedMembers(entry, reverse) {
+		if scored.Member == member {
+			return int64(rank), nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+func (store *memoryStore) ZRange(key string, start int64, stop int64, reverse bool) ([]ScoredMember, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, err := store.lookup(key, storeZSet, false)
+	if err == ErrNotFound {
+		return []ScoredMember{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	members := sortedMembers(entry, reverse)
+	count := int64(len(members))
+	if start < 0 {
+		start += count
+	}
+	if stop < 0 {
+		stop += count
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= count {
+		stop = count - 1
+	}
+	if start > stop {
+		return []ScoredMember{}, nil
+	}
+	return members[start : stop+1], nil
+}
+
+func (store *memoryStore) ZCard(key string) (int64, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, err := store.lookup(key, storeZSet, false)
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(entry.ZSet)), nil
+}
+
+func (store *memoryStore) ZRem(key string, members ...string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, err := store.lookup(key, storeZSet, false)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		delete(entry.ZSet, member)
+	}
+	store.dropIfEmpty(key, entry)
+	store.changed()
+	return nil
+}
+
+func (store *memoryStore) Close() error {
+	return nil
+}
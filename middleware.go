@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"math/rand"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Everything known about a single command invocation; passed along the middleware chain
+type invocation struct {
+	session  *discordgo.Session
+	msgEvent *discordgo.MessageCreate
+	channel  *discordgo.Channel
+	cmd      *command
+	verb     string       // verb the user actually typed
+	args     *commandArgs // already validated against the command's schema
+	prefix   string       // prefix used in this guild
+	started  time.Time
+}
+
+// Runs an invocation and returns what to send back; a nil output means there's nothing to send
+type commandHandler func(inv *invocation) (*commandOutput, error)
+
+// Wraps a handler with extra behaviour, and decides whether to call the next one
+type middleware func(next commandHandler) commandHandler
+
+// A panic recovered from a command, along with where it happened
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprint("panic: ", e.value)
+}
+
+// Middleware registered by plugins with registerMiddleware; runs inside the built-in middleware
+var middlewares []middleware
+
+// Adds a middleware to the chain; middleware registered first runs first
+func registerMiddleware(m middleware) {
+	middlewares = append(middlewares, m)
+}
+
+// Adds a hook which runs before every command; returning an error stops the command and reports it
+func registerBeforeHook(hook func(inv *invocation) error) {
+	registerMiddleware(func(next commandHandler) commandHandler {
+		return func(inv *invocation) (*commandOutput, error) {
+			if err := hook(inv); err != nil {
+				return nil, err
+			}
+			return next(inv)
+		}
+	})
+}
+
+// Adds a hook which runs after every command, with whatever it returned
+func registerAfterHook(hook func(inv *invocation, output *commandOutput, err error)) {
+	registerMiddleware(func(next commandHandler) commandHandler {
+		return func(inv *invocation) (*commandOutput, error) {
+			output, err := next(inv)
+			hook(inv, output, err)
+			return output, err
+		}
+	})
+}
+
+// Builds the full chain around the command itself
+// Order: recovery -> logging/timing -> permissions -> cooldowns -> registered middleware -> command
+func commandPipeline() commandHandler {
+	chain := []middleware{recoverMiddleware, logMiddleware, accessMiddleware, cooldownMiddleware}
+	chain = append(chain, middlewares...)
+
+	handler := callCommand
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+	return handler
+}
+
+// The end of the chain: actually runs the command's function
+func callCommand(inv *invocation) (*commandOutput, error) {
+	inv.session.ChannelTyping(inv.channel.ID)
+
+	output := inv.cmd.function(inv.args, inv.channel, inv.msgEvent, inv.session)
+	if output != nil && output.err != nil {
+		return nil, output.err
+	}
+	return output, nil
+}
+
+// Turns a panic anywhere further down the chain into an error, so one bad command can't take the bot down
+func recoverMiddleware(next commandHandler) commandHandler {
+	return func(inv *invocation) (output *commandOutput, err error) {
+		defer func() {
+			if value := recover(); value != nil {
+				output = nil
+				err = &panicError{value: value, stack: debug.Stack()}
+			}
+		}()
+		return next(inv)
+	}
+}
+
+// Logs each command and how long it took
+func logMiddleware(next commandHandler) commandHandler {
+	return func(inv *invocation) (*commandOutput, error) {
+		DebugPrint("Running command '" + inv.cmd.name + "' for " + inv.msgEvent.Author.Username)
+
+		output, err := next(inv)
+
+		elapsed := time.Since(inv.started).Round(time.Millisecond)
+		if err != nil {
+			fmt.Println("Command '" + inv.cmd.name + "' failed after " + elapsed.String() + ": " + err.Error())
+		} else {
+			DebugPrint("Command '" + inv.cmd.name + "' finished in " + elapsed.String())
+		}
+		return output, err
+	}
+}
+
+// Refuses to run commands the caller isn't allowed to use (see permissions.go)
+func accessMiddleware(next commandHandler) commandHandler {
+	return func(inv *invocation) (*commandOutput, error) {
+		allowed, reason, err := checkAccess(inv.session, inv.cmd, inv.msgEvent.Author.ID, inv.channel)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			DebugPrint("User is not allowed to run this command.")
+			return &commandOutput{response: reason}, nil
+		}
+		return next(inv)
+	}
+}
+
+// Refuses to run commands that are on cooldown (see cooldown.go)
+func cooldownMiddleware(next commandHandler) commandHandler {
+	return func(inv *invocation) (*commandOutput, error) {
+		wait, err := checkCooldowns(inv.session, inv.cmd, inv.msgEvent.Author.ID, inv.channel)
+		if err != nil {
+			// a broken limiter shouldn't stop commands from working
+			fmt.Println(err)
+		} else if wait > 0 {
+			DebugPrint("User is on cooldown.")
+			sendCooldownNotice(inv.session, inv.msgEvent.Author.ID, inv.channel.ID, wait)
+			return nil, nil
+		}
+		return next(inv)
+	}
+}
+
+// Sends the full details of an error to the owner log channel (OWNER_LOG_CHANNEL),
+// and returns a reply telling the user something went wrong, with a short ID they can pass on
+func reportCommandError(inv *invocation, err error) *commandOutput {
+	errorID := fmt.Sprintf("%06x", rand.Intn(0x1000000))
+	output := &commandOutput{response: "Sorry, something went wrong running that command. (error `" + errorID + "`)"}
+
+	fmt.Println("Error " + errorID + ": " + err.Error())
+
+	if cfg.OwnerLogChannel == "" {
+		return output
+	}
+
+	embed := NewEmbed().
+		SetTitle("Error "+errorID).
+		SetDescription("```\n"+err.Error()+"\n```").
+		AddField("Command", inv.cmd.name).
+		AddField("Message", "`"+strings.Replace(inv.msgEvent.Content, "`", "'", -1)+"`").
+		AddField("User", inv.msgEvent.Author.Username+" ("+inv.msgEvent.Author.ID+")").
+		AddField("Channel", "<#"+inv.channel.ID+"> ("+inv.channel.ID+")").
+		SetColor(0xdd2e44).
+		SetFooter(time.Now().UTC().Format(time.RFC1123))
+	if inv.channel.GuildID != "" {
+		embed.AddField("Guild", inv.channel.GuildID)
+	}
+
+	_, sendErr := inv.session.ChannelMessageSendEmbed(cfg.OwnerLogChannel, embed.Truncate().MessageEmbed)
+	if sendErr != nil {
+		fmt.Println("Couldn't send error report to the owner log channel")
+		fmt.Println(sendErr)
+	}
+
+	// stack traces are too long for an embed, so they go in a message of their own
+	if panicErr, ok := err.(*panicError); ok {
+		sendStackTrace(inv.session, errorID, panicErr.stack)
+		fmt.Println(string(panicErr.stack))
+	}
+
+	return output
+}
+
+// Sends a stack trace to the owner log channel, cut down to fit in a message
+func sendStackTrace(session *discordgo.Session, errorID string, stack []byte) {
+	trace := string(stack)
+	if len(trace) > 1900 {
+		trace = trace[:1900]
+	}
+	session.ChannelMessageSend(cfg.OwnerLogChannel, "Stack trace for `"+errorID+"`:\n```\n"+trace+"\n```")
+}
+
+// Stops a panic in an event handler or background loop from taking the whole bot down, and reports it like
+// a command error; use it as `defer recoverAndReport(session, "what was running")`
+// The session may be nil, in which case the panic is only printed
+func recoverAndReport(session *discordgo.Session, where string) {
+	value := recover()
+	if value == nil {
+		return
+	}
+
+	errorID := fmt.Sprintf("%06x", rand.Intn(0x1000000))
+	panicErr := &panicError{value: value, stack: debug.Stack()}
+	fmt.Println("Error " + errorID + " in " + where + ": " + panicErr.Error())
+	fmt.Println(string(panicErr.stack))
+
+	if session == nil || cfg.OwnerLogChannel == "" {
+		return
+	}
+
+	embed := NewEmbed().
+		SetTitle("Error "+errorID).
+		SetDescription("```\n"+panicErr.Error()+"\n```").
+		AddField("While running", where).
+		SetColor(0xdd2e44).
+		SetFooter(time.Now().UTC().Format(time.RFC1123))
+	_, sendErr := session.ChannelMessageSendEmbed(cfg.OwnerLogChannel, embed.Truncate().MessageEmbed)
+	if sendErr != nil {
+		fmt.Println("Couldn't send error report to the owner log channel")
+		fmt.Println(sendErr)
+	}
+	sendStackTrace(session, errorID, panicErr.stack)
+}
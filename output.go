@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A file to upload along with a command's output
+type outputFile struct {
+	name        string    // filename shown in Discord, including the extension
+	contentType string    // MIME type; guessed from the extension if empty
+	reader      io.Reader // file contents; closed after sending if it's an io.Closer
+	spoiler     bool      // uploaded as SPOILER_<name> so Discord blurs it until clicked
+}
+
+// Longest message Discord will accept
+const messageLimit = 2000
+
+// Turns the output files into what discordgo uploads
+func (output *commandOutput) discordFiles() []*discordgo.File {
+	files := []*discordgo.File{}
+	for _, file := range output.files {
+		name := file.name
+		if name == "" {
+			name = "file"
+		}
+		if file.spoiler && !strings.HasPrefix(name, "SPOILER_") {
+			name = "SPOILER_" + name
+		}
+
+		contentType := file.contentType
+		if contentType == "" {
+			contentType = mime.TypeByExtension(filepath.Ext(name))
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		files = append(files, &discordgo.File{Name: name, ContentType: contentType, Reader: file.reader})
+	}
+	return files
+}
+
+// All embeds in the order they should be sent
+func (output *commandOutput) allEmbeds() []*discordgo.MessageEmbed {
+	embeds := []*discordgo.MessageEmbed{}
+	if output.embed != nil {
+		embeds = append(embeds, output.embed)
+	}
+	return append(embeds, output.embeds...)
+}
+
+// Closes any files which need closing once they've been uploaded
+func (output *commandOutput) closeFiles() {
+	for _, file := range output.files {
+		if closer, ok := file.reader.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// Sends a command's output to a channel (or the user's DMs if asked to), returning the messages sent
+// The text, files and first embed go in one message; Discord only allows one embed per message,
+// so any other embeds follow in messages of their own
+func sendOutput(session *discordgo.Session, output *commandOutput, channelID string, userID string) ([]*discordgo.Message, error) {
+	defer output.closeFiles()
+
+	if output.direct {
+		dmChannel, err := session.UserChannelCreate(userID)
+		if err != nil {
+			session.ChannelMessageSend(channelID, "I couldn't DM you; do you have DMs from server members turned off?")
+			return nil, err
+		}
+		if dmChannel.ID != channelID {
+			defer session.ChannelMessageSend(channelID, "Check your DMs!")
+		}
+		channelID = dmChannel.ID
+	}
+
+	embeds := output.allEmbeds()
+	files := output.discordFiles()
+
+	// paginated output shows its first page where the main embed would go
+	if len(output.pages) > 0 {
+		if len(output.pages) > 1 {
+			numberPages(output.pages)
+		}
+		embeds = append([]*discordgo.MessageEmbed{output.pages[0]}, embeds...)
+	}
+
+	first := &discordgo.MessageSend{Content: output.response, Files: files}
+	if len(first.Content) > messageLimit {
+		first.Content = first.Content[:messageLimit]
+	}
+	if len(embeds) > 0 {
+		first.Embed = embeds[0]
+		embeds = embeds[1:]
+	}
+
+	sent := []*discordgo.Message{}
+
+	if first.Content != "" || first.Embed != nil || len(first.Files) > 0 {
+		if len(files) > 0 {
+			DebugPrint("Response contains files, uploading now")
+		}
+		message, err := session.ChannelMessageSendComplex(channelID, first)
+		if err != nil {
+			return sent, err
+		}
+		sent = append(sent, message)
+	}
+
+	for _, embed := range embeds {
+		DebugPrint("Command contains another embed; sending")
+		message, err := session.ChannelMessageSendEmbed(channelID, embed)
+		if err != nil {
+			return sent, err
+		}
+		sent = append(sent, message)
+	}
+
+	if len(output.pages) > 1 && len(sent) > 0 {
+		startPaginator(session, sent[0], userID, output.pages)
+	}
+
+	if len(sent) > 0 {
+		for _, reaction := range output.reactions {
+			err := session.MessageReactionAdd(channelID, sent[0].ID, reaction)
+			if err != nil {
+				fmt.Println("Error adding reaction " + reaction)
+				fmt.Println(err)
+			}
+		}
+	}
+
+	if output.ttl > 0 && len(sent) > 0 {
+		deleteAfter(session, sent, output.ttl)
+	}
+
+	return sent, nil
+}
+
+// Deletes messages once the given time has passed
+func deleteAfter(session *discordgo.Session, messages []*discordgo.Message, ttl time.Duration) {
+	time.AfterFunc(ttl, func() {
+		deleteMessages(session, messages)
+	})
+}
+
+// Replaces an earlier reply with new output, editing the old messages in place where Discord allows it
+// Files can't be added to or removed from a sent message, and an embed can't be taken away,
+// so in those cases the old reply is deleted and the new output sent fresh
+func editOutput(session *discordgo.Session, output *commandOutput, previous []*discordgo.Message, channelID string, userID string) ([]*discordgo.Message, error) {
+	embeds := output.allEmbeds()
+
+	// what each message of the new reply should contain
+	type messageContent struct {
+		content string
+		embed   *discordgo.MessageEmbed
+	}
+	wanted := []messageContent{{content: output.response}}
+	if len(wanted[0].content) > messageLimit {
+		wanted[0].content = wanted[0].content[:messageLimit]
+	}
+	if len(embeds) > 0 {
+		wanted[0].embed = embeds[0]
+		embeds = embeds[1:]
+	}
+	for _, embed := range embeds {
+		wanted = append(wanted, messageContent{embed: embed})
+	}
+
+	editable := !output.direct && len(output.files) == 0 && len(output.pages) == 0 && len(previous) > 0 && (wanted[0].content != "" || wanted[0].embed != nil)
+	for i, message := range previous {
+		if len(message.Attachments) > 0 || message.ChannelID != channelID {
+			editable = false
+		}
+		if i < len(wanted) && len(message.Embeds) > 0 && wanted[i].embed == nil {
+			editable = false
+		}
+	}
+
+	if !editable {
+		DebugPrint("Reply can't be edited in place; sending a new one.")
+		deleteMessages(session, previous)
+		return sendOutput(session, output, channelID, userID)
+	}
+
+	sent := []*discordgo.Message{}
+	for i, want := range wanted {
+		if i < len(previous) {
+			edit := discordgo.NewMessageEdit(channelID, previous[i].ID).SetContent(want.content)
+			if want.embed != nil {
+				edit.SetEmbed(want.embed)
+			}
+			message, err := session.ChannelMessageEditComplex(edit)
+			if err != nil {
+				return sent, err
+			}
+			sent = append(sent, message)
+			continue
+		}
+
+		message, err := session.ChannelMessageSendEmbed(channelID, want.embed)
+		if err != nil {
+			return sent, err
+		}
+		sent = append(sent, message)
+	}
+
+	// the new reply might be shorter than the old one
+	if len(previous) > len(wanted) {
+		deleteMessages(session, previous[len(wanted):])
+	}
+
+	for _, reaction := range output.reactions {
+		err := session.MessageReactionAdd(channelID, sent[0].ID, reaction)
+		if err != nil {
+			fmt.Println("Error adding reaction " + reaction)
+			fmt.Println(err)
+		}
+	}
+
+	if output.ttl > 0 {
+		deleteAfter(session, sent, output.ttl)
+	}
+
+	return sent, nil
+}
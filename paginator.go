@@ -0,0 +1,193 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Reactions used to control paginated output
+const (
+	reactionPrevious = "◀"
+	reactionNext     = "▶"
+	reactionStop     = "⏹"
+)
+
+// How long a paginated message responds to reactions after it was last used
+const paginatorTimeout = 2 * time.Minute
+
+// A message showing one page at a time, flipped with reactions by the user who ran the command
+type paginator struct {
+	sync.Mutex
+	session   *discordgo.Session
+	channelID string
+	messageID string
+	ownerID   string                    // only this user can flip pages
+	pages     []*discordgo.MessageEmbed // every page, already numbered
+	current   int                       // index of the page being shown
+	timer     *time.Timer               // stops the paginator once it's been idle for paginatorTimeout
+	stopped   bool
+}
+
+// Paginators for every message still accepting reactions
+type paginatorRegistry struct {
+	sync.Mutex
+	active map[string]*paginator // message ID -> paginator
+}
+
+var paginators = &paginatorRegistry{active: make(map[string]*paginator)}
+
+// Numbers each page in its footer so users know where they are
+func numberPages(pages []*discordgo.MessageEmbed) {
+	total := strconv.Itoa(len(pages))
+	for i, page := range pages {
+		text := "Page " + strconv.Itoa(i+1) + " of " + total
+
+		// pages made from the same base share a footer, so each gets its own copy
+		footer := discordgo.MessageEmbedFooter{Text: text}
+		if page.Footer != nil {
+			footer = *page.Footer
+			if footer.Text != "" {
+				footer.Text += " • " + text
+			} else {
+				footer.Text = text
+			}
+		}
+		page.Footer = &footer
+	}
+}
+
+// Splits a long list of fields into pages which each look like the base embed
+// This is how output that would otherwise go over Discord's 25 field limit gets shown
+func pagesFromFields(base *discordgo.MessageEmbed, fields []*discordgo.MessageEmbedField, perPage int) []*discordgo.MessageEmbed {
+	if perPage < 1 || perPage > EmbedLimitField {
+		perPage = EmbedLimitField
+	}
+
+	pages := []*discordgo.MessageEmbed{}
+	for start := 0; start < len(fields) || start == 0; start += perPage {
+		end := start + perPage
+		if end > len(fields) {
+			end = len(fields)
+		}
+
+		page := *base
+		page.Fields = fields[start:end]
+		pages = append(pages, &page)
+	}
+	return pages
+}
+
+// Starts listening for reactions on a message showing the first page
+func startPaginator(session *discordgo.Session, message *discordgo.Message, ownerID string, pages []*discordgo.MessageEmbed) {
+	p := &paginator{
+		session:   session,
+		channelID: message.ChannelID,
+		messageID: message.ID,
+		ownerID:   ownerID,
+		pages:     pages,
+		timer: time.AfterFunc(paginatorTimeout, func() {
+			DebugPrint("Paginator on message " + message.ID + " timed out.")
+			paginators.stop(message.ID, true)
+		}),
+	}
+
+	paginators.Lock()
+	paginators.active[message.ID] = p
+	paginators.Unlock()
+
+	for _, reaction := range []string{reactionPrevious, reactionNext, reactionStop} {
+		err := session.MessageReactionAdd(message.ChannelID, message.ID, reaction)
+		if err != nil {
+			DebugPrint("Couldn't add paginator reaction: " + err.Error())
+		}
+	}
+}
+
+// Stops a paginator, optionally clearing its reactions from the message
+func (registry *paginatorRegistry) stop(messageID string, clearReactions bool) {
+	registry.Lock()
+	p, ok := registry.active[messageID]
+	delete(registry.active, messageID)
+	registry.Unlock()
+
+	if !ok {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.stopped {
+		return
+	}
+	p.stopped = true
+	p.timer.Stop()
+
+	if clearReactions {
+		err := p.session.MessageReactionsRemoveAll(p.channelID, p.messageID)
+		if err != nil {
+			DebugPrint("Couldn't clear paginator reactions: " + err.Error())
+		}
+	}
+}
+
+// Called any time a reaction is added; flips pages on paginated messages
+func parseReaction(discordSession *discordgo.Session, reactionEvent *discordgo.MessageReactionAdd) {
+	defer recoverAndReport(discordSession, "the reaction handler")
+
+	paginators.Lock()
+	p, ok := paginators.active[reactionEvent.MessageID]
+	paginators.Unlock()
+
+	if !ok || reactionEvent.UserID == discordSession.State.User.ID {
+		return
+	}
+
+	emoji := reactionEvent.Emoji.Name
+
+	// take the reaction back off so the same button can be pressed again
+	// (this needs Manage Messages; without it users just have to un-react first)
+	if emoji == reactionPrevious || emoji == reactionNext {
+		discordSession.MessageReactionRemove(reactionEvent.ChannelID, reactionEvent.MessageID, emoji, reactionEvent.UserID)
+	}
+
+	if reactionEvent.UserID != p.ownerID {
+		return
+	}
+
+	if emoji == reactionStop {
+		paginators.stop(p.messageID, true)
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.stopped {
+		return
+	}
+
+	switch emoji {
+	case reactionPrevious:
+		if p.current == 0 {
+			return
+		}
+		p.current--
+	case reactionNext:
+		if p.current == len(p.pages)-1 {
+			return
+		}
+		p.current++
+	default:
+		return
+	}
+
+	p.timer.Reset(paginatorTimeout)
+
+	_, err := discordSession.ChannelMessageEditEmbed(p.channelID, p.messageID, p.pages[p.current])
+	if err != nil {
+		DebugPrint("Couldn't change page: " + err.Error())
+	}
+}
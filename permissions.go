@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"strings"
+)
+
+// Does this command check anything that only exists in a guild?
+func (cmd *command) needsGuild() bool {
+	return cmd.permissions != 0 || len(cmd.allowRoles) > 0 || len(cmd.denyRoles) > 0 || cmd.guildOwnerOnly
+}
+
+// Checks whether a user may run a command in a channel
+// Returns a reason to show the user when they may not
+func checkAccess(session *discordgo.Session, cmd *command, userID string, channel *discordgo.Channel) (bool, string, error) {
+
+	// without a database these commands would only fail, so they're hidden and refused
+	if cmd.requiresDatabase && db == nil {
+		return false, "Sorry, but that command needs a database, and I don't have one set up.", nil
+	}
+
+	if cmd.botOwnerOnly && !isBotOwner(userID) {
+		return false, "Sorry, but only my owner can use that command.", nil
+	}
+
+	if !cmd.needsGuild() {
+		return true, "", nil
+	}
+
+	// DMs have no roles or permissions to check
+	if channel.GuildID == "" {
+		return false, "That command can only be used in a server.", nil
+	}
+
+	guild, err := session.State.Guild(channel.GuildID)
+	if err != nil {
+		return false, "", err
+	}
+
+	if cmd.guildOwnerOnly && guild.OwnerID != userID {
+		return false, "Sorry, but only the owner of this server can use that command.", nil
+	}
+
+	// the owner can always do everything else
+	if guild.OwnerID == userID {
+		return true, "", nil
+	}
+
+	if len(cmd.allowRoles) > 0 || len(cmd.denyRoles) > 0 {
+		member, err := GetMember(session, channel.GuildID, userID)
+		if err != nil {
+			return false, "", err
+		}
+
+		if len(cmd.denyRoles) > 0 && hasAnyRole(guild, member, cmd.denyRoles) {
+			return false, "Sorry, but your roles don't allow you to use that command.", nil
+		}
+		if len(cmd.allowRoles) > 0 && !hasAnyRole(guild, member, cmd.allowRoles) {
+			return false, "Sorry, but you need one of these roles to use that command: " + strings.Join(cmd.allowRoles, ", "), nil
+		}
+	}
+
+	if cmd.permissions != 0 {
+		permissions, err := UserPermissions(session, userID, channel.ID)
+		if err != nil {
+			return false, "", err
+		}
+		if permissions&cmd.permissions != cmd.permissions {
+			return false, "Sorry, but you need the " + permissionNames(cmd.permissions) + " permission to use that command here.", nil
+		}
+	}
+
+	return true, "", nil
+}
+
+// Same as checkAccess, but just says yes or no; used to hide commands from help
+func canRun(session *discordgo.Session, cmd *command, userID string, channel *discordgo.Channel) bool {
+	allowed, _, err := checkAccess(session, cmd, userID, channel)
+	if err != nil {
+		DebugPrint("Error checking access to " + cmd.name + ": " + err.Error())
+		return false
+	}
+	return allowed
+}
+
+// For commands anyone can use to look at something, but only some can use to change it
+// Returns nil if the user has the permission in the channel, or the reply to send if they don't
+func requirePermission(session *discordgo.Session, msgEvent *discordgo.MessageCreate, channel *discordgo.Channel, permission int, what string) *commandOutput {
+	permissions, err := UserPermissions(session, msgEvent.Author.ID, channel.ID)
+	if err != nil {
+		fmt.Println(err)
+		return &commandOutput{response: "Error checking your permissions"}
+	}
+	if permissions&permission != permission {
+		return &commandOutput{response: "Sorry, but you need the " + permissionNames(permission) + " permission to " + what + "."}
+	}
+	return nil
+}
+
+// Gets a user's permissions in a channel, including role permissions and channel overwrites
+func UserPermissions(session *discordgo.Session, userID string, channelID string) (int, error) {
+	permissions, err := session.State.UserChannelPermissions(userID, channelID)
+	if err == nil {
+		return permissions, nil
+	}
+
+	// the member might not be cached yet; ask Discord
+	DebugPrint("Permissions not in state, asking Discord: " + err.Error())
+	return session.UserChannelPermissions(userID, channelID)
+}
+
+// Gets a guild member from the state cache, asking Discord directly if it isn't cached
+func GetMember(session *discordgo.Session, guildID string, userID string) (*discordgo.Member, error) {
+	member, err := session.State.Member(guildID, userID)
+	if err == nil {
+		return member, nil
+	}
+	return session.GuildMember(guildID, userID)
+}
+
+// Checks a member's roles against a list of role IDs or names
+func hasAnyRole(guild *discordgo.Guild, member *discordgo.Member, roles []string) bool {
+	for _, role := range guild.Roles {
+		held := false
+		for _, roleID := range member.Roles {
+			if roleID == role.ID {
+				held = true
+				break
+			}
+		}
+		if !held {
+			continue
+		}
+
+		for _, wanted := range roles {
+			if wanted == role.ID || strings.EqualFold(wanted, role.Name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Is this user one of the bot's owners?
+func isBotOwner(userID string) bool {
+	for _, ownerID := range cfg.BotOwners {
+		if ownerID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Falls back to the owner of the bot's Discord application when BOT_OWNERS isn't set
+func loadBotOwners(session *discordgo.Session) {
+	if len(cfg.BotOwners) > 0 {
+		return
+	}
+
+	app, err := session.Application("@me")
+	if err != nil {
+		fmt.Println("Couldn't look up the bot's owner; owner-only commands will be unavailable.")
+		fmt.Println(err)
+		return
+	}
+	if app.Owner != nil {
+		cfg.BotOwners = []string{app.Owner.ID}
+		DebugPrint("Bot owner: " + app.Owner.Username)
+	}
+}
+
+// Human-readable names for the permissions commands are likely to need
+var permissionNameList = []struct {
+	permission int
+	name       string
+}{
+	{discordgo.PermissionAdministrator, "Administrator"},
+	{discordgo.PermissionManageServer, "Manage Server"},
+	{discordgo.PermissionManageChannels, "Manage Channels"},
+	{discordgo.PermissionManageRoles, "Manage Roles"},
+	{discordgo.PermissionManageMessages, "Manage Messages"},
+	{discordgo.PermissionKickMembers, "Kick Members"},
+	{discordgo.PermissionBanMembers, "Ban Members"},
+	{discordgo.PermissionAttachFiles, "Attach Files"},
+	{discordgo.PermissionEmbedLinks, "Embed Links"},
+	{discordgo.PermissionVoiceConnect, "Connect"},
+}
+
+// Lists the names of the permissions in a bitmask
+func permissionNames(permissions int) string {
+	names := []string{}
+	for _, entry := range permissionNameList {
+		if permissions&entry.permission != 0 {
+			names = append(names, entry.name)
+		}
+	}
+	if len(names) == 0 {
+		return "required"
+	}
+	return strings.Join(names, " + ")
+}
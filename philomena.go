@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// An image as returned by Philomena's JSON API, which Twibooru, Manebooru and Ponybooru all run
+type philomenaImage struct {
+	ID              int               `json:"id"`
+	Tags            []string          `json:"tags"`
+	TagIDs          []int             `json:"tag_ids"`
+	Score           int               `json:"score"`
+	SourceURL       string            `json:"source_url"`
+	ViewURL         string            `json:"view_url"`
+	MimeType        string            `json:"mime_type"`
+	Format          string            `json:"format"`
+	Representations map[string]string `json:"representations"`
+}
+
+// Philomena search results; Twibooru calls images "posts"
+type philomenaResults struct {
+	Images []philomenaImage `json:"images"`
+	Posts  []philomenaImage `json:"posts"`
+	Total  int              `json:"total"`
+}
+
+// A site running Philomena, searched with the same syntax and rating tags as Derpibooru
+type philomenaBoard struct {
+	name       string       // shown to users
+	baseURL    string       // site to query, without a trailing slash
+	searchPath string       // path of the image search endpoint
+	pagePath   string       // path before an image's ID in links to it
+	httpClient *http.Client // used for every request
+}
+
+func newPhilomenaBoard(name string, baseURL string, searchPath string, pagePath string) *philomenaBoard {
+	return &philomenaBoard{
+		name:       name,
+		baseURL:    baseURL,
+		searchPath: searchPath,
+		pagePath:   pagePath,
+		httpClient: &http.Client{Timeout: cfg.DerpiTimeout},
+	}
+}
+
+func (board *philomenaBoard) Name() string {
+	return board.name
+}
+
+// Searches with the policy added just as for Derpibooru; Derpibooru filter IDs mean nothing here, so they're left out
+func (board *philomenaBoard) Search(ctx context.Context, query string, policy effectivePolicy) (BoardResults, error) {
+	restricted, err := policy.query(query)
+	if err != nil {
+		return BoardResults{}, err
+	}
+
+	params := url.Values{}
+	params.Set("q", restricted)
+	params.Set("per_page", strconv.Itoa(boardPerPage))
+
+	results := philomenaResults{}
+	err = fetchJSON(ctx, board.httpClient, board.name, board.baseURL+board.searchPath+"?"+params.Encode(), &results)
+	if err != nil {
+		return BoardResults{}, err
+	}
+
+	images := []BoardImage{}
+	for _, image := range append(results.Images, results.Posts...) {
+		images = append(images, board.convert(image))
+	}
+	return BoardResults{Images: images, Total: results.Total}, nil
+}
+
+// Converts a Philomena image to the common model; ratings are ordinary tags, just like on Derpibooru
+func (board *philomenaBoard) convert(image philomenaImage) BoardImage {
+	ratings := []string{}
+	artists := []string{}
+	for _, tag := range image.Tags {
+		if containsString(derpiRatingTags, tag) {
+			ratings = append(ratings, tag)
+		}
+		if strings.HasPrefix(tag, "artist:") {
+			artists = append(artists, strings.TrimPrefix(tag, "artist:"))
+		}
+	}
+
+	isVideo := image.MimeType == "video/webm" || image.Format == "webm"
+	imageURL := firstNonEmpty(image.Representations["large"], image.Representations["full"], image.ViewURL)
+	if isVideo {
+		imageURL = firstNonEmpty(image.ViewURL, image.Representations["full"])
+	}
+
+	return BoardImage{
+		ID:        strconv.Itoa(image.ID),
+		Site:      board.name,
+		PageURL:   board.baseURL + board.pagePath + strconv.Itoa(image.ID),
+		ImageURL:  absoluteURL(imageURL),
+		IsVideo:   isVideo,
+		Ratings:   ratings,
+		Artists:   artists,
+		Tags:      image.Tags,
+		TagIDs:    image.TagIDs,
+		Score:     image.Score,
+		SourceURL: image.SourceURL,
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"strconv"
+	"strings"
+)
+
+// Ratings which can be allowed in channels that aren't marked NSFW
+var sfwRatings = []string{"safe", "suggestive"}
+
+// What image searches may show, set per guild and optionally overridden per channel
+// Empty fields fall through: channel, then guild, then the defaults for the channel type
+type ratingPolicy struct {
+	Ratings       []string `json:"ratings,omitempty"`       // rating tags results may have (see derpiRatingTags)
+	ExcludedTags  []string `json:"excludedTags,omitempty"`  // tag names, or numeric tag IDs, results may never have
+	FilterID      int      `json:"filterID,omitempty"`      // Derpibooru filter used for every search, instead of the caller's choice
+	AllowExplicit *bool    `json:"allowExplicit,omitempty"` // whether NSFW channels may show explicit images; nil means yes
+}
+
+// The policy that actually applies to one channel, with everything filled in
+type effectivePolicy struct {
+	ratings      []string
+	excludedTags []string
+	filterID     int
+}
+
+// Works out the policy for a channel from its guild's settings
+func channelPolicy(channel *discordgo.Channel) effectivePolicy {
+	guild := settings.guild(channel.GuildID)
+	layers := []*ratingPolicy{guild.Policy, guild.ChannelPolicies[channel.ID]}
+
+	policy := effectivePolicy{ratings: sfwRatings[:1]}
+	if channel.NSFW {
+		policy.ratings = derpiRatingTags
+	}
+	allowExplicit := true
+
+	// later layers win; excluded tags add up, so a channel can't undo the guild's exclusions
+	for _, layer := range layers {
+		if layer == nil {
+			continue
+		}
+		if len(layer.Ratings) > 0 {
+			policy.ratings = layer.Ratings
+		}
+		if layer.FilterID > 0 {
+			policy.filterID = layer.FilterID
+		}
+		if layer.AllowExplicit != nil {
+			allowExplicit = *layer.AllowExplicit
+		}
+		policy.excludedTags = append(policy.excludedTags, layer.ExcludedTags...)
+	}
+
+	// whatever the settings say, SFW channels only get SFW ratings and explicit needs an NSFW channel
+	ratings := []string{}
+	for _, rating := range policy.ratings {
+		if !channel.NSFW && !containsString(sfwRatings, rating) {
+			continue
+		}
+		if rating == "explicit" && !allowExplicit {
+			continue
+		}
+		ratings = append(ratings, rating)
+	}
+	if len(ratings) == 0 {
+		ratings = sfwRatings[:1]
+	}
+	policy.ratings = ratings
+
+	return policy
+}
+
+// Adds the policy's restrictions to a search query, as `(<query>), (<ratings>), -<excluded>...`
+// The user's query is parsed first (see query.go), so it can't escape the restrictions with an OR
+func (policy effectivePolicy) query(query string) (string, error) {
+	userQuery, err := parseQuery(query)
+	if err != nil {
+		return "", err
+	}
+
+	required := []queryNode{}
+	if len(policy.ratings) < len(derpiRatingTags) {
+		ratings := []queryNode{}
+		for _, rating := range policy.ratings {
+			ratings = append(ratings, &queryTerm{Text: rating})
+		}
+		if len(ratings) == 1 {
+			required = append(required, ratings[0])
+		} else {
+			required = append(required, &queryOr{Children: ratings})
+		}
+	}
+	for _, tag := range policy.excludedTags {
+		// tag IDs can only be checked on our side
+		if _, err := strconv.Atoi(tag); err != nil {
+			required = append(required, &queryNot{Child: &queryTerm{Text: tag}})
+		}
+	}
+
+	if len(required) == 0 {
+		return userQuery.String(), nil
+	}
+	return restrictQuery(userQuery, required...).String(), nil
+}
+
+// Filter to search with: the policy's if it sets one, otherwise the caller's
+func (policy effectivePolicy) filter(requested int) int {
+	if policy.filterID > 0 {
+		return policy.filterID
+	}
+	return requested
+}
+
+// Checks an image against the policy, giving the reason if it isn't allowed
+// Derpibooru should never return a forbidden image for a policy-restricted query, but this makes sure
+func (policy effectivePolicy) allows(image DerpiImage) (bool, string) {
+	ratings := image.Ratings()
+	if len(ratings) == 0 {
+		return false, "it has no rating"
+	}
+	for _, rating := range ratings {
+		if !containsString(policy.ratings, rating) {
+			return false, "it's rated " + rating
+		}
+	}
+
+	tags := image.TagList()
+	for _, excluded := range policy.excludedTags {
+		if id, err := strconv.Atoi(excluded); err == nil {
+			for _, tagID := range image.TagIds {
+				if tagID == id {
+					return false, "it has an excluded tag"
+				}
+			}
+			continue
+		}
+		if containsString(tags, excluded) {
+			return false, "it's tagged " + excluded
+		}
+	}
+
+	return true, ""
+}
+
+// Keeps only the images the policy allows
+func (policy effectivePolicy) filterImages(images []DerpiImage) []DerpiImage {
+	allowed := []DerpiImage{}
+	for _, image := range images {
+		if ok, _ := policy.allows(image); ok {
+			allowed = append(allowed, image)
+		}
+	}
+	return allowed
+}
+
+// Reports whether a list contains a string, ignoring case
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits a comma-separated list typed by a user, dropping empty items
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Describes a policy layer for the policy command
+func (layer *ratingPolicy) describe() string {
+	if layer == nil {
+		return "Nothing set"
+	}
+
+	lines := []string{}
+	if len(layer.Ratings) > 0 {
+		lines = append(lines, "Ratings: "+strings.Join(layer.Ratings, ", "))
+	}
+	if len(layer.ExcludedTags) > 0 {
+		lines = append(lines, "Excluded: "+strings.Join(layer.ExcludedTags, ", "))
+	}
+	if layer.FilterID > 0 {
+		lines = append(lines, "Filter: "+strconv.Itoa(layer.FilterID))
+	}
+	if layer.AllowExplicit != nil {
+		lines = append(lines, "Explicit in NSFW channels: "+strconv.FormatBool(*layer.AllowExplicit))
+	}
+	if len(lines) == 0 {
+		return "Nothing set"
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Shows the policy for a channel and where it comes from
+func policyOutput(channel *discordgo.Channel) *commandOutput {
+	guild := settings.guild(channel.GuildID)
+	policy := channelPolicy(channel)
+
+	excluded := "none"
+	if len(policy.excludedTags) > 0 {
+		excluded = strings.Join(policy.excludedTags, ", ")
+	}
+	filter := "caller's choice"
+	if policy.filterID > 0 {
+		filter = strconv.Itoa(policy.filterID)
+	}
+	channelType := "SFW"
+	if channel.NSFW {
+		channelType = "NSFW"
+	}
+
+	embed := NewEmbed().
+		SetTitle("Image policy for #"+channel.Name).
+		SetDescription("This is a "+channelType+" channel.").
+		SetColor(derpiEmbedColor).
+		AddField("Allowed ratings", strings.Join(policy.ratings, ", ")).
+		AddField("Excluded tags", excluded).
+		AddField("Filter", filter).
+		AddField("Server settings", guild.Policy.describe()).
+		AddField("Channel settings", guild.ChannelPolicies[channel.ID].describe())
+	return &commandOutput{embed: embed.Truncate().MessageEmbed}
+}
+
+// Changes one setting of a guild's or channel's policy
+func updatePolicy(channel *discordgo.Channel, forChannel bool, setting string, value string) (string, error) {
+	change := func(layer *ratingPolicy) error {
+		switch setting {
+		case "ratings":
+			if value == "default" {
+				layer.Ratings = nil
+				break
+			}
+			ratings := splitList(value)
+			for _, rating := range ratings {
+				if !containsString(derpiRatingTags, rating) {
+					return fmt.Errorf("`%s` isn't a rating. Ratings are: %s.", rating, strings.Join(derpiRatingTags, ", "))
+				}
+			}
+			layer.Ratings = ratings
+		case "exclude":
+			if value == "none" {
+				layer.ExcludedTags = nil
+				break
+			}
+			// adds to the list, so excluding one tag can't quietly allow the others again
+			excluded := append([]string{}, layer.ExcludedTags...)
+			for _, tag := range splitList(value) {
+				if !containsString(excluded, tag) {
+					excluded = append(excluded, tag)
+				}
+			}
+			layer.ExcludedTags = excluded
+		case "include":
+			kept := []string{}
+			for _, tag := range layer.ExcludedTags {
+				if !containsString(splitList(value), tag) {
+					kept = append(kept, tag)
+				}
+			}
+			layer.ExcludedTags = kept
+			if len(kept) == 0 {
+				layer.ExcludedTags = nil
+			}
+		case "filter":
+			if value == "none" {
+				layer.FilterID = 0
+				break
+			}
+			id, err := strconv.Atoi(value)
+			if err != nil || id < 1 {
+				return fmt.Errorf("The filter should be a Derpibooru filter ID, or `none`.")
+			}
+			layer.FilterID = id
+		case "explicit":
+			switch value {
+			case "on", "yes", "true":
+				allow := true
+				layer.AllowExplicit = &allow
+			case "off", "no", "false":
+				allow := false
+				layer.AllowExplicit = &allow
+			case "default":
+				layer.AllowExplicit = nil
+			default:
+				return fmt.Errorf("Use `on`, `off` or `default`.")
+			}
+		case "reset":
+			*layer = ratingPolicy{}
+		}
+		return nil
+	}
+
+	var changeErr error
+	var excluded []string
+	err := settings.update(channel.GuildID, func(guild *guildSettings) {
+		layer := guild.Policy
+		if forChannel {
+			layer = guild.ChannelPolicies[channel.ID]
+		}
+		if layer == nil {
+			layer = &ratingPolicy{}
+		}
+
+		// work on a copy so a bad value doesn't change anything
+		updated := *layer
+		changeErr = change(&updated)
+		if changeErr != nil {
+			return
+		}
+		excluded = updated.ExcludedTags
+
+		// policies are read without the settings lock, so they're replaced rather than changed in place
+		if forChannel {
+			policies := make(map[string]*ratingPolicy)
+			for id, policy := range guild.ChannelPolicies {
+				policies[id] = policy
+			}
+			policies[channel.ID] = &updated
+			guild.ChannelPolicies = policies
+		} else {
+			guild.Policy = &updated
+		}
+	})
+	if changeErr != nil {
+		return "", changeErr
+	}
+	if err != nil {
+		fmt.Println(err)
+		return "", fmt.Errorf("Error saving settings")
+	}
+
+	scope := "this server"
+	if forChannel {
+		scope = "#" + channel.Name
+	}
+	response := "Done! Updated the image policy for " + scope + "."
+	if setting == "exclude" || setting == "include" {
+		if len(excluded) == 0 {
+			response += " No tags are excluded there now."
+		} else {
+			response += " Excluded tags there are now: " + strings.Join(excluded, ", ")
+		}
+	}
+	return response, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Swaps in empty settings saved to a temporary directory, returning a function which puts the old ones back
+func useTestSettings(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "sunbot-settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := settings
+	settings, err = loadSettings(filepath.Join(dir, "settings.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		settings = saved
+		os.RemoveAll(dir)
+	}
+}
+
+func TestChannelPolicy(t *testing.T) {
+	defer useTestSettings(t)()
+
+	no := false
+	tests := []struct {
+		name     string
+		guild    *ratingPolicy
+		channel  *ratingPolicy
+		nsfw     bool
+		ratings  string
+		excluded string
+		filter   int
+	}{
+		{"defaults in a SFW channel", nil, nil, false, "safe", "", 0},
+		{"defaults in a NSFW channel", nil, nil, true, strings.Join(derpiRatingTags, ","), "", 0},
+		{"guild ratings limited in a SFW channel", &ratingPolicy{Ratings: []string{"safe", "suggestive", "explicit"}}, nil, false, "safe,suggestive", "", 0},
+		{"only NSFW ratings fall back to safe", &ratingPolicy{Ratings: []string{"explicit"}}, nil, false, "safe", "", 0},
+		{"channel ratings win", &ratingPolicy{Ratings: []string{"safe", "explicit"}}, &ratingPolicy{Ratings: []string{"questionable"}}, true, "questionable", "", 0},
+		{"explicit turned off", &ratingPolicy{AllowExplicit: &no}, nil, true, "safe,suggestive,questionable,semi-grimdark,grimdark,grotesque", "", 0},
+		{"channel filter wins", &ratingPolicy{FilterID: 100}, &ratingPolicy{FilterID: 200}, false, "safe", "", 200},
+		{"guild filter kept", &ratingPolicy{FilterID: 100}, &ratingPolicy{}, false, "safe", "", 100},
+		{"excluded tags add up", &ratingPolicy{ExcludedTags: []string{"gore"}}, &ratingPolicy{ExcludedTags: []string{"42", "spoiler"}}, false, "safe", "gore,42,spoiler", 0},
+		{"channel can't undo exclusions", &ratingPolicy{ExcludedTags: []string{"gore"}}, &ratingPolicy{ExcludedTags: []string{}}, true, strings.Join(derpiRatingTags, ","), "gore", 0},
+	}
+
+	for _, test := range tests {
+		settings.Guilds["1"] = &guildSettings{
+			Policy:          test.guild,
+			ChannelPolicies: map[string]*ratingPolicy{"10": test.channel},
+		}
+		policy := channelPolicy(&discordgo.Channel{ID: "10", GuildID: "1", NSFW: test.nsfw})
+
+		if ratings := strings.Join(policy.ratings, ","); ratings != test.ratings {
+			t.Errorf("%s: ratings = %s, want %s", test.name, ratings, test.ratings)
+		}
+		if excluded := strings.Join(policy.excludedTags, ","); excluded != test.excluded {
+			t.Errorf("%s: excluded = %s, want %s", test.name, excluded, test.excluded)
+		}
+		if policy.filterID != test.filter {
+			t.Errorf("%s: filter = %d, want %d", test.name, policy.filterID, test.filter)
+		}
+	}
+}
+
+func TestUpdatePolicy(t *testing.T) {
+	defer useTestSettings(t)()
+
+	channel := &discordgo.Channel{ID: "10", GuildID: "1", Name: "art"}
+	steps := []struct {
+		forChannel bool
+		setting    string
+		value      string
+		ok         bool
+		excluded   string // the channel's excluded tags afterwards, guild's first
+	}{
+		{false, "exclude", "gore, Blood", true, "gore,blood"},
+		{false, "exclude", "gore, fire", true, "gore,blood,fire"},
+		{false, "include", "blood", true, "gore,fire"},
+		{true, "exclude", "spoiler", true, "gore,fire,spoiler"},
+		{true, "ratings", "safe, bogus", false, "gore,fire,spoiler"},
+		{true, "include", "gore", true, "gore,fire,spoiler"},
+		{true, "reset", "", true, "gore,fire"},
+		{false, "include", "gore, fire", true, ""},
+		{false, "exclude", "gore", true, "gore"},
+		{false, "exclude", "none", true, ""},
+	}
+
+	for i, step := range steps {
+		_, err := updatePolicy(channel, step.forChannel, step.setting, step.value)
+		if step.ok && err != nil {
+			t.Fatalf("step %d: %s %s failed: %v", i, step.setting, step.value, err)
+		}
+		if !step.ok && err == nil {
+			t.Errorf("step %d: %s %s succeeded; want an error", i, step.setting, step.value)
+		}
+		if excluded := strings.Join(channelPolicy(channel).excludedTags, ","); excluded != step.excluded {
+			t.Errorf("step %d: after %s %s excluded = %s, want %s", i, step.setting, step.value, excluded, step.excluded)
+		}
+	}
+
+	// the changes were saved
+	saved, err := loadSettings(settings.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.Guilds["1"], settings.Guilds["1"]) {
+		t.Errorf("saved settings = %+v, want %+v", saved.Guilds["1"], settings.Guilds["1"])
+	}
+}
+
+// Images are checked again after searching, in case Derpibooru returns something the query should have ruled out
+func TestPolicyAllows(t *testing.T) {
+	policy := effectivePolicy{ratings: []string{"safe", "suggestive"}, excludedTags: []string{"gore", "42"}}
+	tests := []struct {
+		image   DerpiImage
+		allowed bool
+	}{
+		{DerpiImage{ID: 1, Tags: "safe, pony"}, true},
+		{DerpiImage{ID: 2, Tags: "suggestive, pony", TagIds: []int{7}}, true},
+		{DerpiImage{ID: 3, Tags: "explicit, pony"}, false},
+		{DerpiImage{ID: 4, Tags: "safe, grimdark"}, false},
+		{DerpiImage{ID: 5, Tags: "pony"}, false},
+		{DerpiImage{ID: 6, Tags: "safe, gore"}, false},
+		{DerpiImage{ID: 7, Tags: "safe, pony", TagIds: []int{7, 42}}, false},
+	}
+
+	images := []DerpiImage{}
+	want := []int{}
+	for _, test := range tests {
+		if allowed, reason := policy.allows(test.image); allowed != test.allowed {
+			t.Errorf("allows(%q) = %v (%s), want %v", test.image.Tags, allowed, reason, test.allowed)
+		}
+		images = append(images, test.image)
+		if test.allowed {
+			want = append(want, test.image.ID)
+		}
+	}
+
+	got := []int{}
+	for _, image := range policy.filterImages(images) {
+		got = append(got, image.ID)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("filterImages kept %v, want %v", got, want)
+	}
+}
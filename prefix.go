@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Longest prefix an admin is allowed to set
+const maxPrefixLength = 10
+
+// Returns the command prefix used in a guild, falling back to COMMAND_PREFIX
+// DMs have no guild ID, so they always use the default
+func guildPrefix(guildID string) string {
+	if guildID != "" {
+		if prefix := settings.guild(guildID).Prefix; prefix != "" {
+			return prefix
+		}
+	}
+	return cfg.DefaultPrefix
+}
+
+// Checks whether a message is addressed to the bot, either with the guild's prefix or by mentioning it
+// Returns the text following the prefix or mention
+func stripPrefix(msg string, prefix string, botID string) (string, bool) {
+
+	// "@Sunbot help" works everywhere, regardless of prefix
+	for _, mention := range []string{"<@" + botID + ">", "<@!" + botID + ">"} {
+		if strings.HasPrefix(msg, mention) {
+			return strings.TrimLeftFunc(msg[len(mention):], unicode.IsSpace), true
+		}
+	}
+
+	if prefix == "" || !strings.HasPrefix(msg, prefix) {
+		return "", false
+	}
+	rest := msg[len(prefix):]
+
+	// a repeated prefix (like "...") is probably not intended to be a command
+	if strings.HasPrefix(rest, prefix) {
+		return "", false
+	}
+
+	return rest, true
+}
+
+// Checks that a prefix is something users can actually type
+func validatePrefix(prefix string) error {
+	if prefix == "" {
+		return errors.New("The prefix can't be empty.")
+	}
+	if len([]rune(prefix)) > maxPrefixLength {
+		return errors.New("That prefix is too long; keep it to " + strconv.Itoa(maxPrefixLength) + " characters or fewer.")
+	}
+	if strings.IndexFunc(prefix, unicode.IsSpace) >= 0 {
+		return errors.New("The prefix can't contain spaces.")
+	}
+	if strings.HasPrefix(prefix, "<@") {
+		return errors.New("The prefix can't be a mention; mentioning me already works everywhere.")
+	}
+	return nil
+}
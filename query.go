@@ -0,0 +1,584 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Limits on user queries, so a huge or deeply nested one can't tie up the parser or the site
+const (
+	maxQueryLength = 1000
+	maxQueryDepth  = 25
+	maxQueryTerms  = 100
+)
+
+// Fields which take numbers in ranges, like score.gt:100
+var numericQueryFields = map[string]bool{
+	"id": true, "score": true, "upvotes": true, "downvotes": true, "faves": true,
+	"comment_count": true, "tag_count": true, "width": true, "height": true,
+	"aspect_ratio": true, "wilson_score": true, "duration": true,
+}
+
+// Fields which take dates in ranges, like created_at.gte:3 days ago
+var dateQueryFields = map[string]bool{
+	"created_at": true, "updated_at": true, "first_seen_at": true,
+}
+
+// A term with a range, like score.gte:100
+var rangeTerm = regexp.MustCompile(`^([a-z_]+)\.(gt|gte|lt|lte):(.*)$`)
+
+// Boost (^2) and fuzz (~0.8) suffixes; anything else after ^ or ~ is part of the tag, like ^^
+var boostSuffix = regexp.MustCompile(`\^(-?[0-9]+(?:\.[0-9]+)?)$`)
+var fuzzSuffix = regexp.MustCompile(`~([0-9]+(?:\.[0-9]+)?)$`)
+
+// One piece of a parsed search query; String gives it back in a normalized form which parses to the same tree
+type queryNode interface {
+	String() string
+}
+
+// A single search term, like `twilight sparkle`, `artist:foo` or `score.gt:100^2`
+type queryTerm struct {
+	Text  string // the tag, or the value for ranges
+	Field string // field for ranges, like "score"
+	Op    string // range comparison: gt, gte, lt or lte
+	Boost string // relevance boost, if given
+	Fuzz  string // fuzzy matching distance, if given
+}
+
+// Matches when every child does
+type queryAnd struct {
+	Children []queryNode
+}
+
+// Matches when any child does
+type queryOr struct {
+	Children []queryNode
+}
+
+// Matches when the child doesn't
+type queryNot struct {
+	Child queryNode
+}
+
+func (term *queryTerm) String() string {
+	text := term.Text
+	if term.Op != "" {
+		text = term.Field + "." + term.Op + ":" + term.Text
+	}
+	if termNeedsQuotes(text) {
+		text = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text) + `"`
+	}
+	if term.Fuzz != "" {
+		text += "~" + term.Fuzz
+	}
+	if term.Boost != "" {
+		text += "^" + term.Boost
+	}
+	return text
+}
+
+func (node *queryAnd) String() string {
+	parts := []string{}
+	for _, child := range node.Children {
+		if _, isOr := child.(*queryOr); isOr {
+			parts = append(parts, "("+child.String()+")")
+		} else {
+			parts = append(parts, child.String())
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (node *queryOr) String() string {
+	parts := []string{}
+	for _, child := range node.Children {
+		parts = append(parts, child.String())
+	}
+	return strings.Join(parts, " || ")
+}
+
+func (node *queryNot) String() string {
+	if _, isTerm := node.Child.(*queryTerm); isTerm {
+		return "-" + node.Child.String()
+	}
+	return "-(" + node.Child.String() + ")"
+}
+
+// Reports whether a term has to be quoted to be read back as the same term
+func termNeedsQuotes(text string) bool {
+	if text == "" || text != strings.TrimSpace(text) {
+		return true
+	}
+	if strings.ContainsAny(text, `,()"\^~`) || strings.Contains(text, "&&") || strings.Contains(text, "||") {
+		return true
+	}
+	if text[0] == '-' || text[0] == '!' || strings.Contains(text, "  ") {
+		return true
+	}
+	// unquoted terms have their spacing tidied up, so anything but single spaces needs quotes to survive
+	if strings.IndexFunc(text, func(r rune) bool { return unicode.IsSpace(r) && r != ' ' }) >= 0 {
+		return true
+	}
+	for _, word := range strings.Fields(text) {
+		if word == "AND" || word == "OR" || word == "NOT" {
+			return true
+		}
+	}
+	return false
+}
+
+// A mistake in a query, with the byte offset it was found at
+type querySyntaxError struct {
+	message  string
+	position int
+}
+
+func (err *querySyntaxError) Error() string {
+	return err.message
+}
+
+// Shows the query with a marker under the mistake, for replying to the user
+func (err *querySyntaxError) describe(query string) string {
+	position := err.position
+	if position > len(query) {
+		position = len(query)
+	}
+	return err.message + "\n```\n" + query + "\n" + strings.Repeat(" ", len([]rune(query[:position]))) + "^\n```"
+}
+
+// Explains a problem with a query to the user, pointing at the mistake where possible
+func describeQueryError(err error, query string) string {
+	if syntaxErr, ok := err.(*querySyntaxError); ok {
+		return "There's a problem with your search: " + syntaxErr.describe(query)
+	}
+	return "There's a problem with your search: " + err.Error()
+}
+
+// Kinds of token the lexer produces
+type queryTokenKind int
+
+const (
+	tokenTerm queryTokenKind = iota
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenOpen
+	tokenClose
+	tokenEnd
+)
+
+type queryToken struct {
+	kind     queryTokenKind
+	text     string // term text; quotes and their escapes are removed, but escapes in unquoted terms are kept
+	quoted   bool   // the term was in quotes, so its text is taken literally
+	suffix   string // boost or fuzz after a quoted term, like ^2
+	position int    // byte offset in the query
+}
+
+// Reports whether a byte is whitespace between tokens; the query is read byte by byte, so only ASCII counts
+func isQuerySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// Reports whether the query continues with a keyword operator at i, like "AND " or " OR "
+func keywordAt(query string, i int, keyword string) bool {
+	if !strings.HasPrefix(query[i:], keyword) {
+		return false
+	}
+	if i > 0 && !isQuerySpace(query[i-1]) && query[i-1] != '(' && query[i-1] != ')' {
+		return false
+	}
+	end := i + len(keyword)
+	return end < len(query) && (isQuerySpace(query[end]) || query[end] == '(')
+}
+
+// Splits a query into tokens
+// Terms can contain spaces (`twilight sparkle`), so a term runs until an operator or bracket ends it
+func lexQuery(query string) ([]queryToken, error) {
+	tokens := []queryToken{}
+	i := 0
+
+	for {
+		for i < len(query) && isQuerySpace(query[i]) {
+			i++
+		}
+		if i >= len(query) {
+			tokens = append(tokens, queryToken{kind: tokenEnd, position: i})
+			return tokens, nil
+		}
+
+		start := i
+		switch {
+		case query[i] == '(':
+			tokens = append(tokens, queryToken{kind: tokenOpen, position: start})
+			i++
+		case query[i] == ')':
+			tokens = append(tokens, queryToken{kind: tokenClose, position: start})
+			i++
+		case query[i] == ',':
+			tokens = append(tokens, queryToken{kind: tokenAnd, position: start})
+			i++
+		case strings.HasPrefix(query[i:], "&&"):
+			tokens = append(tokens, queryToken{kind: tokenAnd, position: start})
+			i += 2
+		case strings.HasPrefix(query[i:], "||"):
+			tokens = append(tokens, queryToken{kind: tokenOr, position: start})
+			i += 2
+		case query[i] == '-' || query[i] == '!':
+			tokens = append(tokens, queryToken{kind: tokenNot, position: start})
+			i++
+		case keywordAt(query, i, "AND"):
+			tokens = append(tokens, queryToken{kind: tokenAnd, position: start})
+			i += 3
+		case keywordAt(query, i, "OR"):
+			tokens = append(tokens, queryToken{kind: tokenOr, position: start})
+			i += 2
+		case keywordAt(query, i, "NOT"):
+			tokens = append(tokens, queryToken{kind: tokenNot, position: start})
+			i += 3
+		case query[i] == '"':
+			text, end, err := lexQuoted(query, i)
+			if err != nil {
+				return nil, err
+			}
+			// boosts and fuzz can follow the closing quote
+			suffix := end
+			for suffix < len(query) && (query[suffix] == '^' || query[suffix] == '~' || query[suffix] == '.' || query[suffix] == '-' || (query[suffix] >= '0' && query[suffix] <= '9')) {
+				suffix++
+			}
+			tokens = append(tokens, queryToken{kind: tokenTerm, text: text, quoted: true, suffix: query[end:suffix], position: start})
+			i = suffix
+		default:
+			text, end, err := lexTerm(query, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, queryToken{kind: tokenTerm, text: text, position: start})
+			i = end
+		}
+	}
+}
+
+// Reads a "quoted term" starting at i, returning its text and where it ends
+func lexQuoted(query string, i int) (string, int, error) {
+	text := strings.Builder{}
+	for j := i + 1; j < len(query); j++ {
+		switch query[j] {
+		case '\\':
+			if j+1 >= len(query) {
+				return "", 0, &querySyntaxError{"There's a `\\` with nothing after it.", j}
+			}
+			j++
+			text.WriteByte(query[j])
+		case '"':
+			return text.String(), j + 1, nil
+		default:
+			text.WriteByte(query[j])
+		}
+	}
+	return "", 0, &querySyntaxError{"There's a quote `\"` which is never closed.", i}
+}
+
+// Reads an unquoted term starting at i, returning its text and where it ends
+// Brackets inside a term, like `foo (bar)`, are part of it as long as they're balanced
+func lexTerm(query string, i int) (string, int, error) {
+	text := strings.Builder{}
+	depth := 0
+	j := i
+
+	for j < len(query) {
+		c := query[j]
+		if c == '\\' {
+			if j+1 >= len(query) {
+				return "", 0, &querySyntaxError{"There's a `\\` with nothing after it.", j}
+			}
+			text.WriteByte(c)
+			text.WriteByte(query[j+1])
+			j += 2
+			continue
+		}
+		if c == ',' || strings.HasPrefix(query[j:], "&&") || strings.HasPrefix(query[j:], "||") {
+			break
+		}
+		if c == ')' && depth == 0 {
+			break
+		}
+		if isQuerySpace(c) && (keywordAt(query, j+1, "AND") || keywordAt(query, j+1, "OR")) {
+			break
+		}
+		if c == '(' {
+			depth++
+		} else if c == ')' {
+			depth--
+		}
+		text.WriteByte(c)
+		j++
+	}
+
+	if depth > 0 {
+		return "", 0, &querySyntaxError{"There's a `(` in this term which is never closed.", i}
+	}
+	return strings.TrimRightFunc(text.String(), unicode.IsSpace), j, nil
+}
+
+// Removes backslash escapes from an unquoted term
+func unescapeTerm(text string) string {
+	unescaped := strings.Builder{}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) {
+			i++
+		}
+		unescaped.WriteByte(text[i])
+	}
+	return unescaped.String()
+}
+
+// Finds a boost or fuzz suffix which hasn't been escaped with a backslash, like the ^2 in foo^2 but not foo\\^2
+func unescapedSuffix(pattern *regexp.Regexp, text string) []string {
+	match := pattern.FindStringSubmatch(text)
+	if match == nil {
+		return nil
+	}
+	backslashes := 0
+	for i := len(text) - len(match[0]) - 1; i >= 0 && text[i] == '\\'; i-- {
+		backslashes++
+	}
+	if backslashes%2 == 1 {
+		return nil
+	}
+	return match
+}
+
+// Turns a term token into a term, splitting off boosts, fuzz and ranges
+func parseTerm(token queryToken) (*queryTerm, error) {
+	term := &queryTerm{}
+	text := token.text
+
+	if token.quoted {
+		// the quoted part is taken literally; only what follows the closing quote is parsed
+		suffix := token.suffix
+		for suffix != "" {
+			if match := boostSuffix.FindStringSubmatch(suffix); match != nil && term.Boost == "" {
+				term.Boost = match[1]
+				suffix = strings.TrimSuffix(suffix, match[0])
+			} else if match := fuzzSuffix.FindStringSubmatch(suffix); match != nil && term.Fuzz == "" {
+				term.Fuzz = match[1]
+				suffix = strings.TrimSuffix(suffix, match[0])
+			} else {
+				return nil, &querySyntaxError{"I don't understand `" + token.suffix + "` after the quoted term.", token.position}
+			}
+		}
+		term.Text = text
+	} else {
+		if match := unescapedSuffix(boostSuffix, text); match != nil {
+			term.Boost = match[1]
+			text = strings.TrimSuffix(text, match[0])
+		}
+		if match := unescapedSuffix(fuzzSuffix, text); match != nil {
+			term.Fuzz = match[1]
+			text = strings.TrimSuffix(text, match[0])
+		}
+		term.Text = strings.Join(strings.Fields(unescapeTerm(text)), " ")
+	}
+
+	if strings.TrimSpace(term.Text) == "" {
+		return nil, &querySyntaxError{"There's an empty term.", token.position}
+	}
+
+	if match := rangeTerm.FindStringSubmatch(term.Text); match != nil {
+		field, op, value := match[1], match[2], strings.TrimSpace(match[3])
+		switch {
+		case numericQueryFields[field]:
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, &querySyntaxError{"`" + field + "." + op + ":` needs a number.", token.position}
+			}
+		case dateQueryFields[field]:
+			if value == "" {
+				return nil, &querySyntaxError{"`" + field + "." + op + ":` needs a date.", token.position}
+			}
+		default:
+			return nil, &querySyntaxError{"`" + field + "` can't be searched by range.", token.position}
+		}
+		term.Field, term.Op, term.Text = field, op, value
+	}
+
+	return term, nil
+}
+
+// Recursive descent parser over the tokens; precedence is NOT, then AND, then OR
+type queryParser struct {
+	tokens []queryToken
+	next   int
+	depth  int
+	terms  int
+}
+
+func (parser *queryParser) peek() queryToken {
+	return parser.tokens[parser.next]
+}
+
+func (parser *queryParser) take() queryToken {
+	token := parser.tokens[parser.next]
+	if token.kind != tokenEnd {
+		parser.next++
+	}
+	return token
+}
+
+func (parser *queryParser) parseOr() (queryNode, error) {
+	first, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []queryNode{first}
+	for parser.peek().kind == tokenOr {
+		parser.take()
+		child, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return flatten(&queryOr{Children: children}), nil
+}
+
+func (parser *queryParser) parseAnd() (queryNode, error) {
+	first, err := parser.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	children := []queryNode{first}
+	for parser.peek().kind == tokenAnd {
+		parser.take()
+		child, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return flatten(&queryAnd{Children: children}), nil
+}
+
+func (parser *queryParser) parseNot() (queryNode, error) {
+	if parser.peek().kind != tokenNot {
+		return parser.parseAtom()
+	}
+	parser.take()
+
+	parser.depth++
+	if parser.depth > maxQueryDepth {
+		return nil, &querySyntaxError{"The search is nested too deeply.", parser.peek().position}
+	}
+	child, err := parser.parseNot()
+	parser.depth--
+	if err != nil {
+		return nil, err
+	}
+
+	// two negatives make a positive
+	if not, ok := child.(*queryNot); ok {
+		return not.Child, nil
+	}
+	return &queryNot{Child: child}, nil
+}
+
+func (parser *queryParser) parseAtom() (queryNode, error) {
+	token := parser.take()
+	switch token.kind {
+	case tokenTerm:
+		parser.terms++
+		if parser.terms > maxQueryTerms {
+			return nil, &querySyntaxError{"The search has too many terms (the most is " + strconv.Itoa(maxQueryTerms) + ").", token.position}
+		}
+		return parseTerm(token)
+	case tokenOpen:
+		parser.depth++
+		if parser.depth > maxQueryDepth {
+			return nil, &querySyntaxError{"The search is nested too deeply.", token.position}
+		}
+		if parser.peek().kind == tokenClose {
+			return nil, &querySyntaxError{"There's nothing between these brackets.", token.position}
+		}
+		node, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := parser.take(); closing.kind != tokenClose {
+			return nil, &querySyntaxError{"There's a `(` which is never closed.", token.position}
+		}
+		parser.depth--
+		return node, nil
+	case tokenClose:
+		return nil, &querySyntaxError{"There's a `)` without a matching `(`.", token.position}
+	case tokenEnd:
+		return nil, &querySyntaxError{"The search ends where I expected a term.", token.position}
+	default:
+		return nil, &querySyntaxError{"There's an operator where I expected a term.", token.position}
+	}
+}
+
+// Merges nested ANDs into their parent AND (and ORs into ORs), since the grouping doesn't change the meaning
+func flatten(node queryNode) queryNode {
+	switch node := node.(type) {
+	case *queryAnd:
+		children := []queryNode{}
+		for _, child := range node.Children {
+			if and, ok := child.(*queryAnd); ok {
+				children = append(children, and.Children...)
+			} else {
+				children = append(children, child)
+			}
+		}
+		node.Children = children
+	case *queryOr:
+		children := []queryNode{}
+		for _, child := range node.Children {
+			if or, ok := child.(*queryOr); ok {
+				children = append(children, or.Children...)
+			} else {
+				children = append(children, child)
+			}
+		}
+		node.Children = children
+	}
+	return node
+}
+
+// Parses a Derpibooru search query into a tree, or explains what's wrong with it
+func parseQuery(query string) (queryNode, error) {
+	if len(query) > maxQueryLength {
+		return nil, &querySyntaxError{"The search is too long (the most is " + strconv.Itoa(maxQueryLength) + " characters).", maxQueryLength}
+	}
+
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &queryParser{tokens: tokens}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token.kind != tokenEnd {
+		if token.kind == tokenClose {
+			return nil, &querySyntaxError{"There's a `)` without a matching `(`.", token.position}
+		}
+		return nil, &querySyntaxError{"I expected an operator like `,` or `||` here.", token.position}
+	}
+	return node, nil
+}
+
+// Combines a user's query with required conditions, so that none of them can be escaped with an OR
+// The result is always an AND whose first child is the user's whole query
+func restrictQuery(query queryNode, required ...queryNode) *queryAnd {
+	return &queryAnd{Children: append([]queryNode{query}, required...)}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"safe", "safe"},
+		{"twilight   sparkle, rarity", "twilight sparkle, rarity"},
+		{"a && b AND c", "a, b, c"},
+		{"a || b OR c", "a || b || c"},
+		{"a, b || c", "a, b || c"},
+		{"a, (b || c)", "a, (b || c)"},
+		{"-a, !b, NOT c", "-a, -b, -c"},
+		{"--a", "a"},
+		{"-(a || b)", "-(a || b)"},
+		{"semi-grimdark", "semi-grimdark"},
+		{"artist:foo, score.gte:100", "artist:foo, score.gte:100"},
+		{"created_at.gte:3 days ago", "created_at.gte:3 days ago"},
+		{"foo^2, bar~0.5", "foo^2, bar~0.5"},
+		{`"a, b"^1.5`, `"a, b"^1.5`},
+		{`foo\,bar`, `"foo,bar"`},
+		{"^^", `"^^"`},
+		{"princess luna (g4)", `"princess luna (g4)"`},
+		{"(princess luna (g4))", `"princess luna (g4)"`},
+		{"\"a\tb\"", "\"a\tb\""},
+	}
+
+	for _, test := range tests {
+		node, err := parseQuery(test.query)
+		if err != nil {
+			t.Errorf("parseQuery(%q) failed: %v", test.query, err)
+			continue
+		}
+		if got := node.String(); got != test.want {
+			t.Errorf("parseQuery(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	queries := []string{
+		"",
+		"a,",
+		"a ||",
+		"(a",
+		"a)",
+		"()",
+		`"a`,
+		"a b)",
+		`"a" b`,
+		"score.gt:lots",
+		"colour.gt:5",
+		"foo(",
+		strings.Repeat("(", maxQueryDepth+1) + "a" + strings.Repeat(")", maxQueryDepth+1),
+		strings.Repeat("a, ", maxQueryTerms) + "a",
+	}
+
+	for _, query := range queries {
+		if node, err := parseQuery(query); err == nil {
+			t.Errorf("parseQuery(%q) = %q, want an error", query, node.String())
+		} else if _, ok := err.(*querySyntaxError); !ok {
+			t.Errorf("parseQuery(%q) gave %T, want *querySyntaxError", query, err)
+		}
+	}
+}
+
+func TestRestrictQuery(t *testing.T) {
+	user, err := parseQuery("explicit || pony")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := restrictQuery(user, &queryTerm{Text: "safe"}).String()
+	if want := "(explicit || pony), safe"; got != want {
+		t.Errorf("restrictQuery() = %q, want %q", got, want)
+	}
+}
+
+func FuzzParseQuery(f *testing.F) {
+	seeds := []string{
+		"safe", "a, b || c", "-(a || b), c", `"quoted \" term"^2`, "score.gt:5",
+		"created_at.lte:2018-01-01", "foo~0.5^2", "a AND (b OR NOT c)", "princess luna (g4)",
+		`foo\^2`, "!a && !!b", "(((a)))",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, query string) {
+		node, err := parseQuery(query)
+		if err != nil {
+			if _, ok := err.(*querySyntaxError); !ok {
+				t.Fatalf("parseQuery(%q) gave %T, want *querySyntaxError", query, err)
+			}
+			// describing the error must never panic, wherever it points
+			err.(*querySyntaxError).describe(query)
+			return
+		}
+
+		// the normalized form must parse back to itself
+		normalized := node.String()
+		reparsed, err := parseQuery(normalized)
+		if err != nil {
+			t.Fatalf("normalized %q to %q, which doesn't parse: %v", query, normalized, err)
+		}
+		if again := reparsed.String(); again != normalized {
+			t.Fatalf("normalized %q to %q, then %q", query, normalized, again)
+		}
+
+		// whatever the user typed, a restricted query must still require the restriction
+		restricted, err := parseQuery(restrictQuery(node, &queryTerm{Text: "safe"}).String())
+		if err != nil {
+			t.Fatalf("restricting %q gave a query which doesn't parse: %v", query, err)
+		}
+		and, ok := restricted.(*queryAnd)
+		if !ok {
+			t.Fatalf("restricting %q gave %q, which isn't an AND", query, restricted.String())
+		}
+		last, ok := and.Children[len(and.Children)-1].(*queryTerm)
+		if !ok || last.String() != "safe" {
+			t.Fatalf("restricting %q gave %q, which doesn't end with safe", query, restricted.String())
+		}
+	})
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Most idle connections kept open to Redis
+const redisPoolSize = 10
+
+// How long one Redis command may take, including connecting
+const redisTimeout = 5 * time.Second
+
+// An error reply from Redis, like "WRONGTYPE Operation against a key holding the wrong kind of value"
+type redisError string
+
+func (err redisError) Error() string {
+	return "Redis: " + string(err)
+}
+
+// One connection to Redis
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Keeps data in Redis, speaking its protocol directly over a small pool of connections
+type redisStore struct {
+	addr     string          // host:port
+	password string          // sent with AUTH if not empty
+	db       int             // database number selected on each connection
+	pool     chan *redisConn // idle connections
+}
+
+// Connects to Redis at an address like "localhost:6379" or a URL like "redis://:password@host:6379/0"
+// A password in the URL is used if none is given separately
+func newRedisStore(address string, password string) (*redisStore, error) {
+	store := &redisStore{addr: address, password: password, pool: make(chan *redisConn, redisPoolSize)}
+
+	if strings.HasPrefix(address, "redis://") {
+		parsed, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		store.addr = parsed.Host
+		if urlPassword, ok := parsed.User.Password(); ok && store.password == "" {
+			store.password = urlPassword
+		}
+		if db := strings.Trim(parsed.Path, "/"); db != "" {
+			store.db, err = strconv.Atoi(db)
+			if err != nil {
+				return nil, fmt.Errorf("bad database number %q", db)
+			}
+		}
+	}
+	if _, _, err := net.SplitHostPort(store.addr); err != nil {
+		store.addr = net.JoinHostPort(store.addr, "6379")
+	}
+
+	// make sure it's reachable now, rather than on the first command
+	reply, err := store.do("PING")
+	if err != nil {
+		return nil, err
+	}
+	DebugPrint(fmt.Sprint("Redis says ", reply))
+	return store, nil
+}
+
+// Opens a new connection, logging in and picking the database
+func (store *redisStore) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", store.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if store.password != "" {
+		_, err = rc.do("AUTH", store.password)
+	}
+	if err == nil && store.db != 0 {
+		_, err = rc.do("SELECT", strconv.Itoa(store.db))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// Runs a command on a pooled connection
+// Connections which fail mid-command are closed rather than reused, since they may have half a reply waiting
+func (store *redisStore) do(args ...string) (interface{}, error) {
+	var rc *redisConn
+	select {
+	case rc = <-store.pool:
+	default:
+		var err error
+		rc, err = store.dial()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := rc.do(args...)
+	if _, isReply := err.(redisError); err != nil && !isReply {
+		rc.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case store.pool <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+// Sends a command and reads its reply
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var request strings.Builder
+	request.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		request.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	_, err := io.WriteString(rc.conn, request.String())
+	if err != nil {
+		return nil, err
+	}
+	return rc.read()
+}
+
+// Reads one reply: a string, an int64, nil for a missing value, or a []interface{} of replies
+// Error replies come back as a redisError
+func (rc *redisConn) read() (interface{}, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply from Redis")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(rc.reader, data)
+		if err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			items[i], err = rc.read()
+			if _, isReply := err.(redisError); err != nil && !isReply {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply from Redis: %q", line)
+}
+
+// Turns a Redis error about types into ErrWrongType
+func redisErr(err error) error {
+	if reply, ok := err.(redisError); ok && strings.HasPrefix(string(reply), "WRONGTYPE") {
+		return ErrWrongType
+	}
+	return err
+}
+
+// Runs a command whose reply is a string, giving ErrNotFound for a missing value
+func (store *redisStore) doString(args ...string) (string, error) {
+	reply, err := store.do(args...)
+	if err != nil {
+		return "", redisErr(err)
+	}
+	if reply == nil {
+		return "", ErrNotFound
+	}
+	text, ok := reply.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected reply from Redis to %s: %v", args[0], reply)
+	}
+	return text, nil
+}
+
+// Runs a command whose reply is an integer
+func (store *redisStore) doInt(args ...string) (int64, error) {
+	reply, err := store.do(args...)
+	if err != nil {
+		return 0, redisErr(err)
+	}
+	number, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply from Redis to %s: %v", args[0], reply)
+	}
+	return number, nil
+}
+
+// Runs a command whose reply is a list of strings
+func (store *redisStore) doStrings(args ...string) ([]string, error) {
+	reply, err := store.do(args...)
+	if err != nil {
+		return nil, redisErr(err)
+	}
+	items, ok := reply.([]interface{})
+	if !ok && reply != nil {
+		return nil, fmt.Errorf("unexpected reply from Redis to %s: %v", args[0], reply)
+	}
+	texts := []string{}
+	for _, item := range items {
+		text, _ := item.(string)
+		texts = append(texts, text)
+	}
+	return texts, nil
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// Milliseconds for commands which take them, since Redis rounds seconds down
+func formatMillis(ttl time.Duration) string {
+	return strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+}
+
+func (store *redisStore) Get(key string) (string, error) {
+	return store.doString("GET", key)
+}
+
+func (store *redisStore) Set(key string, value string, ttl time.Duration) error {
+	args := []string{"SET", key, value}
+	if ttl > 0 {
+		args = append(args, "PX", formatMillis(ttl))
+	}
+	_, err := store.do(args...)
+	return redisErr(err)
+}
+
+func (store *redisStore) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	args := []string{"SET", key, value, "NX"}
+	if ttl > 0 {
+		args = append(args, "PX", formatMillis(ttl))
+	}
+	// OK if it was set, nil if the key already existed
+	reply, err := store.do(args...)
+	if err != nil {
+		return false, redisErr(err)
+	}
+	return reply != nil, nil
+}
+
+func (store *redisStore) IncrBy(key string, amount int64) (int64, error) {
+	return store.doInt("INCRBY", key, strconv.FormatInt(amount, 10))
+}
+
+func (store *redisStore) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := store.do(append([]string{"DEL"}, keys...)...)
+	return redisErr(err)
+}
+
+func (store *redisStore) Expire(key string, ttl time.Duration) error {
+	var set int64
+	var err error
+	if ttl > 0 {
+		set, err = store.doInt("PEXPIRE", key, formatMillis(ttl))
+	} else {
+		set, err = store.doInt("PERSIST", key)
+		if err == nil && set == 0 {
+			// PERSIST also gives 0 for a key that already has no expiry
+			_, err = store.TTL(key)
+			return err
+		}
+	}
+	if err == nil && set == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (store *redisStore) TTL(key string) (time.Duration, error) {
+	millis, err := store.doInt("PTTL", key)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case millis == -2:
+		return 0, ErrNotFound
+	case millis < 0:
+		return 0, nil
+	}
+	return time.Duration(millis) * time.Millisecond, nil
+}
+
+// Uses SCAN rather than KEYS, so a big database isn't blocked while it's searched
+func (store *redisStore) Keys(pattern string) ([]string, error) {
+	seen := make(map[string]bool)
+	keys := []string{}
+
+	cursor := "0"
+	for {
+		reply, err := store.do("SCAN", cursor, "MATCH", pattern, "COUNT", "1000")
+		if err != nil {
+			return nil, redisErr(err)
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return nil, fmt.Errorf("unexpected reply from Redis to SCAN: %v", reply)
+		}
+		cursor, _ = parts[0].(string)
+		batch, _ := parts[1].([]interface{})
+		for _, item := range batch {
+			// SCAN can return a key more than once
+			if key, ok := item.(string); ok && !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+// Redis has other kinds of value too, but Sunbot never makes them
+func (store *redisStore) Type(key string) (string, error) {
+	kind, err := store.doString("TYPE", key)
+	if err != nil {
+		return "", err
+	}
+	switch kind {
+	case "none":
+		return "", ErrNotFound
+	case storeString, storeHash, storeZSet:
+		return kind, nil
+	}
+	return "", fmt.Errorf("key %s holds a Redis %s, which Sunbot doesn't use", key, kind)
+}
+
+func (store *redisStore) HGet(key string, field string) (string, error) {
+	return store.doString("HGET", key, field)
+}
+
+func (store *redisStore) HGetAll(key string) (map[string]string, error) {
+	pairs, err := store.doStrings("HGETALL", key)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		fields[pairs[i]] = pairs[i+1]
+	}
+	return fields, nil
+}
+
+// Uses HMSET, since HSET only takes several fields from Redis 4 on
+func (store *redisStore) HSet(key string, fields map[string]string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	args := []string{"HMSET", key}
+	for field, value := range fields {
+		args = append(args, field, value)
+	}
+	_, err := store.do(args...)
+	return redisErr(err)
+}
+
+func (store *redisStore) HDel(key string, fields ...string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	_, err := store.do(append([]string{"HDEL", key}, fields...)...)
+	return redisErr(err)
+}
+
+func (store *redisStore) HIncrBy(key string, field string, amount int64) (int64, error) {
+	return store.doInt("HINCRBY", key, field, strconv.FormatInt(amount, 10))
+}
+
+func (store *redisStore) ZAdd(key string, member string, score float64) error {
+	_, err := store.do("ZADD", key, formatScore(score), member)
+	return redisErr(err)
+}
+
+func (store *redisStore) ZIncrBy(key string, member string, amount float64) (float64, error) {
+	text, err := store.doString("ZINCRBY", key, formatScore(amount), member)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(text, 64)
+}
+
+func (store *redisStore) ZScore(key string, member string) (float64, error) {
+	text, err := store.doString("ZSCORE", key, member)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(text, 64)
+}
+
+func (store *redisStore) ZRank(key string, member string, reverse bool) (int64, error) {
+	command := "ZRANK"
+	if reverse {
+		command = "ZREVRANK"
+	}
+	reply, err := store.do(command, key, member)
+	if err != nil {
+		return 0, redisErr(err)
+	}
+	if reply == nil {
+		return 0, ErrNotFound
+	}
+	rank, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply from Redis to %s: %v", command, reply)
+	}
+	return rank, nil
+}
+
+func (store *redisStore) ZRange(key string, start int64, stop int64, reverse bool) ([]ScoredMember, error) {
+	command := "ZRANGE"
+	if reverse {
+		command = "ZREVRANGE"
+	}
+	pairs, err := store.doStrings(command, key, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10), "WITHSCORES")
+	if err != nil {
+		return nil, err
+	}
+
+	members := []ScoredMember{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		score, err := strconv.ParseFloat(pairs[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, ScoredMember{Member: pairs[i], Score: score})
+	}
+	return members, nil
+}
+
+func (store *redisStore) ZCard(key string) (int64, error) {
+	return store.doInt("ZCARD", key)
+}
+
+func (store *redisStore) ZRem(key string, members ...string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	_, err := store.do(append([]string{"ZREM", key}, members...)...)
+	return redisErr(err)
+}
+
+// Closes the idle connections; commands still running close theirs when done
+func (store *redisStore) Close() error {
+	for {
+		select {
+		case rc := <-store.pool:
+			rc.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Connects to a fake Redis server which reads one command, sends it on the returned channel and answers with
+// the given reply, exactly as written; with hangUp it then closes the connection, as if it went away mid-reply
+func fakeRedis(t *testing.T, reply string, hangUp bool) (*redisConn, <-chan []string) {
+	client, server := net.Pipe()
+	commands := make(chan []string, 1)
+
+	go func() {
+		defer func() {
+			if hangUp {
+				server.Close()
+			}
+		}()
+		reader := bufio.NewReader(server)
+		command, err := readFakeCommand(reader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		commands <- command
+		server.Write([]byte(reply))
+	}()
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return &redisConn{conn: client, reader: bufio.NewReader(client)}, commands
+}
+
+// Reads a command as clients send them: an array of bulk strings
+func readFakeCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{}
+	for i := 0; i < count; i++ {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, string(data[:length]))
+	}
+	return args, nil
+}
+
+func TestRedisConnReplies(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  interface{}
+	}{
+		{"simple string", "+OK\r\n", "OK"},
+		{"integer", ":-42\r\n", int64(-42)},
+		{"bulk string", "$5\r\nhello\r\n", "hello"},
+		{"bulk string with a line break", "$6\r\nab\r\ncd\r\n", "ab\r\ncd"},
+		{"empty bulk string", "$0\r\n\r\n", ""},
+		{"nil bulk string", "$-1\r\n", nil},
+		{"nil array", "*-1\r\n", nil},
+		{"empty array", "*0\r\n", []interface{}{}},
+		{"nested arrays", "*3\r\n$1\r\na\r\n*2\r\n:1\r\n$-1\r\n*0\r\n", []interface{}{"a", []interface{}{int64(1), nil}, []interface{}{}}},
+	}
+
+	for _, test := range tests {
+		rc, commands := fakeRedis(t, test.reply, false)
+		got, err := rc.do("GET", "some key")
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, got, test.want)
+		}
+		if command := <-commands; !reflect.DeepEqual(command, []string{"GET", "some key"}) {
+			t.Errorf("%s: server got %q", test.name, command)
+		}
+	}
+}
+
+func TestRedisConnErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		reply     string
+		hangUp    bool
+		fromRedis bool // the error is a reply from Redis rather than a broken connection
+	}{
+		{"error reply", "-ERR unknown command\r\n", false, true},
+		{"wrong type", "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", false, true},
+		{"unknown reply type", "?what\r\n", false, false},
+		{"bad integer", ":lots\r\n", false, false},
+		{"dropped before replying", "", true, false},
+		{"dropped mid-line", "+OK", true, false},
+		{"dropped mid-bulk string", "$10\r\nhel", true, false},
+		{"dropped mid-array", "*3\r\n:1\r\n$1\r\na\r\n", true, false},
+	}
+
+	for _, test := range tests {
+		rc, _ := fakeRedis(t, test.reply, test.hangUp)
+		got, err := rc.do("GET", "key")
+		if err == nil {
+			t.Errorf("%s: got %#v, want an error", test.name, got)
+			continue
+		}
+		if _, isReply := err.(redisError); isReply != test.fromRedis {
+			t.Errorf("%s: error %v is a reply from Redis: %v, want %v", test.name, err, isReply, test.fromRedis)
+		}
+	}
+
+	rc, _ := fakeRedis(t, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", false)
+	if _, err := rc.do("HGET", "key", "field"); redisErr(err) != ErrWrongType {
+		t.Errorf("redisErr(%v) = %v, want ErrWrongType", err, redisErr(err))
+	}
+}
+
+// Connections are reused after a reply, even an error reply, but never after breaking mid-reply
+func TestRedisStorePool(t *testing.T) {
+	tests := []struct {
+		name   string
+		reply  string
+		hangUp bool
+		reused bool
+	}{
+		{"reply", "+OK\r\n", false, true},
+		{"error reply", "-ERR nope\r\n", false, true},
+		{"dropped mid-reply", "$10\r\nhel", true, false},
+	}
+
+	for _, test := range tests {
+		rc, _ := fakeRedis(t, test.reply, test.hangUp)
+		store := &redisStore{pool: make(chan *redisConn, 1)}
+		store.pool <- rc
+
+		store.do("SET", "key", "value")
+		if reused := len(store.pool) == 1; reused != test.reused {
+			t.Errorf("%s: connection reused: %v, want %v", test.name, reused, test.reused)
+		}
+	}
+}
+
+func TestRedisStoreSetNX(t *testing.T) {
+	tests := []struct {
+		reply string
+		set   bool
+	}{
+		{"+OK\r\n", true},
+		{"$-1\r\n", false},
+	}
+
+	for _, test := range tests {
+		rc, commands := fakeRedis(t, test.reply, false)
+		store := &redisStore{pool: make(chan *redisConn, 1)}
+		store.pool <- rc
+
+		set, err := store.SetNX("key", "1", 1500*time.Millisecond)
+		if err != nil || set != test.set {
+			t.Errorf("SetNX with reply %q = %v, %v; want %v", test.reply, set, err, test.set)
+		}
+		if command := <-commands; !reflect.DeepEqual(command, []string{"SET", "key", "1", "NX", "PX", "1500"}) {
+			t.Errorf("server got %q", command)
+		}
+	}
+}
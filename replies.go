@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long after a command its message can be edited or deleted and still update the bot's reply
+const replyTrackingWindow = 10 * time.Minute
+
+// Most invocations remembered at once; the oldest are forgotten first
+const replyTrackingLimit = 1000
+
+// The bot's reply to one command invocation
+type trackedReply struct {
+	messages []*discordgo.Message // messages the bot sent in reply, in order
+	created  time.Time            // when the command was first run
+}
+
+// Remembers which reply belongs to which invocation, for a limited time
+type replyTracker struct {
+	sync.Mutex
+	replies map[string]*trackedReply // invoking message ID -> reply
+	order   []string                 // invoking message IDs, oldest first
+}
+
+// Global reply tracker used by the message handlers
+var replies = &replyTracker{replies: make(map[string]*trackedReply)}
+
+// Records the reply to an invocation, replacing any earlier reply to the same message
+func (tracker *replyTracker) track(invoking *discordgo.Message, sent []*discordgo.Message) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	if existing, ok := tracker.replies[invoking.ID]; ok {
+		// an edit keeps the original window rather than extending it
+		existing.messages = sent
+		return
+	}
+
+	tracker.replies[invoking.ID] = &trackedReply{messages: sent, created: time.Now()}
+	tracker.order = append(tracker.order, invoking.ID)
+	tracker.prune()
+}
+
+// Gets the reply to an invocation, if it's still being tracked
+func (tracker *replyTracker) get(messageID string) (*trackedReply, bool) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	tracker.prune()
+	reply, ok := tracker.replies[messageID]
+	return reply, ok
+}
+
+// Stops tracking an invocation, returning its reply if there was one
+func (tracker *replyTracker) remove(messageID string) (*trackedReply, bool) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	tracker.prune()
+	reply, ok := tracker.replies[messageID]
+	delete(tracker.replies, messageID)
+	return reply, ok
+}
+
+// Forgets invocations which are too old, or too many; the caller must hold the lock
+func (tracker *replyTracker) prune() {
+	cutoff := time.Now().Add(-replyTrackingWindow)
+
+	drop := 0
+	for _, messageID := range tracker.order {
+		reply, ok := tracker.replies[messageID]
+		if ok && reply.created.After(cutoff) && len(tracker.order)-drop <= replyTrackingLimit {
+			break
+		}
+		delete(tracker.replies, messageID)
+		drop++
+	}
+	tracker.order = tracker.order[drop:]
+}
+
+// For commands whose every use can be re-run when edited
+func rerunAlways(args *commandArgs) bool {
+	return true
+}
+
+// Re-runs an edited command only when the first word of an argument is one of the given ones, like `policy show`
+func rerunWhen(name string, readOnly ...string) func(*commandArgs) bool {
+	return func(args *commandArgs) bool {
+		word := strings.ToLower(firstWord(args.String(name)))
+		for _, allowed := range readOnly {
+			if word == allowed {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Re-runs an edited command unless the first word of an argument is one of the given ones, like `derpi watch`
+func rerunUnless(name string, changing ...string) func(*commandArgs) bool {
+	rerun := rerunWhen(name, changing...)
+	return func(args *commandArgs) bool {
+		return !rerun(args)
+	}
+}
+
+// Whether an edited invocation may run again; anything which might change something, like giving XP or adding a
+// watch, would do it twice
+func rerunsOnEdit(cmd *command, args *commandArgs) bool {
+	return cmd.rerunOnEdit != nil && cmd.rerunOnEdit(args)
+}
+
+// The first word of some text, or "" if there isn't one
+func firstWord(text string) string {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return ""
+	}
+	return words[0]
+}
+
+// Called any time a message is edited; re-runs tracked commands and updates the reply in place
+// Only commands which don't change anything are re-run (see rerunsOnEdit)
+func parseEditedMessage(discordSession *discordgo.Session, msgEvent *discordgo.MessageUpdate) {
+	defer recoverAndReport(discordSession, "the message edit handler")
+
+	// embeds being filled in also count as edits, but those don't include an author or any text
+	if msgEvent.Author == nil || msgEvent.Author.Bot || len(msgEvent.Content) == 0 {
+		return
+	}
+
+	previous, ok := replies.get(msgEvent.ID)
+	if !ok {
+		return
+	}
+	DebugPrint("\nTracked command edited:\n" + msgEvent.Author.Username + ": " + msgEvent.Content)
+
+	messageChannel, err := GetChannel(discordSession, msgEvent.ChannelID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	prefix := guildPrefix(messageChannel.GuildID)
+
+	commandText, ok := stripPrefix(msgEvent.Content, prefix, discordSession.State.User.ID)
+	if !ok {
+		// no longer a command, so the reply doesn't make sense any more
+		DebugPrint("Edited message is no longer a command; removing reply.")
+		deleteMessages(discordSession, previous.messages)
+		replies.remove(msgEvent.ID)
+		return
+	}
+
+	output := runCommandText(discordSession, &discordgo.MessageCreate{Message: msgEvent.Message}, messageChannel, prefix, commandText, true)
+	if output == nil {
+		DebugPrint("Edited command had no output or isn't re-run; leaving the old reply.")
+		return
+	}
+
+	sent, err := editOutput(discordSession, output, previous.messages, msgEvent.ChannelID, msgEvent.Author.ID)
+	if err != nil {
+		fmt.Println("Error updating command output")
+		fmt.Println(err)
+	}
+	replies.track(msgEvent.Message, sent)
+}
+
+// Called any time a message is deleted; removes the bot's reply to it
+func parseDeletedMessage(discordSession *discordgo.Session, msgEvent *discordgo.MessageDelete) {
+	defer recoverAndReport(discordSession, "the message delete handler")
+
+	previous, ok := replies.remove(msgEvent.ID)
+	if !ok {
+		return
+	}
+
+	DebugPrint("Tracked command deleted; removing reply.")
+	deleteMessages(discordSession, previous.messages)
+}
+
+// Deletes messages, ignoring ones which are already gone
+func deleteMessages(session *discordgo.Session, messages []*discordgo.Message) {
+	for _, message := range messages {
+		paginators.stop(message.ID, false)
+		err := session.ChannelMessageDelete(message.ChannelID, message.ID)
+		if err != nil {
+			DebugPrint("Couldn't delete message " + message.ID + ": " + err.Error())
+		}
+	}
+}
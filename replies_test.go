@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"testing"
+)
+
+func TestRerunsOnEdit(t *testing.T) {
+	list := initCommands()
+	tests := []struct {
+		text  string
+		rerun bool
+	}{
+		{"help", true},
+		{"derpi pony", true},
+		{"derpi id 1", true},
+		{"derpi watches", true},
+		{"tag pony", true},
+		{"stats", true},
+		{"rank", true},
+		{"policy", true},
+		{"policy show", true},
+		{"levels top", true},
+		{"daily list", true},
+		{"booru e621 pony", true},
+		{"prefix", true},
+
+		{"derpi watch pony", false},
+		{"derpi unwatch 3", false},
+		{"daily top 08:30 UTC pony", false},
+		{"policy exclude gore", false},
+		{"levels on", false},
+		{"statschannels exclude 123", false},
+		{"booru default e621", false},
+		{"prefix !", false},
+		{"derpicache flush", false},
+		{"xp give 1 500", false},
+		{"exec ls", false},
+		{"autosource on", false},
+	}
+
+	for _, test := range tests {
+		tokens, err := tokenize(test.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd, ok := list[tokens[0].text]
+		if !ok {
+			t.Fatalf("no command %q", tokens[0].text)
+		}
+		args, err := parseArgs(cmd, tokens[1:])
+		if err != nil {
+			t.Fatalf("parseArgs(%q) failed: %v", test.text, err)
+		}
+		if got := rerunsOnEdit(cmd, args); got != test.rerun {
+			t.Errorf("rerunsOnEdit(%q) = %v, want %v", test.text, got, test.rerun)
+		}
+	}
+}
+
+// Editing a command which changes something must not make the change again
+func TestEditedCommandNotRerun(t *testing.T) {
+	saved := commands
+	defer func() {
+		commands = saved
+	}()
+
+	runs := 0
+	commands = map[string]*command{
+		"give": {
+			verbs:     []string{"give"},
+			arguments: []argument{{name: "amount", kind: argInt}},
+			function: func(args *commandArgs, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, session *discordgo.Session) *commandOutput {
+				runs++
+				return &commandOutput{response: "Given"}
+			},
+		},
+	}
+
+	msgEvent := &discordgo.MessageCreate{Message: &discordgo.Message{ID: "1", Author: &discordgo.User{ID: "2"}}}
+	output := runCommandText(nil, msgEvent, &discordgo.Channel{ID: "3"}, ".", "give 500", true)
+	if output != nil || runs != 0 {
+		t.Errorf("editing ran the command %d times and replied %v", runs, output)
+	}
+}
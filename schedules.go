@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Most daily posts one guild can have
+const maxSchedulesPerGuild = 10
+
+// How many posted image IDs each schedule remembers, so repeats can be skipped
+const maxScheduleHistory = 200
+
+// How late a post may still be made, for when the bot was down or Derpibooru was unreachable at the time
+// Anything later is skipped until the next day, rather than posting "today's" image at a strange hour
+const scheduleCatchUp = time.Hour
+
+// Kinds of daily post
+const (
+	scheduleFeatured = "featured" // the image featured on Derpibooru's front page
+	scheduleTop      = "top"      // the highest scoring image from the last 24 hours matching a query
+)
+
+// A daily image post to a channel
+type derpiSchedule struct {
+	ID        int       `json:"id"`        // number shown to users, unique across all guilds
+	GuildID   string    `json:"guildID"`   // guild the channel belongs to
+	ChannelID string    `json:"channelID"` // channel the image is posted to
+	Kind      string    `json:"kind"`      // scheduleFeatured or scheduleTop
+	Query     string    `json:"query"`     // query as typed, for scheduleTop; the channel's policy is added when posting
+	Time      string    `json:"time"`      // time of day to post, like "08:30"
+	Timezone  string    `json:"timezone"`  // IANA timezone name the time is in, like "Europe/London"
+	CreatedBy string    `json:"createdBy"` // user ID of whoever set it up
+	LastRun   time.Time `json:"lastRun"`   // when it last posted, or was skipped; the next post is the first due time after this
+	Posted    []int     `json:"posted"`    // IDs of the images it has posted, newest last
+}
+
+// Parses a time of day like "8:30" or "08:30"
+func parseTimeOfDay(text string) (hour int, minute int, err error) {
+	parsed, err := time.Parse("15:04", text)
+	if err != nil {
+		return 0, 0, fmt.Errorf("That isn't a time I understand; use 24-hour time, like `08:30` or `17:00`.")
+	}
+	return parsed.Hour(), parsed.Minute(), nil
+}
+
+// Loads a timezone by name; "Local" is refused since it means wherever the bot happens to run
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "Local" {
+		return nil, fmt.Errorf("unknown time zone Local")
+	}
+	return time.LoadLocation(name)
+}
+
+// The first time the schedule is due after the given time
+func (schedule *derpiSchedule) nextRun(after time.Time) (time.Time, error) {
+	location, err := loadTimezone(schedule.Timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	hour, minute, err := parseTimeOfDay(schedule.Time)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// days are added in the schedule's timezone, so the post stays at the same local time across daylight saving changes
+	local := after.In(location)
+	next := time.Date(local.Year(), local.Month(), local.Day(), hour, minute, 0, 0, location)
+	for !next.After(after) {
+		local = local.AddDate(0, 0, 1)
+		next = time.Date(local.Year(), local.Month(), local.Day(), hour, minute, 0, 0, location)
+	}
+	return next, nil
+}
+
+// Describes when a schedule posts, like "08:30 Europe/London"
+func (schedule *derpiSchedule) describe() string {
+	what := "the featured image"
+	if schedule.Kind == scheduleTop {
+		what = "the top image for `" + schedule.Query + "`"
+	}
+	return what + " at " + schedule.Time + " " + schedule.Timezone
+}
+
+// The item methods listStore needs
+func (schedule *derpiSchedule) itemID() int       { return schedule.ID }
+func (schedule *derpiSchedule) setItemID(id int)  { schedule.ID = id }
+func (schedule *derpiSchedule) itemGuild() string { return schedule.GuildID }
+
+// Holds every daily post and saves them to a JSON file so they survive restarts
+type scheduleStore struct {
+	*listStore[derpiSchedule, *derpiSchedule]
+}
+
+// Global schedule store (see initSchedules)
+var schedules *scheduleStore
+
+// Loads schedules from the given file; a missing file just means there aren't any yet
+func loadSchedules(path string) (*scheduleStore, error) {
+	list, err := loadListStore[derpiSchedule](path, "schedules")
+	if err != nil {
+		return nil, err
+	}
+	return &scheduleStore{list}, nil
+}
+
+// Copies of the schedules whose time has come
+func (store *scheduleStore) due(now time.Time) []derpiSchedule {
+	store.Lock()
+	defer store.Unlock()
+
+	list := []derpiSchedule{}
+	for _, schedule := range store.items {
+		next, err := schedule.nextRun(schedule.LastRun)
+		if err != nil {
+			fmt.Println("Error in daily post #" + strconv.Itoa(schedule.ID) + ": " + err.Error())
+			continue
+		}
+		if !now.Before(next) {
+			list = append(list, *schedule)
+		}
+	}
+	return list
+}
+
+// Images already posted in a channel by any of its schedules
+func (store *scheduleStore) postedIn(channelID string) map[int]bool {
+	store.Lock()
+	defer store.Unlock()
+
+	posted := make(map[int]bool)
+	for _, schedule := range store.items {
+		if schedule.ChannelID == channelID {
+			for _, id := range schedule.Posted {
+				posted[id] = true
+			}
+		}
+	}
+	return posted
+}
+
+// Records that a schedule ran, along with the image it posted (0 if none); it may have been removed in the meantime
+func (store *scheduleStore) finishRun(id int, ran time.Time, postedID int) error {
+	store.Lock()
+	defer store.Unlock()
+
+	for _, schedule := range store.items {
+		if schedule.ID != id {
+			continue
+		}
+
+		schedule.LastRun = ran
+		if postedID != 0 {
+			schedule.Posted = append(schedule.Posted, postedID)
+			if len(schedule.Posted) > maxScheduleHistory {
+				schedule.Posted = schedule.Posted[len(schedule.Posted)-maxScheduleHistory:]
+			}
+		}
+		return store.save()
+	}
+	return nil
+}
+
+// Loads schedules; posting starts once connected (see startScheduler)
+func initSchedules() error {
+	var err error
+	schedules, err = loadSchedules(cfg.DerpiScheduleFile)
+	return err
+}
+
+// Makes daily posts in the background for as long as the bot runs
+func startScheduler(session *discordgo.Session) {
+	go func() {
+		for range time.Tick(time.Minute) {
+			now := time.Now()
+			for _, schedule := range schedules.due(now) {
+				func() {
+					defer recoverAndReport(session, "daily post #"+strconv.Itoa(schedule.ID))
+					runSchedule(session, schedule, now)
+				}()
+			}
+		}
+	}()
+}
+
+// Makes one daily post, or skips it if it's too late
+// Errors leave the schedule due, so it's tried again next minute until scheduleCatchUp runs out
+func runSchedule(session *discordgo.Session, schedule derpiSchedule, now time.Time) {
+	next, _ := schedule.nextRun(schedule.LastRun)
+	if now.Sub(next) > scheduleCatchUp {
+		DebugPrint("Daily post #" + strconv.Itoa(schedule.ID) + " is too late; skipping until tomorrow")
+		err := schedules.finishRun(schedule.ID, now, 0)
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	image, found, err := pickScheduledImage(session, schedule)
+	if err != nil {
+		fmt.Println("Error in daily post #" + strconv.Itoa(schedule.ID) + ": " + err.Error())
+		return
+	}
+	if !found {
+		DebugPrint("Daily post #" + strconv.Itoa(schedule.ID) + " found nothing new to post")
+		err = schedules.finishRun(schedule.ID, now, 0)
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	footer := "Featured image of the day"
+	if schedule.Kind == scheduleTop {
+		footer = "Top image of the day for: " + schedule.Query
+	}
+	_, err = sendOutput(session, derpiImageOutput(image, footer+" • daily post #"+strconv.Itoa(schedule.ID)), schedule.ChannelID, "")
+	if err != nil {
+		fmt.Println("Error sending daily post #" + strconv.Itoa(schedule.ID) + ": " + err.Error())
+		return
+	}
+
+	err = schedules.finishRun(schedule.ID, now, image.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Finds the image a schedule should post; found is false if there's nothing new the channel allows
+func pickScheduledImage(session *discordgo.Session, schedule derpiSchedule) (image DerpiImage, found bool, err error) {
+	channel, err := GetChannel(session, schedule.ChannelID)
+	if err != nil {
+		return image, false, err
+	}
+	policy := channelPolicy(channel)
+	posted := schedules.postedIn(schedule.ChannelID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DerpiTimeout)
+	defer cancel()
+
+	if schedule.Kind == scheduleFeatured {
+		image, err = derpi.Featured(ctx)
+		if err != nil {
+			return image, false, err
+		}
+		// the featured image can stay up for more than a day, and it might not suit this channel
+		allowed, reason := policy.allows(image)
+		if !allowed {
+			DebugPrint("Daily post #" + strconv.Itoa(schedule.ID) + " skipped the featured image because " + reason)
+		}
+		return image, allowed && !posted[image.ID], nil
+	}
+
+	// top: the user's query, limited to the last day, with the channel's policy around it all
+	query, err := scheduleQuery(schedule.Query)
+	if err != nil {
+		return image, false, err
+	}
+	query, err = policy.query(query)
+	if err != nil {
+		return image, false, err
+	}
+
+	results, err := derpi.Search(ctx, DerpiSearchOptions{
+		Query:         query,
+		PerPage:       DerpiMaxPerPage,
+		SortField:     DerpiSortScore,
+		SortDirection: "desc",
+		FilterID:      policy.filter(0),
+		NoCache:       true,
+	})
+	if err != nil {
+		return image, false, err
+	}
+	for _, image := range policy.filterImages(results.Search) {
+		if !posted[image.ID] {
+			return image, true, nil
+		}
+	}
+	return image, false, nil
+}
+
+// Limits a query to images uploaded in the last 24 hours
+func scheduleQuery(query string) (string, error) {
+	node, err := parseQuery(query)
+	if err != nil {
+		return "", err
+	}
+	return restrictQuery(node, &queryTerm{Field: "created_at", Op: "gte", Text: "24 hours ago"}).String(), nil
+}
+
+// Handles `.daily`
+func dailyCommand(text string, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, session *discordgo.Session) *commandOutput {
+	if channel.GuildID == "" {
+		return &commandOutput{response: "Daily posts can only be used in a server."}
+	}
+
+	words := strings.Fields(text)
+	if len(words) == 0 || words[0] == "list" {
+		return listSchedules(channel.GuildID)
+	}
+
+	if denied := requirePermission(session, msgEvent, channel, discordgo.PermissionManageChannels, "change daily posts"); denied != nil {
+		return denied
+	}
+
+	switch words[0] {
+	case "remove":
+		if len(words) < 2 {
+			return &commandOutput{response: "Which daily post? Use its number from `daily list`, like `daily remove 3`."}
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(words[1], "#"))
+		if err != nil {
+			return &commandOutput{response: "Which daily post? Use its number from `daily list`, like `daily remove 3`."}
+		}
+		removed, err := schedules.remove(channel.GuildID, id)
+		if err != nil {
+			fmt.Println(err)
+			return &commandOutput{response: "Error saving daily posts"}
+		}
+		if !removed {
+			return &commandOutput{response: "There's no daily post #" + strconv.Itoa(id) + " in this server."}
+		}
+		return &commandOutput{response: "Done! Daily post #" + strconv.Itoa(id) + " removed."}
+
+	case scheduleFeatured, scheduleTop:
+		return addSchedule(words, channel, msgEvent)
+	}
+
+	return &commandOutput{response: "I don't know how to do that. Use `daily featured <time> [timezone]`, `daily top <time> [timezone] [query]`, `daily list` or `daily remove <number>`."}
+}
+
+// Handles `.daily featured` and `.daily top`
+func addSchedule(words []string, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate) *commandOutput {
+	if len(words) < 2 {
+		return &commandOutput{response: "When should I post? Give a time, like `daily " + words[0] + " 08:30 Europe/London`."}
+	}
+	hour, minute, err := parseTimeOfDay(words[1])
+	if err != nil {
+		return &commandOutput{response: err.Error()}
+	}
+
+	// the timezone is optional, so the next word only counts as one if it's a timezone I know
+	timezone := "UTC"
+	rest := words[2:]
+	if len(rest) > 0 {
+		if _, err := loadTimezone(rest[0]); err == nil {
+			timezone = rest[0]
+			rest = rest[1:]
+		} else if words[0] == scheduleFeatured || strings.Contains(rest[0], "/") {
+			return &commandOutput{response: "I don't know the timezone `" + rest[0] + "`. Use a name like `Europe/London` or `America/New_York`."}
+		}
+	}
+
+	query := strings.Join(rest, " ")
+	if words[0] == scheduleTop {
+		if query == "" {
+			query = "*"
+		}
+		// check the query now, rather than finding out when it's time to post
+		checked, err := scheduleQuery(query)
+		if err == nil {
+			_, err = channelPolicy(channel).query(checked)
+		}
+		if err != nil {
+			return &commandOutput{response: describeQueryError(err, query)}
+		}
+	}
+
+	if len(schedules.forGuild(channel.GuildID)) >= maxSchedulesPerGuild {
+		return &commandOutput{response: "This server already has " + strconv.Itoa(maxSchedulesPerGuild) + " daily posts; remove one first."}
+	}
+
+	schedule := &derpiSchedule{
+		GuildID:   channel.GuildID,
+		ChannelID: channel.ID,
+		Kind:      words[0],
+		Query:     query,
+		Time:      fmt.Sprintf("%02d:%02d", hour, minute),
+		Timezone:  timezone,
+		CreatedBy: msgEvent.Author.ID,
+		LastRun:   time.Now(),
+	}
+	next, err := schedule.nextRun(schedule.LastRun)
+	if err != nil {
+		fmt.Println(err)
+		return &commandOutput{response: "Error: " + err.Error()}
+	}
+
+	err = schedules.add(schedule)
+	if err != nil {
+		fmt.Println(err)
+		return &commandOutput{response: "Error saving daily posts"}
+	}
+
+	response := "Okay! I'll post " + schedule.describe() + " here every day (daily post #" + strconv.Itoa(schedule.ID) + ")."
+	response += "\nThe first one is in " + next.Sub(time.Now()).Round(time.Minute).String() + ". Only images this channel's image policy allows will be posted (see `policy`)."
+	return &commandOutput{response: response}
+}
+
+// Lists a guild's daily posts
+func listSchedules(guildID string) *commandOutput {
+	list := schedules.forGuild(guildID)
+	if len(list) == 0 {
+		return &commandOutput{response: "There are no daily posts in this server."}
+	}
+
+	lines := []string{}
+	for _, schedule := range list {
+		lines = append(lines, "**#"+strconv.Itoa(schedule.ID)+"** "+schedule.describe()+" in <#"+schedule.ChannelID+">")
+	}
+
+	embed := NewEmbed().
+		SetTitle("Daily posts").
+		SetDescription(strings.Join(lines, "\n")).
+		SetColor(derpiEmbedColor)
+	return &commandOutput{embed: embed.Truncate().MessageEmbed}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextRun(t *testing.T) {
+	tests := []struct {
+		time     string
+		timezone string
+		after    string
+		want     string
+	}{
+		// later the same day, and tomorrow once it's passed or exactly due
+		{"08:30", "UTC", "2026-06-01T06:00:00Z", "2026-06-01T08:30:00Z"},
+		{"08:30", "UTC", "2026-06-01T08:30:00Z", "2026-06-02T08:30:00Z"},
+		{"08:30", "UTC", "2026-06-01T09:00:00Z", "2026-06-02T08:30:00Z"},
+		{"00:00", "UTC", "2026-12-31T23:59:00Z", "2027-01-01T00:00:00Z"},
+
+		// London's clocks go forward on 29 March 2026 and back on 25 October 2026, and the post stays at 08:30 local
+		{"08:30", "Europe/London", "2026-03-28T09:00:00Z", "2026-03-29T07:30:00Z"},
+		{"08:30", "Europe/London", "2026-03-29T06:00:00Z", "2026-03-29T07:30:00Z"},
+		{"08:30", "Europe/London", "2026-10-24T08:00:00Z", "2026-10-25T08:30:00Z"},
+		{"08:30", "Europe/London", "2026-10-25T07:45:00Z", "2026-10-25T08:30:00Z"},
+
+		// New York changes on different days, and its local date is behind UTC in the evening
+		{"20:00", "America/New_York", "2026-03-08T01:30:00Z", "2026-03-09T00:00:00Z"},
+		{"20:00", "America/New_York", "2026-11-01T00:30:00Z", "2026-11-02T01:00:00Z"},
+
+		// Tokyo's local date is ahead of UTC
+		{"08:00", "Asia/Tokyo", "2026-06-01T00:00:00Z", "2026-06-01T23:00:00Z"},
+		{"08:00", "Asia/Tokyo", "2026-05-31T22:00:00Z", "2026-05-31T23:00:00Z"},
+	}
+
+	for _, test := range tests {
+		after, _ := time.Parse(time.RFC3339, test.after)
+		want, _ := time.Parse(time.RFC3339, test.want)
+		schedule := &derpiSchedule{Time: test.time, Timezone: test.timezone}
+
+		got, err := schedule.nextRun(after)
+		if err != nil {
+			t.Errorf("nextRun(%s) for %s %s failed: %v", test.after, test.time, test.timezone, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("nextRun(%s) for %s %s = %s, want %s", test.after, test.time, test.timezone, got.UTC().Format(time.RFC3339), test.want)
+		}
+	}
+}
+
+func TestNextRunErrors(t *testing.T) {
+	tests := []struct {
+		time     string
+		timezone string
+	}{
+		{"08:30", "Local"},
+		{"08:30", "Mars/Olympus_Mons"},
+		{"25:00", "UTC"},
+		{"8.30", "UTC"},
+	}
+
+	for _, test := range tests {
+		schedule := &derpiSchedule{Time: test.time, Timezone: test.timezone}
+		if _, err := schedule.nextRun(time.Now()); err == nil {
+			t.Errorf("nextRun for %s %s should fail", test.time, test.timezone)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Key holding the version of the data layout the database uses
+const schemaVersionKey = "schema:version"
+
+// A change to how data is laid out in the database, run once when upgrading
+// Migrations must only use the store they're given, so a dry run can stop them writing
+type migration struct {
+	version     int    // schema version after this migration; one more than the one before it
+	description string // what it changes, for the log
+	run         func(store Store) error
+}
+
+// Every migration, oldest first; add new ones to the end and never change or remove old ones
+var migrations = []migration{
+	{
+		version:     1,
+		description: "store isBot in user hashes as true/false instead of go-redis's 1/0",
+		run: func(store Store) error {
+			keys, err := store.Keys("user:*")
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				value, err := store.HGet(key, "isBot")
+				if err == ErrNotFound || err == ErrWrongType {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if isBot, err := strconv.ParseBool(value); err == nil && value != strconv.FormatBool(isBot) {
+					err = store.HSet(key, map[string]string{"isBot": strconv.FormatBool(isBot)})
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version:     2,
+		description: "fill in each guild's leaderboard from its members' post counts",
+		run: func(store Store) error {
+			keys, err := store.Keys("guild:*:user:*")
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				// guild:<guild ID>:user:<user ID>, not one of the keys under it
+				parts := strings.Split(key, ":")
+				if len(parts) != 4 {
+					continue
+				}
+				posts, err := store.HGet(key, "posts")
+				if err == ErrNotFound || err == ErrWrongType {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				count, err := strconv.ParseFloat(posts, 64)
+				if err != nil {
+					continue
+				}
+				err = store.ZAdd(guildKey(parts[1], "messages"), parts[3], count)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// The schema version this build of Sunbot expects
+func latestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// Reads the database's schema version
+// A database without one is either brand new, and so already up to date, or from before versions were kept
+func schemaVersion(store Store) (int, error) {
+	value, err := store.Get(schemaVersionKey)
+	if err == ErrNotFound {
+		keys, err := store.Keys("*")
+		if err != nil {
+			return 0, err
+		}
+		if len(keys) == 0 {
+			return latestSchemaVersion(), nil
+		}
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("bad schema version %q in the database", value)
+	}
+	return version, nil
+}
+
+// Brings the database up to date by running each migration it hasn't had yet, in order
+// The version is saved after each one, so a failure leaves the database at the last one that worked
+// With dryRun, nothing is written; the changes each migration would make are printed instead
+func migrate(store Store, dryRun bool) error {
+	version, err := schemaVersion(store)
+	if err != nil {
+		return err
+	}
+	if version > latestSchemaVersion() {
+		return fmt.Errorf("the database is at schema version %d, but this version of Sunbot only knows up to %d; upgrade Sunbot", version, latestSchemaVersion())
+	}
+
+	for _, step := range migrations {
+		if step.version <= version {
+			continue
+		}
+
+		if dryRun {
+			recorder := &dryRunStore{Store: store}
+			err = step.run(recorder)
+			if err != nil {
+				return fmt.Errorf("migration %d would fail: %v", step.version, err)
+			}
+			fmt.Printf("Migration %d (%s) would make %d changes:\n", step.version, step.description, len(recorder.changes))
+			for _, change := range recorder.changes {
+				fmt.Println("  " + change)
+			}
+			// later migrations would see this one's changes, which a dry run can't give them
+			fmt.Println("Later migrations can't be checked until this one has run.")
+			return nil
+		}
+
+		fmt.Printf("Running migration %d: %s\n", step.version, step.description)
+		err = step.run(store)
+		if err != nil {
+			return fmt.Errorf("migration %d failed: %v", step.version, err)
+		}
+		err = store.Set(schemaVersionKey, strconv.Itoa(step.version), 0)
+		if err != nil {
+			return err
+		}
+		version = step.version
+	}
+
+	if dryRun {
+		fmt.Printf("The database is up to date (schema version %d).\n", version)
+		return nil
+	}
+	// new databases get their version written too, so they aren't mistaken for old ones later
+	return store.Set(schemaVersionKey, strconv.Itoa(version), 0)
+}
+
+// Passes reads through to a store but only records writes, for trying migrations out
+type dryRunStore struct {
+	Store
+	changes []string
+}
+
+func (store *dryRunStore) record(format string, args ...interface{}) {
+	store.changes = append(store.changes, fmt.Sprintf(format, args...))
+}
+
+func (store *dryRunStore) Set(key string, value string, ttl time.Duration) error {
+	store.record("SET %s = %q", key, value)
+	return nil
+}
+
+func (store *dryRunStore) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	_, err := store.Store.Type(key)
+	if err == nil {
+		return false, nil
+	}
+	if err != ErrNotFound {
+		return false, err
+	}
+	store.record("SET %s = %q if it doesn't exist", key, value)
+	return true, nil
+}
+
+func (store *dryRunStore) IncrBy(key string, amount int64) (int64, error) {
+	store.record("INCRBY %s %d", key, amount)
+	value, err := store.Store.Get(key)
+	current, _ := strconv.ParseInt(value, 10, 64)
+	if err != nil && err != ErrNotFound {
+		return 0, err
+	}
+	return current + amount, nil
+}
+
+func (store *dryRunStore) Delete(keys ...string) error {
+	for _, key := range keys {
+		store.record("DELETE %s", key)
+	}
+	return nil
+}
+
+func (store *dryRunStore) Expire(key string, ttl time.Duration) error {
+	store.record("EXPIRE %s in %s", key, ttl)
+	return nil
+}
+
+func (store *dryRunStore) HSet(key string, fields map[string]string) error {
+	for field, value := range fields {
+		store.record("HSET %s %s = %q", key, field, value)
+	}
+	return nil
+}
+
+func (store *dryRunStore) HDel(key string, fields ...string) error {
+	for _, field := range fields {
+		store.record("HDEL %s %s", key, field)
+	}
+	return nil
+}
+
+func (store *dryRunStore) HIncrBy(key string, field string, amount int64) (int64, error) {
+	store.record("HINCRBY %s %s %d", key, field, amount)
+	value, err := store.Store.HGet(key, field)
+	current, _ := strconv.ParseInt(value, 10, 64)
+	if err != nil && err != ErrNotFound {
+		return 0, err
+	}
+	return current + amount, nil
+}
+
+func (store *dryRunStore) ZAdd(key string, member string, score float64) error {
+	store.record("ZADD %s %s = %v", key, member, score)
+	return nil
+}
+
+func (store *dryRunStore) ZIncrBy(key string, member string, amount float64) (float64, error) {
+	store.record("ZINCRBY %s %s %v", key, member, amount)
+	current, err := store.Store.ZScore(key, member)
+	if err != nil && err != ErrNotFound {
+		return 0, err
+	}
+	return current + amount, nil
+}
+
+func (store *dryRunStore) ZRem(key string, members ...string) error {
+	for _, member := range members {
+		store.record("ZREM %s %s", key, member)
+	}
+	return nil
+}
+
+// Closing is up to whoever opened the real store
+func (store *dryRunStore) Close() error {
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Per-guild settings that guild admins can change with commands
+// Empty values mean "use the default from the environment"
+type guildSettings struct {
+	Prefix                string                   `json:"prefix,omitempty"`                // command prefix used in this guild
+	SilentUnknownCommands bool                     `json:"silentUnknownCommands,omitempty"` // don't reply to commands that don't exist
+	AutoSourceChannels    []string                 `json:"autoSourceChannels,omitempty"`    // channels where posted images are looked up on Derpibooru (see source.go)
+	Policy                *ratingPolicy            `json:"policy,omitempty"`                // what image searches may show (see policy.go)
+	ChannelPolicies       map[string]*ratingPolicy `json:"channelPolicies,omitempty"`       // channel ID -> overrides for Policy
+	DefaultBooru          string                   `json:"defaultBooru,omitempty"`          // site `.booru` searches when none is given (see imageboard.go)
+	SillyCommands         *bool                    `json:"sillyCommands,omitempty"`         // overrides SILLY_COMMANDS in this guild if set
+	LeftAt                *time.Time               `json:"leftAt,omitempty"`                // when the bot was removed from the guild, if it was (see guilds.go)
+	StatsExcludedChannels []string                 `json:"statsExcludedChannels,omitempty"` // channel IDs whose messages don't count towards stats (see stats.go)
+	Levels                *levelSettings           `json:"levels,omitempty"`                // XP and role rewards (see levels.go)
+}
+
+// Holds the settings for every guild and saves them to a JSON file so they survive restarts
+type settingsStore struct {
+	sync.RWMutex
+	path   string
+	Guilds map[string]*guildSettings `json:"guilds"` // guild ID -> settings
+}
+
+// Loads settings from the given file; a missing file just means nothing has been set yet
+func loadSettings(path string) (*settingsStore, error) {
+	store := &settingsStore{
+		path:   path,
+		Guilds: make(map[string]*guildSettings),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		DebugPrint("No settings file at " + path + "; starting fresh.")
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, store)
+	if err != nil {
+		return nil, err
+	}
+	if store.Guilds == nil {
+		store.Guilds = make(map[string]*guildSettings)
+	}
+
+	return store, nil
+}
+
+// Returns a copy of a guild's settings; guilds with nothing set get the zero value
+func (s *settingsStore) guild(guildID string) guildSettings {
+	s.RLock()
+	defer s.RUnlock()
+
+	if settings, ok := s.Guilds[guildID]; ok {
+		return *settings
+	}
+	return guildSettings{}
+}
+
+// Changes a guild's settings and writes the result to disk
+func (s *settingsStore) update(guildID string, change func(*guildSettings)) error {
+	s.Lock()
+	defer s.Unlock()
+
+	settings, ok := s.Guilds[guildID]
+	if !ok {
+		settings = &guildSettings{}
+		s.Guilds[guildID] = settings
+	}
+	change(settings)
+
+	return s.save()
+}
+
+// Writes all settings to disk; the caller must hold the lock
+func (s *settingsStore) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, data)
+}
+
+// Removes a guild's settings entirely and writes the result to disk
+func (s *settingsStore) remove(guildID string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.Guilds[guildID]; !ok {
+		return nil
+	}
+	delete(s.Guilds, guildID)
+	return s.save()
+}
+
+// Guilds the bot has been removed from, with when it happened
+func (s *settingsStore) leftGuilds() map[string]time.Time {
+	s.RLock()
+	defer s.RUnlock()
+
+	left := make(map[string]time.Time)
+	for guildID, settings := range s.Guilds {
+		if settings.LeftAt != nil {
+			left[guildID] = *settings.LeftAt
+		}
+	}
+	return left
+}
+
+// Whether the silly commands (which don't use the prefix) are on in a guild, falling back to SILLY_COMMANDS
+func sillyCommandsEnabled(guildID string) bool {
+	if guildID != "" {
+		if enabled := settings.guild(guildID).SillyCommands; enabled != nil {
+			return *enabled
+		}
+	}
+	return cfg.SillyCommandsEnabled
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Most matches listed by `.source`
+const maxSourceMatches = 5
+
+// How many earlier messages `.source` looks through for an image when none was given
+const sourceLookback = 10
+
+// How long the message a reply is to stays known; `.source` needs it only while the command runs
+const referenceMemory = 2 * time.Minute
+
+// How long `.source` waits to learn whether its message is a reply, since the raw event may arrive a moment after it
+const referenceWait = time.Second
+
+// Fuzziness used for automatic checks; much stricter than the default, since a wrong guess is worse than none
+const autoSourceFuzziness = 0.1
+
+// Links which look like they point straight at an image
+var imageLink = regexp.MustCompile(`https?://\S+\.(?:png|jpe?g|gif|webp)(?:\?\S*)?`)
+
+// Any link at all; a message with one is taken to already have a source
+var anyLink = regexp.MustCompile(`https?://\S+`)
+
+// Finds images in a message: attachments first, then image links in the text
+func imageURLs(message *discordgo.Message) []string {
+	urls := []string{}
+	for _, attachment := range message.Attachments {
+		// only images have a size
+		if attachment.Width > 0 && attachment.Height > 0 {
+			urls = append(urls, attachment.URL)
+		}
+	}
+	return append(urls, imageLink.FindAllString(message.Content, -1)...)
+}
+
+// Checks a link given to `.source`: a single http or https URL, optionally in <> to stop Discord embedding it
+func parseImageLink(given string) (string, error) {
+	given = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(given), "<"), ">")
+	parsed, err := url.Parse(given)
+	if err != nil || strings.ContainsAny(given, " \t\n") || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", fmt.Errorf("That doesn't look like a link to an image.")
+	}
+	return given, nil
+}
+
+// The message a new message replies to, if any
+type messageReference struct {
+	target string    // ID of the message replied to, or "" if it isn't a reply
+	seen   time.Time // when the new message arrived
+}
+
+// Remembers which message each new message replies to. The Discord library this uses doesn't know about
+// replies, so they're read from the raw events (see onRawEvent)
+type referenceTracker struct {
+	sync.Mutex
+	references map[string]messageReference // message ID -> reference
+}
+
+// Global reference tracker filled by onRawEvent
+var references = &referenceTracker{references: make(map[string]messageReference)}
+
+// Records what a message replies to, forgetting old messages
+func (tracker *referenceTracker) record(messageID string, target string, now time.Time) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	for id, reference := range tracker.references {
+		if now.Sub(reference.seen) > referenceMemory {
+			delete(tracker.references, id)
+		}
+	}
+	tracker.references[messageID] = messageReference{target: target, seen: now}
+}
+
+// Gets the message a message replies to, waiting up to the given time for it to be recorded
+func (tracker *referenceTracker) target(messageID string, wait time.Duration) (string, bool) {
+	deadline := time.Now().Add(wait)
+	for {
+		tracker.Lock()
+		reference, ok := tracker.references[messageID]
+		tracker.Unlock()
+		if ok || !time.Now().Before(deadline) {
+			return reference.target, ok
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Reads a MESSAGE_CREATE event's message ID and the ID of the message it replies to, if any
+func parseMessageReference(raw json.RawMessage) (string, string, error) {
+	message := struct {
+		ID        string `json:"id"`
+		Reference *struct {
+			MessageID string `json:"message_id"`
+		} `json:"message_reference"`
+	}{}
+	err := json.Unmarshal(raw, &message)
+	if err != nil {
+		return "", "", err
+	}
+	if message.Reference == nil {
+		return message.ID, "", nil
+	}
+	return message.ID, message.Reference.MessageID, nil
+}
+
+// Handles raw gateway events, recording which message each new message replies to
+func onRawEvent(session *discordgo.Session, event *discordgo.Event) {
+	if event.Type != "MESSAGE_CREATE" {
+		return
+	}
+
+	messageID, target, err := parseMessageReference(event.RawData)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	references.record(messageID, target, time.Now())
+}
+
+// Finds an image in the message an invocation replies to; the bool says whether it was a reply at all
+func repliedImageURL(session *discordgo.Session, msgEvent *discordgo.MessageCreate) (string, bool, error) {
+	// an edit comes long after its reply was recorded, so there's nothing worth waiting for
+	wait := referenceWait
+	if msgEvent.EditedTimestamp != "" {
+		wait = 0
+	}
+
+	target, _ := references.target(msgEvent.ID, wait)
+	if target == "" {
+		return "", false, nil
+	}
+
+	message, err := session.ChannelMessage(msgEvent.ChannelID, target)
+	if err != nil {
+		// most likely deleted; the recent messages may still have the image
+		fmt.Println(err)
+		return "", false, nil
+	}
+	if urls := imageURLs(message); len(urls) > 0 {
+		return urls[0], true, nil
+	}
+	return "", true, fmt.Errorf("The message you replied to doesn't have an image I can look up.")
+}
+
+// Picks the image `.source` should look up: a URL given as an argument, an image in the invoking message,
+// an image in the message it replies to, or failing those the newest image among the last few messages in the channel
+func sourceImageURL(session *discordgo.Session, given string, msgEvent *discordgo.MessageCreate) (string, error) {
+	if given != "" {
+		return parseImageLink(given)
+	}
+
+	if urls := imageURLs(msgEvent.Message); len(urls) > 0 {
+		return urls[0], nil
+	}
+
+	imageURL, isReply, err := repliedImageURL(session, msgEvent)
+	if isReply {
+		return imageURL, err
+	}
+
+	recent, err := session.ChannelMessages(msgEvent.ChannelID, sourceLookback, msgEvent.ID, "", "")
+	if err != nil {
+		fmt.Println(err)
+		return "", fmt.Errorf("Error reading earlier messages.")
+	}
+	for _, message := range recent {
+		if urls := imageURLs(message); len(urls) > 0 {
+			return urls[0], nil
+		}
+	}
+
+	return "", fmt.Errorf("I couldn't find an image. Attach one, give a link, reply to it, or post it just before using this command.")
+}
+
+// Lists reverse search matches which can be shown in the channel
+func sourceOutput(matches []DerpiImage, channel *discordgo.Channel) *commandOutput {
+	lines := []string{}
+	hidden := 0
+	for _, image := range matches {
+		if !derpiAllowedIn(image, channel) {
+			hidden++
+			continue
+		}
+		if len(lines) == maxSourceMatches {
+			continue
+		}
+
+		line := "**#" + strconv.Itoa(image.ID) + "** " + derpi.PageURL(image.ID)
+		if artists := image.Artists(); len(artists) > 0 {
+			line += " by " + strings.Join(artists, ", ")
+		}
+		if image.SourceURL != "" {
+			line += "\nSource: " + image.SourceURL
+		} else {
+			line += "\nNo source listed."
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) == 0 {
+		if hidden > 0 {
+			return &commandOutput{response: "I found matches, but this channel's image policy doesn't allow showing them."}
+		}
+		return &commandOutput{response: "I couldn't find that image on Derpibooru."}
+	}
+
+	embed := NewEmbed().
+		SetTitle("Possible sources").
+		SetDescription(strings.Join(lines, "\n\n")).
+		SetColor(derpiEmbedColor)
+	if hidden > 0 {
+		embed.SetFooter(strconv.Itoa(hidden) + " more not shown, because of this channel's image policy")
+	}
+	return &commandOutput{embed: embed.Truncate().MessageEmbed}
+}
+
+// Reports whether a channel has opted in to automatic source finding
+func autoSourceEnabled(guildID string, channelID string) bool {
+	for _, id := range settings.guild(guildID).AutoSourceChannels {
+		if id == channelID {
+			return true
+		}
+	}
+	return false
+}
+
+// Looks up images posted without a link in channels which asked for it, replying only for a single close match
+func checkAutoSource(session *discordgo.Session, msgEvent *discordgo.MessageCreate) {
+	defer recoverAndReport(session, "automatic source lookup")
+
+	urls := imageURLs(msgEvent.Message)
+	if len(urls) == 0 || anyLink.MatchString(msgEvent.Content) {
+		return
+	}
+
+	channel, err := GetChannel(session, msgEvent.ChannelID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if !autoSourceEnabled(channel.GuildID, channel.ID) {
+		return
+	}
+
+	// every check is an API call, so a burst of uploads shouldn't become a burst of searches
+	wait, err := limiter.take("autosource:channel:"+channel.ID, 10*time.Second, 3, time.Now())
+	if err != nil || wait > 0 {
+		DebugPrint("Skipping automatic source check; channel is on cooldown.")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DerpiTimeout)
+	defer cancel()
+
+	matches, err := derpi.ReverseSearch(ctx, urls[0], autoSourceFuzziness)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(matches) != 1 || !derpiAllowedIn(matches[0], channel) {
+		DebugPrint("Automatic source check found " + strconv.Itoa(len(matches)) + " matches; staying quiet.")
+		return
+	}
+
+	// angle brackets stop Discord adding previews, keeping the reply small
+	image := matches[0]
+	response := "Found on Derpibooru: <" + derpi.PageURL(image.ID) + ">"
+	if image.SourceURL != "" {
+		response += "\nSource: <" + image.SourceURL + ">"
+	}
+	_, err = session.ChannelMessageSend(channel.ID, response)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
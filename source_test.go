@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseImageLink(t *testing.T) {
+	tests := []struct {
+		given string
+		want  string
+		ok    bool
+	}{
+		{"https://derpicdn.net/img/view/2020/1/1/1.png", "https://derpicdn.net/img/view/2020/1/1/1.png", true},
+		{"http://example.com/image?id=4", "http://example.com/image?id=4", true},
+		{"<https://example.com/a.jpg>", "https://example.com/a.jpg", true},
+		{"  https://example.com/a.jpg  ", "https://example.com/a.jpg", true},
+		{"look at https://example.com/a.jpg", "", false},
+		{"https://example.com/a.jpg please", "", false},
+		{"ftp://example.com/a.jpg", "", false},
+		{"javascript:alert(1)", "", false},
+		{"https://", "", false},
+		{"example.com/a.jpg", "", false},
+		{"not a link", "", false},
+	}
+
+	for _, test := range tests {
+		got, err := parseImageLink(test.given)
+		if test.ok && (err != nil || got != test.want) {
+			t.Errorf("parseImageLink(%q) = %q, %v; want %q", test.given, got, err, test.want)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("parseImageLink(%q) = %q; want an error", test.given, got)
+		}
+	}
+}
+
+func TestParseMessageReference(t *testing.T) {
+	tests := []struct {
+		raw    string
+		id     string
+		target string
+	}{
+		{`{"id": "10", "content": ".source"}`, "10", ""},
+		{`{"id": "11", "content": ".source", "message_reference": {"channel_id": "2", "message_id": "9"}}`, "11", "9"},
+		{`{"id": "12", "message_reference": null}`, "12", ""},
+	}
+
+	for _, test := range tests {
+		id, target, err := parseMessageReference(json.RawMessage(test.raw))
+		if err != nil || id != test.id || target != test.target {
+			t.Errorf("parseMessageReference(%s) = %q, %q, %v; want %q, %q", test.raw, id, target, err, test.id, test.target)
+		}
+	}
+
+	if _, _, err := parseMessageReference(json.RawMessage(`[`)); err == nil {
+		t.Error("parseMessageReference accepted broken JSON")
+	}
+}
+
+func TestReferenceTracker(t *testing.T) {
+	tracker := &referenceTracker{references: make(map[string]messageReference)}
+	now := time.Now()
+
+	tracker.record("1", "", now.Add(-referenceMemory-time.Second))
+	tracker.record("2", "1", now)
+	tracker.record("3", "", now)
+
+	if target, ok := tracker.target("2", 0); !ok || target != "1" {
+		t.Errorf("reply target = %q, %v; want \"1\", true", target, ok)
+	}
+	if target, ok := tracker.target("3", 0); !ok || target != "" {
+		t.Errorf("non-reply target = %q, %v; want \"\", true", target, ok)
+	}
+	if _, ok := tracker.target("1", 0); ok {
+		t.Error("an old message was still remembered")
+	}
+
+	// a reference recorded while waiting is still found
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tracker.record("4", "2", time.Now())
+	}()
+	if target, ok := tracker.target("4", time.Second); !ok || target != "2" {
+		t.Errorf("late reply target = %q, %v; want \"2\", true", target, ok)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Activity is counted per guild, on top of the layout in users.go:
+//   guild:<guild ID>:user:<user ID>            hash of posts, words, attachments and lastPost (unix seconds)
+//   guild:<guild ID>:user:<user ID>:channels   sorted set of channel ID -> messages
+//   guild:<guild ID>:messages                  sorted set of user ID -> messages, for the all-time leaderboard
+//   guild:<guild ID>:day:<YYYY-MM-DD>          sorted set of user ID -> messages that day (UTC), kept for statsHistory
+// Every change is a single increment, so messages arriving at once can't lose each other's counts
+
+// How many days of daily counts are kept, which is as far back as the leaderboard can go
+const statsHistory = 31
+
+// How many days the stats command's histogram shows
+const statsHistogramDays = 14
+
+// How many people the leaderboard shows
+const leaderboardSize = 10
+
+// Periods the leaderboard can cover, in days; 0 is all time
+var leaderboardPeriods = map[string]int{
+	"day":   1,
+	"week":  7,
+	"month": 30,
+	"all":   0,
+}
+
+// Key of the sorted set counting a guild's messages per user for one day
+func dayKey(guildID string, day time.Time) string {
+	return guildKey(guildID, "day", day.UTC().Format("2006-01-02"))
+}
+
+// Counts a message towards its author's stats and XP, unless it's in a DM or a channel the guild doesn't track
+func recordMessage(session *discordgo.Session, msgEvent *discordgo.MessageCreate) {
+	defer recoverAndReport(session, "counting a message")
+
+	if db == nil || msgEvent.Author == nil || msgEvent.Author.Bot {
+		return
+	}
+
+	channel, err := GetChannel(session, msgEvent.ChannelID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if channel.GuildID == "" || statsExcluded(channel.GuildID, channel.ID) {
+		return
+	}
+
+	err = recordPost(channel.GuildID, channel.ID, msgEvent.Author, len(strings.Fields(msgEvent.Content)), len(msgEvent.Attachments))
+	if err != nil {
+		fmt.Println("Database error counting a post: " + err.Error())
+	}
+
+	// XP goes by the same rules about what counts (see levels.go)
+	err = awardXP(session, msgEvent, channel)
+	if err != nil {
+		fmt.Println("Database error giving XP: " + err.Error())
+	}
+}
+
+// Counts a message from a user in a guild's channel, adding them to the database if they're new
+func recordPost(guildID string, channelID string, user *discordgo.User, words int, attachments int) error {
+	err := db.HSet(userKey(user.ID), map[string]string{
+		"username": user.Username,
+		"isBot":    strconv.FormatBool(user.Bot),
+	})
+	if err != nil {
+		return err
+	}
+
+	member := memberKey(guildID, user.ID)
+	_, err = db.HIncrBy(member, "posts", 1)
+	if err == nil && words > 0 {
+		_, err = db.HIncrBy(member, "words", int64(words))
+	}
+	if err == nil && attachments > 0 {
+		_, err = db.HIncrBy(member, "attachments", int64(attachments))
+	}
+	if err == nil {
+		err = db.HSet(member, map[string]string{"lastPost": strconv.FormatInt(time.Now().Unix(), 10)})
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ZIncrBy(member+":channels", channelID, 1)
+	if err != nil {
+		return err
+	}
+	_, err = db.ZIncrBy(guildKey(guildID, "messages"), user.ID, 1)
+	if err != nil {
+		return err
+	}
+
+	today := dayKey(guildID, time.Now())
+	_, err = db.ZIncrBy(today, user.ID, 1)
+	if err != nil {
+		return err
+	}
+	return db.Expire(today, statsHistory*24*time.Hour)
+}
+
+// Whether a guild has turned off counting messages in a channel
+func statsExcluded(guildID string, channelID string) bool {
+	for _, excluded := range settings.guild(guildID).StatsExcludedChannels {
+		if excluded == channelID {
+			return true
+		}
+	}
+	return false
+}
+
+// Pulls a channel ID out of a #channel mention, or returns a bare ID as it is
+func parseChannelMention(text string) (string, bool) {
+	text = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(text), "<#"), ">")
+	if _, err := strconv.ParseUint(text, 10, 64); err != nil {
+		return "", false
+	}
+	return text, true
+}
+
+// Reads a number stored in a hash, treating anything missing or unreadable as 0
+func fieldInt(fields map[string]string, name string) int64 {
+	value, _ := strconv.ParseInt(fields[name], 10, 64)
+	return value
+}
+
+// Builds the stats embed for a user in a guild, or returns ErrNotFound if they haven't posted there
+func statsOutput(guildID string, user *discordgo.User) (*discordgo.MessageEmbed, error) {
+	fields, err := getMember(guildID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	posts := fieldInt(fields, "posts")
+	words := fieldInt(fields, "words")
+
+	embed := NewEmbed().
+		SetTitle("Stats for "+user.Username).
+		SetThumbnail(user.AvatarURL("128")).
+		AddField("Messages", strconv.FormatInt(posts, 10)).
+		AddField("Words", strconv.FormatInt(words, 10)).
+		AddField("Attachments", strconv.FormatInt(fieldInt(fields, "attachments"), 10))
+	if posts > 0 {
+		embed.AddField("Words per message", strconv.FormatFloat(float64(words)/float64(posts), 'f', 1, 64))
+	}
+
+	rank, err := db.ZRank(guildKey(guildID, "messages"), user.ID, true)
+	if err == nil {
+		total, err := db.ZCard(guildKey(guildID, "messages"))
+		if err != nil {
+			return nil, err
+		}
+		embed.AddField("Rank", "#"+strconv.FormatInt(rank+1, 10)+" of "+strconv.FormatInt(total, 10))
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+	embed.InlineAllFields()
+
+	channels, err := db.ZRange(memberKey(guildID, user.ID)+":channels", 0, 4, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(channels) > 0 {
+		lines := []string{}
+		for _, channel := range channels {
+			lines = append(lines, "<#"+channel.Member+"> "+strconv.FormatFloat(channel.Score, 'f', 0, 64))
+		}
+		embed.AddField("Top channels", strings.Join(lines, "\n"))
+	}
+
+	histogram, err := statsHistogram(guildID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	embed.AddField("Last "+strconv.Itoa(statsHistogramDays)+" days (UTC)", histogram)
+
+	if lastPost := fieldInt(fields, "lastPost"); lastPost > 0 {
+		embed.SetFooter("Last message " + time.Unix(lastPost, 0).UTC().Format("2 Jan 2006 15:04") + " UTC")
+	}
+
+	return embed.Truncate().MessageEmbed, nil
+}
+
+// Draws a user's messages per day as a bar chart, oldest first
+func statsHistogram(guildID string, userID string) (string, error) {
+	const width = 20
+
+	now := time.Now().UTC()
+	counts := make([]float64, statsHistogramDays)
+	highest := 0.0
+	for i := range counts {
+		day := now.AddDate(0, 0, i-statsHistogramDays+1)
+		count, err := db.ZScore(dayKey(guildID, day), userID)
+		if err != nil && err != ErrNotFound {
+			return "", err
+		}
+		counts[i] = count
+		if count > highest {
+			highest = count
+		}
+	}
+
+	lines := []string{}
+	for i, count := range counts {
+		day := now.AddDate(0, 0, i-statsHistogramDays+1)
+		bar := 0
+		if highest > 0 {
+			bar = int(count * width / highest)
+		}
+		if bar == 0 && count > 0 {
+			bar = 1
+		}
+		lines = append(lines, day.Format("Jan 02")+" "+strings.Repeat("█", bar)+" "+strconv.FormatFloat(count, 'f', 0, 64))
+	}
+	return "```\n" + strings.Join(lines, "\n") + "\n```", nil
+}
+
+// The most active users in a guild over a period (see leaderboardPeriods), most messages first
+func leaderboard(guildID string, days int) ([]ScoredMember, error) {
+	if days == 0 {
+		return db.ZRange(guildKey(guildID, "messages"), 0, leaderboardSize-1, true)
+	}
+
+	// add up each day's counts
+	totals := make(map[string]float64)
+	now := time.Now()
+	for i := 0; i < days; i++ {
+		members, err := db.ZRange(dayKey(guildID, now.AddDate(0, 0, -i)), 0, -1, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			totals[member.Member] += member.Score
+		}
+	}
+
+	summed := &storeEntry{ZSet: totals}
+	top := sortedMembers(summed, true)
+	if len(top) > leaderboardSize {
+		top = top[:leaderboardSize]
+	}
+	return top, nil
+}
+
+// Builds the leaderboard embed for a guild
+func leaderboardOutput(guildID string, period string) (*discordgo.MessageEmbed, error) {
+	top, err := leaderboard(guildID, leaderboardPeriods[period])
+	if err != nil {
+		return nil, err
+	}
+
+	titles := map[string]string{
+		"day":   "Most active today",
+		"week":  "Most active in the last week",
+		"month": "Most active in the last month",
+		"all":   "Most active of all time",
+	}
+	embed := NewEmbed().SetTitle(titles[period])
+	if len(top) == 0 {
+		return embed.SetDescription("Nobody has said anything yet!").MessageEmbed, nil
+	}
+
+	lines := []string{}
+	for i, member := range top {
+		name, err := db.HGet(userKey(member.Member), "username")
+		if err == ErrNotFound {
+			name = "<@" + member.Member + ">"
+		} else if err != nil {
+			return nil, err
+		}
+		messages := " messages"
+		if member.Score == 1 {
+			messages = " message"
+		}
+		lines = append(lines, "**"+strconv.Itoa(i+1)+".** "+name+" - "+strconv.FormatFloat(member.Score, 'f', 0, 64)+messages)
+	}
+	if period != "all" {
+		embed.SetFooter("Days are counted in UTC")
+	}
+	return embed.SetDescription(strings.Join(lines, "\n")).Truncate().MessageEmbed, nil
+}
+
+// Turns counting messages in a channel on or off; the caller checks permissions
+func setStatsExcluded(guildID string, channelID string, excluded bool) error {
+	return settings.update(guildID, func(guild *guildSettings) {
+		kept := []string{}
+		for _, id := range guild.StatsExcludedChannels {
+			if id != channelID {
+				kept = append(kept, id)
+			}
+		}
+		if excluded {
+			kept = append(kept, channelID)
+		}
+		guild.StatsExcludedChannels = kept
+		if len(kept) == 0 {
+			guild.StatsExcludedChannels = nil
+		}
+	})
+}
+
+// Lists the channels a guild doesn't count messages in
+func excludedChannelsOutput(guildID string) *commandOutput {
+	excluded := settings.guild(guildID).StatsExcludedChannels
+	if len(excluded) == 0 {
+		return &commandOutput{response: "Messages are counted in every channel here."}
+	}
+
+	mentions := []string{}
+	for _, channelID := range excluded {
+		mentions = append(mentions, "<#"+channelID+">")
+	}
+	return &commandOutput{response: "Messages aren't counted in: " + strings.Join(mentions, ", ")}
+}
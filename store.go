@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Store is where data which has to outlive the bot is kept, like user post counts
+// Every method is safe to use from several goroutines at once, and the Incr methods are atomic
+type Store interface {
+	// Get returns a key's value, or ErrNotFound
+	Get(key string) (string, error)
+	// Set sets a key's value; a ttl of 0 keeps it forever
+	Set(key string, value string, ttl time.Duration) error
+	// SetNX sets a key's value and ttl in one step, but only if the key doesn't exist, reporting whether it did
+	SetNX(key string, value string, ttl time.Duration) (bool, error)
+	// IncrBy adds to a key's integer value, starting from 0, and returns the result
+	IncrBy(key string, amount int64) (int64, error)
+	// Delete removes keys of any kind; missing keys are ignored
+	Delete(keys ...string) error
+	// Expire sets how long until a key is removed; a ttl of 0 keeps it forever
+	Expire(key string, ttl time.Duration) error
+	// TTL returns how long until a key is removed, 0 if it's kept forever, or ErrNotFound
+	TTL(key string) (time.Duration, error)
+	// Keys lists the keys matching a glob pattern like "user:*", in no particular order
+	Keys(pattern string) ([]string, error)
+	// Type returns the kind of value a key holds (storeString, storeHash or storeZSet), or ErrNotFound
+	Type(key string) (string, error)
+
+	// HGet returns one field of a hash, or ErrNotFound
+	HGet(key string, field string) (string, error)
+	// HGetAll returns every field of a hash; a missing hash gives an empty map
+	HGetAll(key string) (map[string]string, error)
+	// HSet sets fields of a hash, leaving the others alone
+	HSet(key string, fields map[string]string) error
+	// HDel removes fields from a hash
+	HDel(key string, fields ...string) error
+	// HIncrBy adds to a hash field's integer value, starting from 0, and returns the result
+	HIncrBy(key string, field string, amount int64) (int64, error)
+
+	// ZAdd sets a member's score in a sorted set
+	ZAdd(key string, member string, score float64) error
+	// ZIncrBy adds to a member's score, starting from 0, and returns the result
+	ZIncrBy(key string, member string, amount float64) (float64, error)
+	// ZScore returns a member's score, or ErrNotFound
+	ZScore(key string, member string) (float64, error)
+	// ZRank returns a member's position, starting at 0 for the lowest score (or highest if reverse), or ErrNotFound
+	ZRank(key string, member string, reverse bool) (int64, error)
+	// ZRange returns members from start to stop inclusive, lowest score first (or highest if reverse)
+	// Negative positions count back from the end, so 0, -1 is everything
+	ZRange(key string, start int64, stop int64, reverse bool) ([]ScoredMember, error)
+	// ZCard returns how many members a sorted set has
+	ZCard(key string) (int64, error)
+	// ZRem removes members from a sorted set
+	ZRem(key string, members ...string) error
+
+	// Close saves anything outstanding and releases connections
+	Close() error
+}
+
+// ScoredMember is a member of a sorted set along with its score
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// ErrNotFound is returned when a key, field or member doesn't exist
+var ErrNotFound = errors.New("not found in the database")
+
+// ErrWrongType is returned when a key holds a different kind of value, like using a hash as a sorted set
+var ErrWrongType = errors.New("database key holds the wrong kind of value")
+
+// Value for DATABASE_FILE which keeps everything in memory, which is lost when the bot stops
+const memoryStorePath = ":memory:"
+
+// Connects to whichever store is configured: Redis if REDIS_URL is set, otherwise the DATABASE_FILE
+// Returns nil without an error if neither is set, in which case commands which need a database are turned off
+func initStore() (Store, error) {
+	if cfg.RedisURL != "" {
+		store, err := newRedisStore(cfg.RedisURL, cfg.RedisPassword)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to Redis at %s: %v", cfg.RedisURL, err)
+		}
+		DebugPrint("Using Redis at " + cfg.RedisURL)
+		return store, nil
+	}
+
+	if cfg.DatabaseFile == memoryStorePath {
+		DebugPrint("Using an in-memory database; nothing will be saved.")
+		return newMemoryStore(), nil
+	}
+
+	if cfg.DatabaseFile != "" {
+		store, err := newFileStore(cfg.DatabaseFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the database from %s: %v", cfg.DatabaseFile, err)
+		}
+		DebugPrint("Using the database file " + cfg.DatabaseFile)
+		return store, nil
+	}
+
+	DebugPrint("No database configured; commands which need one are disabled.")
+	return nil, nil
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Runs the same tests against every Store backend, so they all behave like Redis does
+// Redis is only tested when SUNBOT_TEST_REDIS_URL is set; the tests keep to keys under a random prefix and remove them after
+func TestStores(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testStore(t, newMemoryStore(), "")
+	})
+
+	t.Run("file", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "sunbot-store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		store, err := newFileStore(filepath.Join(dir, "db.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		testStore(t, store, "")
+	})
+
+	t.Run("redis", func(t *testing.T) {
+		address := os.Getenv("SUNBOT_TEST_REDIS_URL")
+		if address == "" {
+			t.Skip("SUNBOT_TEST_REDIS_URL isn't set")
+		}
+		store, err := newRedisStore(address, os.Getenv("SUNBOT_TEST_REDIS_PASSWORD"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+
+		prefix := fmt.Sprintf("sunbot-test:%06x:", rand.Intn(0x1000000))
+		defer func() {
+			keys, _ := store.Keys(prefix + "*")
+			if len(keys) > 0 {
+				store.Delete(keys...)
+			}
+		}()
+		testStore(t, store, prefix)
+	})
+}
+
+func testStore(t *testing.T, store Store, prefix string) {
+	key := func(name string) string {
+		return prefix + name
+	}
+	sortedKeys := func(pattern string) []string {
+		keys, err := store.Keys(prefix + pattern)
+		if err != nil {
+			t.Fatalf("Keys(%q) failed: %v", pattern, err)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	t.Run("strings", func(t *testing.T) {
+		if _, err := store.Get(key("missing")); err != ErrNotFound {
+			t.Errorf("Get of a missing key gave %v, want ErrNotFound", err)
+		}
+		if err := store.Set(key("s"), "hello", 0); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := store.Get(key("s")); err != nil || value != "hello" {
+			t.Errorf("Get = %q, %v; want hello", value, err)
+		}
+		if kind, err := store.Type(key("s")); err != nil || kind != storeString {
+			t.Errorf("Type = %q, %v; want %q", kind, err, storeString)
+		}
+		if _, err := store.Type(key("missing")); err != ErrNotFound {
+			t.Errorf("Type of a missing key gave %v, want ErrNotFound", err)
+		}
+
+		if value, err := store.IncrBy(key("counter"), 5); err != nil || value != 5 {
+			t.Errorf("IncrBy from nothing = %d, %v; want 5", value, err)
+		}
+		if value, err := store.IncrBy(key("counter"), -2); err != nil || value != 3 {
+			t.Errorf("IncrBy = %d, %v; want 3", value, err)
+		}
+		if _, err := store.IncrBy(key("s"), 1); err == nil {
+			t.Errorf("IncrBy of a string that isn't a number should fail")
+		}
+
+		if set, err := store.SetNX(key("once"), "first", time.Hour); err != nil || !set {
+			t.Errorf("SetNX of a missing key = %v, %v; want true", set, err)
+		}
+		if set, err := store.SetNX(key("once"), "second", time.Hour); err != nil || set {
+			t.Errorf("SetNX of an existing key = %v, %v; want false", set, err)
+		}
+		if set, err := store.SetNX(key("s"), "other", 0); err != nil || set {
+			t.Errorf("SetNX of a key set by Set = %v, %v; want false", set, err)
+		}
+		if value, err := store.Get(key("once")); err != nil || value != "first" {
+			t.Errorf("Get after SetNX = %q, %v; want first", value, err)
+		}
+		if ttl, err := store.TTL(key("once")); err != nil || ttl <= 0 || ttl > time.Hour {
+			t.Errorf("TTL after SetNX = %v, %v; want up to an hour", ttl, err)
+		}
+
+		if err := store.Delete(key("s"), key("counter"), key("once"), key("missing")); err != nil {
+			t.Fatal(err)
+		}
+		if keys := sortedKeys("*"); len(keys) != 0 {
+			t.Errorf("keys left after Delete: %v", keys)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		if _, err := store.TTL(key("missing")); err != ErrNotFound {
+			t.Errorf("TTL of a missing key gave %v, want ErrNotFound", err)
+		}
+
+		store.Set(key("forever"), "x", 0)
+		if ttl, err := store.TTL(key("forever")); err != nil || ttl != 0 {
+			t.Errorf("TTL of a key without expiry = %v, %v; want 0", ttl, err)
+		}
+
+		store.Set(key("hour"), "x", time.Hour)
+		if ttl, err := store.TTL(key("hour")); err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+			t.Errorf("TTL = %v, %v; want just under an hour", ttl, err)
+		}
+		if err := store.Expire(key("hour"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if ttl, err := store.TTL(key("hour")); err != nil || ttl != 0 {
+			t.Errorf("TTL after Expire(0) = %v, %v; want 0", ttl, err)
+		}
+		if err := store.Expire(key("missing"), time.Hour); err != ErrNotFound {
+			t.Errorf("Expire of a missing key gave %v, want ErrNotFound", err)
+		}
+
+		store.Set(key("short"), "x", 50*time.Millisecond)
+		store.SetNX(key("shortnx"), "x", 50*time.Millisecond)
+		store.HSet(key("shorthash"), map[string]string{"a": "1"})
+		store.Expire(key("shorthash"), 50*time.Millisecond)
+		time.Sleep(150 * time.Millisecond)
+		if _, err := store.Get(key("short")); err != ErrNotFound {
+			t.Errorf("Get of an expired key gave %v, want ErrNotFound", err)
+		}
+		if fields, err := store.HGetAll(key("shorthash")); err != nil || len(fields) != 0 {
+			t.Errorf("HGetAll of an expired hash = %v, %v; want nothing", fields, err)
+		}
+		// once it's gone, it can be set again
+		if set, err := store.SetNX(key("shortnx"), "y", 0); err != nil || !set {
+			t.Errorf("SetNX of an expired key = %v, %v; want true", set, err)
+		}
+		store.Delete(key("shortnx"))
+		if keys := sortedKeys("*"); !reflect.DeepEqual(keys, []string{key("forever"), key("hour")}) {
+			t.Errorf("Keys after expiry = %v", keys)
+		}
+
+		store.Delete(key("forever"), key("hour"))
+	})
+
+	t.Run("hashes", func(t *testing.T) {
+		if fields, err := store.HGetAll(key("missing")); err != nil || len(fields) != 0 {
+			t.Errorf("HGetAll of a missing hash = %v, %v; want an empty map", fields, err)
+		}
+		if _, err := store.HGet(key("h"), "a"); err != ErrNotFound {
+			t.Errorf("HGet of a missing hash gave %v, want ErrNotFound", err)
+		}
+
+		store.HSet(key("h"), map[string]string{"a": "1", "b": "2"})
+		store.HSet(key("h"), map[string]string{"b": "3"})
+		if fields, err := store.HGetAll(key("h")); err != nil || !reflect.DeepEqual(fields, map[string]string{"a": "1", "b": "3"}) {
+			t.Errorf("HGetAll = %v, %v", fields, err)
+		}
+		if _, err := store.HGet(key("h"), "c"); err != ErrNotFound {
+			t.Errorf("HGet of a missing field gave %v, want ErrNotFound", err)
+		}
+		if value, err := store.HIncrBy(key("h"), "c", 4); err != nil || value != 4 {
+			t.Errorf("HIncrBy from nothing = %d, %v; want 4", value, err)
+		}
+		if kind, err := store.Type(key("h")); err != nil || kind != storeHash {
+			t.Errorf("Type = %q, %v; want %q", kind, err, storeHash)
+		}
+
+		// a hash with no fields left doesn't exist any more
+		store.HDel(key("h"), "a", "b", "c")
+		if _, err := store.Type(key("h")); err != ErrNotFound {
+			t.Errorf("Type of an emptied hash gave %v, want ErrNotFound", err)
+		}
+		if keys := sortedKeys("*"); len(keys) != 0 {
+			t.Errorf("keys left after emptying a hash: %v", keys)
+		}
+	})
+
+	t.Run("sorted sets", func(t *testing.T) {
+		if members, err := store.ZRange(key("missing"), 0, -1, false); err != nil || len(members) != 0 {
+			t.Errorf("ZRange of a missing set = %v, %v; want nothing", members, err)
+		}
+		if count, err := store.ZCard(key("missing")); err != nil || count != 0 {
+			t.Errorf("ZCard of a missing set = %d, %v; want 0", count, err)
+		}
+
+		// b and c tie, so they're ordered by name
+		store.ZAdd(key("z"), "c", 2)
+		store.ZAdd(key("z"), "a", 1)
+		store.ZAdd(key("z"), "b", 2)
+		store.ZAdd(key("z"), "d", 5)
+		if score, err := store.ZIncrBy(key("z"), "a", 2.5); err != nil || score != 3.5 {
+			t.Errorf("ZIncrBy = %v, %v; want 3.5", score, err)
+		}
+		if score, err := store.ZScore(key("z"), "d"); err != nil || score != 5 {
+			t.Errorf("ZScore = %v, %v; want 5", score, err)
+		}
+		if _, err := store.ZScore(key("z"), "e"); err != ErrNotFound {
+			t.Errorf("ZScore of a missing member gave %v, want ErrNotFound", err)
+		}
+
+		members := func(scored []ScoredMember) []string {
+			names := []string{}
+			for _, member := range scored {
+				names = append(names, member.Member)
+			}
+			return names
+		}
+		ranges := []struct {
+			start, stop int64
+			reverse     bool
+			want        []string
+		}{
+			{0, -1, false, []string{"b", "c", "a", "d"}},
+			{0, -1, true, []string{"d", "a", "c", "b"}},
+			{1, 2, false, []string{"c", "a"}},
+			{-2, -1, false, []string{"a", "d"}},
+			{-1, -1, true, []string{"b"}},
+			{-10, 0, false, []string{"b"}},
+			{2, 100, false, []string{"a", "d"}},
+			{3, 1, false, []string{}},
+			{10, 20, false, []string{}},
+		}
+		for _, test := range ranges {
+			got, err := store.ZRange(key("z"), test.start, test.stop, test.reverse)
+			if err != nil || !reflect.DeepEqual(members(got), test.want) {
+				t.Errorf("ZRange(%d, %d, reverse %v) = %v, %v; want %v", test.start, test.stop, test.reverse, members(got), err, test.want)
+			}
+		}
+		if got, _ := store.ZRange(key("z"), 0, 0, true); len(got) != 1 || got[0].Score != 5 {
+			t.Errorf("ZRange scores = %v, want d at 5", got)
+		}
+
+		if rank, err := store.ZRank(key("z"), "a", false); err != nil || rank != 2 {
+			t.Errorf("ZRank = %d, %v; want 2", rank, err)
+		}
+		if rank, err := store.ZRank(key("z"), "a", true); err != nil || rank != 1 {
+			t.Errorf("reverse ZRank = %d, %v; want 1", rank, err)
+		}
+		if _, err := store.ZRank(key("z"), "e", false); err != ErrNotFound {
+			t.Errorf("ZRank of a missing member gave %v, want ErrNotFound", err)
+		}
+		if count, err := store.ZCard(key("z")); err != nil || count != 4 {
+			t.Errorf("ZCard = %d, %v; want 4", count, err)
+		}
+		if kind, err := store.Type(key("z")); err != nil || kind != storeZSet {
+			t.Errorf("Type = %q, %v; want %q", kind, err, storeZSet)
+		}
+
+		// a sorted set with no members left doesn't exist any more
+		store.ZRem(key("z"), "a", "b", "c", "d")
+		if _, err := store.Type(key("z")); err != ErrNotFound {
+			t.Errorf("Type of an emptied sorted set gave %v, want ErrNotFound", err)
+		}
+		if keys := sortedKeys("*"); len(keys) != 0 {
+			t.Errorf("keys left after emptying a sorted set: %v", keys)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		store.Set(key("s"), "x", 0)
+		store.HSet(key("h"), map[string]string{"a": "1"})
+		store.ZAdd(key("z"), "a", 1)
+		defer store.Delete(key("s"), key("h"), key("z"))
+
+		checks := []struct {
+			name string
+			err  error
+		}{
+			{"Get of a hash", errOnly(store.Get(key("h")))},
+			{"HGet of a string", errOnly(store.HGet(key("s"), "a"))},
+			{"HGetAll of a sorted set", errOnly(store.HGetAll(key("z")))},
+			{"HSet of a string", store.HSet(key("s"), map[string]string{"a": "1"})},
+			{"HIncrBy of a sorted set", errOnly(store.HIncrBy(key("z"), "a", 1))},
+			{"IncrBy of a hash", errOnly(store.IncrBy(key("h"), 1))},
+			{"ZAdd of a hash", store.ZAdd(key("h"), "a", 1)},
+			{"ZIncrBy of a string", errOnly(store.ZIncrBy(key("s"), "a", 1))},
+			{"ZScore of a hash", errOnly(store.ZScore(key("h"), "a"))},
+			{"ZRange of a string", errOnly(store.ZRange(key("s"), 0, -1, false))},
+			{"ZCard of a hash", errOnly(store.ZCard(key("h")))},
+		}
+		for _, check := range checks {
+			if check.err != ErrWrongType {
+				t.Errorf("%s gave %v, want ErrWrongType", check.name, check.err)
+			}
+		}
+
+		// Set replaces whatever was there
+		if err := store.Set(key("h"), "y", 0); err != nil {
+			t.Errorf("Set over a hash failed: %v", err)
+		}
+	})
+
+	t.Run("keys", func(t *testing.T) {
+		store.Set(key("user:1"), "x", 0)
+		store.Set(key("user:2"), "x", 0)
+		store.Set(key("guild:1:user:1"), "x", 0)
+		defer store.Delete(key("user:1"), key("user:2"), key("guild:1:user:1"))
+
+		if keys := sortedKeys("user:*"); !reflect.DeepEqual(keys, []string{key("user:1"), key("user:2")}) {
+			t.Errorf("Keys(user:*) = %v", keys)
+		}
+		if keys := sortedKeys("guild:*:user:*"); !reflect.DeepEqual(keys, []string{key("guild:1:user:1")}) {
+			t.Errorf("Keys(guild:*:user:*) = %v", keys)
+		}
+	})
+}
+
+// Drops the value from a store call so only its error is checked
+func errOnly(_ interface{}, err error) error {
+	return err
+}
+
+// The file store keeps everything across restarts, except keys which expire in the meantime
+func TestFileStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sunbot-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db.json")
+
+	store, err := newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set("kept", "x", 0)
+	store.Set("expiring", "x", 50*time.Millisecond)
+	store.HSet("hash", map[string]string{"a": "1"})
+	store.ZAdd("zset", "a", 2)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	reloaded, err := newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+
+	keys, _ := reloaded.Keys("*")
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"hash", "kept", "zset"}) {
+		t.Errorf("keys after reloading = %v", keys)
+	}
+	if score, err := reloaded.ZScore("zset", "a"); err != nil || score != 2 {
+		t.Errorf("ZScore after reloading = %v, %v; want 2", score, err)
+	}
+}
+
+// A dry run answers as the real store would but writes nothing
+func TestDryRunStoreSetNX(t *testing.T) {
+	store := newMemoryStore()
+	store.Set("taken", "x", 0)
+	recorder := &dryRunStore{Store: store}
+
+	if set, err := recorder.SetNX("taken", "y", time.Hour); err != nil || set {
+		t.Errorf("SetNX of an existing key = %v, %v; want false", set, err)
+	}
+	if set, err := recorder.SetNX("free", "y", time.Hour); err != nil || !set {
+		t.Errorf("SetNX of a missing key = %v, %v; want true", set, err)
+	}
+	if _, err := store.Get("free"); err != ErrNotFound {
+		t.Errorf("the dry run wrote to the store: %v", err)
+	}
+	if len(recorder.changes) != 1 {
+		t.Errorf("recorded changes = %q, want one", recorder.changes)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"sort"
+	"strings"
+)
+
+// Most suggestions offered for a mistyped command
+const maxSuggestions = 3
+
+// Finds verbs which look like what the user meant to type, closest first
+// Only verbs for commands the user can actually run are suggested
+func suggestVerbs(session *discordgo.Session, input string, userID string, channel *discordgo.Channel) []string {
+	type candidate struct {
+		verb     string
+		distance int
+	}
+
+	input = strings.ToLower(input)
+	candidates := []candidate{}
+	seen := make(map[*command]bool)
+
+	for verb := range commands {
+		distance := levenshtein(input, verb)
+
+		// typing the start of a verb (".derp") counts as close, however much is missing
+		if strings.HasPrefix(verb, input) && len(input) >= 2 {
+			distance = 1
+		}
+
+		// allow roughly one mistake for every three letters
+		limit := len(verb) / 3
+		if limit < 1 {
+			limit = 1
+		}
+		if distance > limit {
+			continue
+		}
+
+		candidates = append(candidates, candidate{verb: verb, distance: distance})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].verb < candidates[j].verb
+	})
+
+	suggestions := []string{}
+	for _, c := range candidates {
+		cmd := commands[c.verb]
+		// several verbs can point to the same command; only suggest it once
+		if seen[cmd] || !canRun(session, cmd, userID, channel) {
+			continue
+		}
+		seen[cmd] = true
+		suggestions = append(suggestions, c.verb)
+		if len(suggestions) == maxSuggestions {
+			break
+		}
+	}
+	return suggestions
+}
+
+// Number of single-letter edits needed to turn one string into another
+func levenshtein(a string, b string) int {
+	first := []rune(a)
+	second := []rune(b)
+
+	previous := make([]int, len(second)+1)
+	current := make([]int, len(second)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(first); i++ {
+		current[0] = i
+		for j := 1; j <= len(second); j++ {
+			cost := 1
+			if first[i-1] == second[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(second)]
+}
+
+// Smallest of the given integers
+func minInt(first int, rest ...int) int {
+	min := first
+	for _, value := range rest {
+		if value < min {
+			min = value
+		}
+	}
+	return min
+}
+
+// Finds commands whose name, description or verbs contain every given word
+func searchCommands(commandList []*command, query string) []*command {
+	words := strings.Fields(strings.ToLower(query))
+	results := []*command{}
+
+	for _, cmd := range commandList {
+		text := strings.ToLower(cmd.name + " " + cmd.description + " " + cmd.category + " " + strings.Join(cmd.verbs, " "))
+		matches := true
+		for _, word := range words {
+			if !strings.Contains(text, word) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			results = append(results, cmd)
+		}
+	}
+	return results
+}
+
+// A "did you mean" hint for a mistyped verb, or nothing if no command looks close
+func didYouMean(session *discordgo.Session, input string, prefix string, userID string, channel *discordgo.Channel) string {
+	suggestions := suggestVerbs(session, input, userID, channel)
+	if len(suggestions) == 0 {
+		return ""
+	}
+
+	for i, verb := range suggestions {
+		suggestions[i] = "`" + prefix + verb + "`"
+	}
+	return "\nDid you mean " + strings.Join(suggestions, " or ") + "?"
+}
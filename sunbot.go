@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/bwmarrin/discordgo"
 	"github.com/caarlos0/env"
@@ -18,25 +19,43 @@ const (
 
 // Environment variables
 type config struct {
-	DiscordAuthToken     string `env:"DISCORD_AUTH_TOKEN,required"`      // environment variable DISCORD_AUTH_TOKEN
-	DefaultPrefix        string `env:"COMMAND_PREFIX" envDefault:"."`    // environment variable COMMAND_PREFIX
-	DebugEnabled         bool   `env:"DEBUG_OUTPUT" envDefault:"true"`   // environment variable DEBUG_OUTPUT
-	SillyCommandsEnabled bool   `env:"SILLY_COMMANDS" envDefault:"true"` // environment variable SILLY_COMMANDS
-	/*
-	RedisURL             string `env:"REDIS_URL" envDefault:""`          // environment variable REDIS_URL
-	RedisPassword        string `env:"REDIS_PASSWORD" envDefault:""`     // environment variable REDIS_PASSWORD
-	*/
-	DerpiApiKey          string `env:"DERPIBOORU_API_KEY" envDefault:""` // environment variable DERPIBOORU_API_KEY
+	DiscordAuthToken     string        `env:"DISCORD_AUTH_TOKEN"`                                   // environment variable DISCORD_AUTH_TOKEN
+	DefaultPrefix        string        `env:"COMMAND_PREFIX" envDefault:"."`                        // environment variable COMMAND_PREFIX
+	DebugEnabled         bool          `env:"DEBUG_OUTPUT" envDefault:"true"`                       // environment variable DEBUG_OUTPUT
+	SillyCommandsEnabled bool          `env:"SILLY_COMMANDS" envDefault:"true"`                     // environment variable SILLY_COMMANDS
+	RedisURL             string        `env:"REDIS_URL" envDefault:""`                              // environment variable REDIS_URL
+	RedisPassword        string        `env:"REDIS_PASSWORD" envDefault:""`                         // environment variable REDIS_PASSWORD
+	DatabaseFile         string        `env:"DATABASE_FILE" envDefault:""`                          // environment variable DATABASE_FILE
+	LegacyDataGuild      string        `env:"LEGACY_DATA_GUILD" envDefault:""`                      // environment variable LEGACY_DATA_GUILD
+	GuildDataRetention   time.Duration `env:"GUILD_DATA_RETENTION" envDefault:"0"`                  // environment variable GUILD_DATA_RETENTION
+	XPCooldown           time.Duration `env:"XP_COOLDOWN" envDefault:"1m"`                          // environment variable XP_COOLDOWN
+	XPMin                int           `env:"XP_MIN" envDefault:"15"`                               // environment variable XP_MIN
+	XPMax                int           `env:"XP_MAX" envDefault:"25"`                               // environment variable XP_MAX
+	DerpiApiKey          string        `env:"DERPIBOORU_API_KEY" envDefault:""`                     // environment variable DERPIBOORU_API_KEY
+	DerpiURL             string        `env:"DERPIBOORU_URL" envDefault:"https://derpibooru.org"`   // environment variable DERPIBOORU_URL
+	DerpiTimeout         time.Duration `env:"DERPIBOORU_TIMEOUT" envDefault:"10s"`                  // environment variable DERPIBOORU_TIMEOUT
+	DerpiCacheTTL        time.Duration `env:"DERPIBOORU_CACHE_TTL" envDefault:"5m"`                 // environment variable DERPIBOORU_CACHE_TTL
+	DerpiCacheSize       int           `env:"DERPIBOORU_CACHE_SIZE" envDefault:"500"`               // environment variable DERPIBOORU_CACHE_SIZE
+	DerpiWatchFile       string        `env:"DERPIBOORU_WATCH_FILE" envDefault:"watches.json"`      // environment variable DERPIBOORU_WATCH_FILE
+	DerpiWatchInterval   time.Duration `env:"DERPIBOORU_WATCH_INTERVAL" envDefault:"5m"`            // environment variable DERPIBOORU_WATCH_INTERVAL
+	DerpiScheduleFile    string        `env:"DERPIBOORU_SCHEDULE_FILE" envDefault:"schedules.json"` // environment variable DERPIBOORU_SCHEDULE_FILE
+	DerpiLinkPreviews    bool          `env:"DERPIBOORU_LINK_PREVIEWS" envDefault:"true"`           // environment variable DERPIBOORU_LINK_PREVIEWS
+	DerpiTagCacheTTL     time.Duration `env:"DERPIBOORU_TAG_CACHE_TTL" envDefault:"1h"`             // environment variable DERPIBOORU_TAG_CACHE_TTL
+	OwnerLogChannel      string        `env:"OWNER_LOG_CHANNEL" envDefault:""`                      // environment variable OWNER_LOG_CHANNEL
+	SettingsFile         string        `env:"SETTINGS_FILE" envDefault:"settings.json"`             // environment variable SETTINGS_FILE
+	BotOwners            []string      `env:"BOT_OWNERS" envDefault:""`                             // environment variable BOT_OWNERS (comma-separated user IDs)
+	CooldownFile         string        `env:"COOLDOWN_FILE" envDefault:""`                          // environment variable COOLDOWN_FILE
+	UserRateLimit        int           `env:"USER_RATE_LIMIT" envDefault:"10"`                      // environment variable USER_RATE_LIMIT
+	UserRatePeriod       time.Duration `env:"USER_RATE_PERIOD" envDefault:"1m"`                     // environment variable USER_RATE_PERIOD
 }
 
 // Global variables
 var (
 	commands     map[string]*command // verb string -> command object (see commands.go)
 	cfg          config
-	/*
-	client       *redis.Client
-	redisEnabled bool
-	*/
+	settings     *settingsStore // per-guild settings (see settings.go)
+	derpi        *DerpiClient   // Derpibooru API client (see derpibooru.go)
+	db           Store          // persistent storage, nil if no database is set up (see store.go)
 )
 
 func init() {
@@ -53,31 +72,85 @@ func main() {
 		return
 	}
 
-	/*
-	if cfg.RedisURL != "" {
-		// default, is changed later
-		redisEnabled = false
-		// init redis
-		client = redis.NewClient(&redis.Options{
-			Addr:     cfg.RedisURL,
-			Password: cfg.RedisPassword,
-			DB:       0, // use default DB
-		})
+	// subcommands can write backups to stdout, so keep debug output out of it
+	if len(os.Args) > 1 {
+		cfg.DebugEnabled = false
+	}
 
-		pong, err := client.Ping().Result()
-		fmt.Println("Connecting to Redis...\n"+cfg.RedisURL+"\n"+pong, err) // Output: PONG <nil>
+	// connect to the database, if there is one
+	db, err = initStore()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-		// tell user if db didn't connect
-		if err != nil {
-			fmt.Println("Error connecting to Redis.")
-		} else {
-			// for later checks; less typing than checking if cfg.RedisURL is empty
-			redisEnabled = true
+	DebugPrint("Default command prefix: " + cfg.DefaultPrefix)
+
+	// load per-guild settings
+	settings, err = loadSettings(cfg.SettingsFile)
+	if err != nil {
+		fmt.Println("Error loading settings from " + cfg.SettingsFile + "\n" + err.Error())
+		return
+	}
+
+	// set up command cooldowns
+	err = initCooldowns()
+	if err != nil {
+		fmt.Println("Error loading cooldowns from " + cfg.CooldownFile + "\n" + err.Error())
+		return
+	}
+
+	// Derpibooru client used by image commands
+	derpi = NewDerpiClient(cfg.DerpiURL, cfg.DerpiApiKey, cfg.DerpiTimeout)
+	derpi.Cache = initDerpiCache()
+
+	// image boards searched by the booru command (see imageboard.go)
+	initBoards()
+
+	// Derpibooru subscriptions
+	err = initWatches()
+	if err != nil {
+		fmt.Println("Error loading Derpibooru watches from " + cfg.DerpiWatchFile + "\n" + err.Error())
+		return
+	}
+
+	// daily image posts
+	err = initSchedules()
+	if err != nil {
+		fmt.Println("Error loading daily posts from " + cfg.DerpiScheduleFile + "\n" + err.Error())
+		return
+	}
+
+	// maintenance subcommands like `sunbot export` run instead of the bot (see tools.go)
+	if len(os.Args) > 1 {
+		found, err := runTool(os.Args[1], os.Args[2:])
+		if !found {
+			fmt.Println("Unknown command " + os.Args[1] + "; expected migrate, export or import.")
+		} else if err != nil && err != flag.ErrHelp {
+			fmt.Println(err)
+		}
+		if db != nil {
+			err = db.Close()
+			if err != nil {
+				fmt.Println(err)
+			}
 		}
+		return
+	}
+
+	if cfg.DiscordAuthToken == "" {
+		fmt.Println("DISCORD_AUTH_TOKEN isn't set.\nPlease check https://github.com/techniponi/sunbot for details.")
+		return
 	}
-	*/
 
-	DebugPrint("Command prefix: " + cfg.DefaultPrefix)
+	// bring the database up to date (see schema.go)
+	if db != nil {
+		err = migrate(db, false)
+		if err != nil {
+			fmt.Println("Error migrating the database\n" + err.Error())
+			return
+		}
+	}
 
 	// Initialize commands
 	commands = initCommands()
@@ -90,8 +163,19 @@ func main() {
 		return
 	}
 
-	// message handler
+	// message handlers
 	discord.AddHandler(parseChatMessage)
+	discord.AddHandler(parseEditedMessage)
+	discord.AddHandler(parseDeletedMessage)
+	discord.AddHandler(parseReaction)
+
+	// replies, which the Discord library doesn't parse (see source.go)
+	discord.AddHandler(onRawEvent)
+
+	// joining and leaving guilds (see guilds.go)
+	discord.AddHandler(onReady)
+	discord.AddHandler(onGuildCreate)
+	discord.AddHandler(onGuildDelete)
 
 	// Open a websocket connection to Discord and begin listening.
 	err = discord.Open()
@@ -100,6 +184,18 @@ func main() {
 		return
 	}
 
+	// owner-only commands need to know who the owner is
+	loadBotOwners(discord)
+
+	// post new uploads for Derpibooru watches
+	startWatchPoller(discord)
+
+	// make daily image posts when they're due
+	startScheduler(discord)
+
+	// delete the data of guilds the bot left long enough ago
+	startGuildDataSweeper()
+
 	// Wait here until CTRL-C or other term signal is received.
 	fmt.Println("Sunbot is now running.  Press CTRL-C to exit.")
 	sc := make(chan os.Signal, 1)
@@ -109,13 +205,27 @@ func main() {
 	// Cleanly close down the Discord session.
 	discord.Close()
 
+	// save anything the database hasn't yet
+	if db != nil {
+		err = db.Close()
+		if err != nil {
+			fmt.Println("Error closing the database: " + err.Error())
+		}
+	}
+
 }
 
 // Called any time a message is sent
 func parseChatMessage(discordSession *discordgo.Session, msgEvent *discordgo.MessageCreate) {
+	defer recoverAndReport(discordSession, "the message handler")
 
 	if len(msgEvent.Content) == 0 {
 		DebugPrint("Message received; did not contain text.")
+		// images posted on their own may still need a source (see source.go)
+		if !msgEvent.Author.Bot {
+			checkAutoSource(discordSession, msgEvent)
+			recordMessage(discordSession, msgEvent)
+		}
 		return
 	}
 
@@ -135,47 +245,49 @@ func parseChatMessage(discordSession *discordgo.Session, msgEvent *discordgo.Mes
 
 	}
 
-	// Did the message start with the command prefix?
-	if msg[:1] == cfg.DefaultPrefix {
-
-		DebugPrint("Message starts with the command prefix.")
+	messageChannel, err := GetChannel(discordSession, msgEvent.ChannelID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-		// prepare variables to parse command
-		args := strings.Split(msg[1:], " ")
-		cmdInput := args[0]
-		args = append(args[:0], args[1:]...)
+	// each guild can have its own prefix
+	prefix := guildPrefix(messageChannel.GuildID)
 
-		if cmd, ok := commands[cmdInput]; ok {
-			DebugPrint("Command is valid.")
-			messageChannel, _ := discordSession.Channel(msgEvent.ChannelID)
+	// Did the message start with the command prefix (or a mention)?
+	if commandText, ok := stripPrefix(msg, prefix, discordSession.State.User.ID); ok {
 
-			discordSession.ChannelTyping(msgEvent.ChannelID)
+		DebugPrint("Message starts with the command prefix.")
 
-			output := cmd.function(args, messageChannel, msgEvent, discordSession)
-			if output.file == nil {
-				discordSession.ChannelMessageSend(msgEvent.ChannelID, output.response)
+		output := runCommandText(discordSession, msgEvent, messageChannel, prefix, commandText, false)
+		if output == nil {
+			DebugPrint("Command had no output.")
+			// still remembered, so fixing the command by editing it works
+			replies.track(msgEvent.Message, nil)
+			return
+		}
 
-				if output.embed != nil {
-					DebugPrint("Command contains embed; sending")
-					discordSession.ChannelMessageSendEmbed(msgEvent.ChannelID, output.embed)
-				}
-			} else {
-				DebugPrint("Response contains image, uploading now")
-				discordSession.ChannelFileSend(msgEvent.ChannelID, "image.png", output.file)
-			}
-		} else {
-			DebugPrint("Command is not valid.")
-			if msg[:3] == cfg.DefaultPrefix+cfg.DefaultPrefix+cfg.DefaultPrefix {
-				// ignore; probably not intended to be a command
-			} else {
-				discordSession.ChannelMessageSend(msgEvent.ChannelID, "I don't understand that command. Use `"+cfg.DefaultPrefix+"help` if you're confused!")
-			}
+		sent, err := sendOutput(discordSession, output, msgEvent.ChannelID, msgEvent.Author.ID)
+		if err != nil {
+			fmt.Println("Error sending command output")
+			fmt.Println(err)
 		}
 
+		// remember the reply so editing or deleting the command can update it (see replies.go)
+		replies.track(msgEvent.Message, sent)
+
 	} else {
 		DebugPrint("Message is not a command.")
 
-		if cfg.SillyCommandsEnabled {
+		// show info for pasted Derpibooru links (see derpilinks.go)
+		if cfg.DerpiLinkPreviews {
+			expandDerpiLinks(discordSession, msgEvent, messageChannel)
+		}
+
+		// look up images posted without a source, where enabled (see source.go)
+		checkAutoSource(discordSession, msgEvent)
+
+		if sillyCommandsEnabled(messageChannel.GuildID) {
 
 			switch msg {
 			case "h":
@@ -192,55 +304,66 @@ func parseChatMessage(discordSession *discordgo.Session, msgEvent *discordgo.Mes
 
 		}
 
-		/*
-		// only execute if database is connected
-		if redisEnabled {
+		// count posts in servers, if there's a database (see stats.go)
+		recordMessage(discordSession, msgEvent)
 
-			DebugPrint("Checking if user exists in database...")
-			// check if user is in database yet
-			userDb, err := GetUser(msgEvent.Author, true) // create new user if it doesn't exist
-			if err != nil {
-				// some unknown error
-				fmt.Println("Database error, see log.")
-				fmt.Println(err)
-			} else {
-				DebugPrint("User does exist.")
-				DebugPrint(userDb.String())
-
-				postCount := 0
-
-				// increase total posts by one
-				if userDb.Val()["posts"] != "" {
-					postCount, _ = strconv.Atoi(userDb.Val()["posts"])
-					postCount++
-				} else {
-					postCount = 1
-				}
-
-				// actually set the user
-				_, err := SetUser(msgEvent.Author, map[string]interface{}{
-					"posts": strconv.Itoa(postCount),
-				})
-
-				if err != nil {
-					if err == redis.Nil {
-						// Create the user. This code theoretically should not ever be run, but it's here.
-						DebugPrint("somehow, a user existed a moment ago and now it doesn't. Creating it anyway...? (check your database?)")
-						_, err := CreateUser(msgEvent.Author)
-						if err != nil {
-							fmt.Println("Database error, see log.")
-							fmt.Println(err)
-						}
-					} else {
-						fmt.Println("Database error, see log.")
-						fmt.Println(err)
-					}
-				}
+	}
 
-			}
+}
+
+// Works out which command some text invokes and runs it, returning what to reply with
+// The text has already had the prefix removed; an edited command only runs again if it doesn't change anything
+func runCommandText(discordSession *discordgo.Session, msgEvent *discordgo.MessageCreate, messageChannel *discordgo.Channel, prefix string, commandText string, edited bool) *commandOutput {
+
+	// split into words, respecting quotes
+	tokens, err := tokenize(commandText)
+	if err != nil {
+		return &commandOutput{response: err.Error()}
+	}
+	if len(tokens) == 0 {
+		DebugPrint("Message was only the prefix.")
+		return nil
+	}
+	cmdInput := tokens[0].text
+
+	cmd, ok := commands[cmdInput]
+	if !ok {
+		DebugPrint("Command is not valid.")
+		if messageChannel.GuildID != "" && settings.guild(messageChannel.GuildID).SilentUnknownCommands {
+			return nil
 		}
-		*/
+		return &commandOutput{response: "I don't understand that command." + didYouMean(discordSession, cmdInput, prefix, msgEvent.Author.ID, messageChannel) + "\nUse `" + prefix + "help` if you're confused!"}
+	}
+	DebugPrint("Command is valid.")
+
+	// validate arguments against the command's schema before running anything
+	args, err := parseArgs(cmd, tokens[1:])
+	if err != nil {
+		DebugPrint("Arguments were invalid: " + err.Error())
+		return &commandOutput{response: err.Error() + "\nUsage: `" + prefix + cmd.usage() + "`"}
+	}
 
+	// an edit of a command which changes something would make the change again
+	if edited && !rerunsOnEdit(cmd, args) {
+		DebugPrint("Edited command isn't re-run, since it may change something.")
+		return nil
 	}
 
+	inv := &invocation{
+		session:  discordSession,
+		msgEvent: msgEvent,
+		channel:  messageChannel,
+		cmd:      cmd,
+		verb:     cmdInput,
+		args:     args,
+		prefix:   prefix,
+		started:  time.Now(),
+	}
+
+	// run the command through the middleware chain (see middleware.go)
+	output, err := commandPipeline()(inv)
+	if err != nil {
+		return reportCommandError(inv, err)
+	}
+	return output
 }
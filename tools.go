@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Maintenance subcommands, run instead of the bot as `sunbot <command> [options]`
+var tools = map[string]func(args []string) error{
+	"migrate": migrateTool,
+	"export":  exportTool,
+	"import":  importTool,
+}
+
+// Runs a maintenance subcommand; settings, watches, daily posts and the database must already be loaded
+// Returns false if there's no such subcommand
+func runTool(name string, args []string) (bool, error) {
+	tool, ok := tools[name]
+	if !ok {
+		return false, nil
+	}
+	return true, tool(args)
+}
+
+// Prints what a subcommand takes when it's used wrong or with -h
+func toolFlags(name string, usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: sunbot %s %s\n", name, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// sunbot migrate [-dry-run]
+func migrateTool(args []string) error {
+	flags := toolFlags("migrate", "[-dry-run]")
+	dryRun := flags.Bool("dry-run", false, "print what each migration, and moving old post counts, would change without changing anything")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if db == nil {
+		return fmt.Errorf("no database is set up (see REDIS_URL and DATABASE_FILE)")
+	}
+	err = migrate(db, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	// post counts from before they were kept per server can move here too, if LEGACY_DATA_GUILD says where
+	if !*dryRun {
+		return migrateLegacyUsers(db, nil)
+	}
+	recorder := &dryRunStore{Store: db}
+	err = migrateLegacyUsers(recorder, nil)
+	if err != nil {
+		return err
+	}
+	if len(recorder.changes) > 0 {
+		fmt.Printf("Moving old post counts would make %d changes:\n", len(recorder.changes))
+		for _, change := range recorder.changes {
+			fmt.Println("  " + change)
+		}
+	}
+	return nil
+}
+
+// sunbot export [-guild ID] [file]
+func exportTool(args []string) error {
+	flags := toolFlags("export", "[-guild ID] [file]")
+	guildID := flags.String("guild", "", "only export this guild")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	output := io.Writer(os.Stdout)
+	if flags.NArg() > 0 {
+		file, err := os.Create(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+	}
+
+	err = exportData(db, *guildID, output)
+	if err == nil && flags.NArg() > 0 {
+		fmt.Println("Exported to " + flags.Arg(0))
+	}
+	return err
+}
+
+// sunbot import -offline [-guild ID] [file]
+// A running bot keeps the settings, watches and daily posts in memory and would write its own copy over the
+// import the next time it saved, so -offline is required to confirm it's stopped
+func importTool(args []string) error {
+	flags := toolFlags("import", "-offline [-guild ID] [file]")
+	guildID := flags.String("guild", "", "only import this guild from the backup")
+	offline := flags.Bool("offline", false, "confirm the bot isn't running; required, since a running bot would overwrite the import")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if !*offline {
+		flags.Usage()
+		return fmt.Errorf("stop the bot before importing, then run this again with -offline; a running bot would overwrite the imported settings, watches and daily posts")
+	}
+
+	input := io.Reader(os.Stdin)
+	if flags.NArg() > 0 {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	return importData(db, *guildID, input)
+}
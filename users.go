@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Data is split by scope so one instance can serve many guilds without mixing them up:
+//   user:<user ID>                      details which are the same everywhere, like username
+//   guild:<guild ID>:user:<user ID>     what a user has done in one guild, like post counts (see stats.go)
+//   guild:<guild ID>:...                anything else belonging to a guild
+// Everything under guild:<guild ID>: is deleted along with the guild's data (see guilds.go)
+
+// Key of the hash holding a user's details which don't depend on the guild
+func userKey(userID string) string {
+	return "user:" + userID
+}
+
+// Key for something belonging to a guild, like guildKey(id, "user", userID)
+func guildKey(guildID string, parts ...string) string {
+	return "guild:" + guildID + ":" + strings.Join(parts, ":")
+}
+
+// Key of the hash holding what a user has done in one guild
+func memberKey(guildID string, userID string) string {
+	return guildKey(guildID, "user", userID)
+}
+
+// Gets a user's stored fields in a guild, along with their global ones, or ErrNotFound if they haven't been seen there
+func getMember(guildID string, userID string) (map[string]string, error) {
+	fields, err := db.HGetAll(memberKey(guildID, userID))
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrNotFound
+	}
+
+	global, err := db.HGetAll(userKey(userID))
+	if err != nil {
+		return nil, err
+	}
+	for field, value := range global {
+		// the guild's value wins if both have one
+		if _, ok := fields[field]; !ok {
+			fields[field] = value
+		}
+	}
+	return fields, nil
+}
+
+// Fields on an old user:<id> hash recording how far moving its post count has got, since the Store can't change
+// several keys at once; a move that failed part way carries on where it stopped instead of counting posts twice
+const (
+	legacyMoveGuild = "legacyMoveGuild" // guild the count is going to, so changing LEGACY_DATA_GUILD can't split it
+	legacyMoveStep  = "legacyMoveStep"  // "counted" once the member's posts include it, "ranked" once the leaderboard does
+)
+
+// Moves post counts from the old layout, where user:<id> held them for every guild at once, into one guild
+// The old layout can't say which guild a post was in, so this only happens automatically when the bot is in a
+// single guild; otherwise LEGACY_DATA_GUILD says where they go
+// Each user's count is removed from the old key once it's moved, so running this again does nothing; only a crash
+// between an increment and recording it can still count one user's posts twice
+func migrateLegacyUsers(store Store, guildIDs []string) error {
+	keys, err := store.Keys(userKey("*"))
+	if err != nil {
+		return err
+	}
+
+	target := cfg.LegacyDataGuild
+	if target == "" && len(guildIDs) == 1 {
+		target = guildIDs[0]
+	}
+
+	moved := 0
+	for _, key := range keys {
+		fields, err := store.HGetAll(key)
+		if err == ErrWrongType {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		posts, ok := fields["posts"]
+		if !ok {
+			continue
+		}
+		count, err := strconv.ParseInt(posts, 10, 64)
+		if err != nil {
+			return fmt.Errorf("moving %s: bad post count %q", key, posts)
+		}
+		userID := strings.TrimPrefix(key, userKey(""))
+
+		guildID := fields[legacyMoveGuild]
+		if guildID == "" {
+			guildID = target
+		}
+		if guildID == "" {
+			fmt.Println("The database has post counts from before they were kept per server, and I can't tell which server they belong to.")
+			fmt.Println("Set LEGACY_DATA_GUILD to that server's ID, then restart or run `sunbot migrate` to move them there.")
+			return nil
+		}
+
+		step := fields[legacyMoveStep]
+		if step == "" {
+			err = store.HSet(key, map[string]string{legacyMoveGuild: guildID})
+			if err == nil {
+				_, err = store.HIncrBy(memberKey(guildID, userID), "posts", count)
+			}
+			if err == nil {
+				err = store.HSet(key, map[string]string{legacyMoveStep: "counted"})
+			}
+			if err != nil {
+				return fmt.Errorf("moving %s: %v", key, err)
+			}
+			step = "counted"
+		}
+		if step == "counted" {
+			_, err = store.ZIncrBy(guildKey(guildID, "messages"), userID, float64(count))
+			if err == nil {
+				err = store.HSet(key, map[string]string{legacyMoveStep: "ranked"})
+			}
+			if err != nil {
+				return fmt.Errorf("moving %s: %v", key, err)
+			}
+		}
+
+		err = store.HDel(key, "posts", legacyMoveGuild, legacyMoveStep)
+		if err != nil {
+			return err
+		}
+		moved++
+	}
+
+	if moved > 0 {
+		fmt.Println("Moved the post counts of " + strconv.Itoa(moved) + " users to their server.")
+	}
+	return nil
+}
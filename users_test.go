@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// Fails the first ZIncrBy, like a connection dropping half way through moving a user
+type flakyZIncrStore struct {
+	Store
+	failed bool
+}
+
+func (store *flakyZIncrStore) ZIncrBy(key string, member string, amount float64) (float64, error) {
+	if !store.failed {
+		store.failed = true
+		return 0, errors.New("connection reset")
+	}
+	return store.Store.ZIncrBy(key, member, amount)
+}
+
+func TestMigrateLegacyUsers(t *testing.T) {
+	store := newMemoryStore()
+	store.HSet(userKey("1"), map[string]string{"username": "a", "posts": "7"})
+	store.HSet(userKey("2"), map[string]string{"username": "b", "posts": "3"})
+	store.HSet(userKey("3"), map[string]string{"username": "c"})
+	store.HSet(memberKey("10", "1"), map[string]string{"posts": "2"})
+	store.ZAdd(guildKey("10", "messages"), "1", 2)
+
+	// the first run stops part way, and the next ones must not count anything twice
+	if err := migrateLegacyUsers(&flakyZIncrStore{Store: store}, []string{"10"}); err == nil {
+		t.Fatal("the first run should have failed")
+	}
+	for run := 0; run < 2; run++ {
+		if err := migrateLegacyUsers(store, []string{"10"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		userID   string
+		posts    string
+		messages float64
+	}{
+		{"1", "9", 9},
+		{"2", "3", 3},
+	}
+	for _, test := range tests {
+		if posts, _ := store.HGet(memberKey("10", test.userID), "posts"); posts != test.posts {
+			t.Errorf("user %s has %s posts, want %s", test.userID, posts, test.posts)
+		}
+		if messages, _ := store.ZScore(guildKey("10", "messages"), test.userID); messages != test.messages {
+			t.Errorf("user %s has %v on the leaderboard, want %v", test.userID, messages, test.messages)
+		}
+		fields, _ := store.HGetAll(userKey(test.userID))
+		for _, field := range []string{"posts", legacyMoveGuild, legacyMoveStep} {
+			if _, ok := fields[field]; ok {
+				t.Errorf("user %s still has %s", test.userID, field)
+			}
+		}
+	}
+	if _, err := store.Type(memberKey("10", "3")); err != ErrNotFound {
+		t.Errorf("a user without old posts was given some")
+	}
+}
+
+// With several guilds and no LEGACY_DATA_GUILD, nothing moves
+func TestMigrateLegacyUsersNeedsGuild(t *testing.T) {
+	store := newMemoryStore()
+	store.HSet(userKey("1"), map[string]string{"posts": "7"})
+
+	if err := migrateLegacyUsers(store, []string{"10", "20"}); err != nil {
+		t.Fatal(err)
+	}
+	if posts, _ := store.HGet(userKey("1"), "posts"); posts != "7" {
+		t.Errorf("old posts = %q, want them left alone", posts)
+	}
+	if keys, _ := store.Keys("guild:*"); len(keys) != 0 {
+		t.Errorf("keys made: %v", keys)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Most subscriptions one guild can have, so a single server can't keep the poller busy
+const maxWatchesPerGuild = 10
+
+// Most new images posted for one subscription per poll; the rest are skipped rather than flooding the channel
+const maxWatchPosts = 5
+
+// Longest a failing subscription waits between attempts
+const maxWatchBackoff = time.Hour
+
+// A Derpibooru query whose new uploads are posted to a channel
+type derpiWatch struct {
+	ID         int       `json:"id"`         // number shown to users, unique across all guilds
+	GuildID    string    `json:"guildID"`    // guild the channel belongs to
+	ChannelID  string    `json:"channelID"`  // channel new images are posted to
+	Query      string    `json:"query"`      // query as typed; the channel's policy is added when polling
+	CreatedBy  string    `json:"createdBy"`  // user ID of whoever set it up
+	LastSeenID int       `json:"lastSeenID"` // highest image ID already handled, so restarts don't repost
+	failures   int       // errors in a row, for backing off
+	nextPoll   time.Time // don't poll before this
+}
+
+// The item methods listStore needs
+func (watch *derpiWatch) itemID() int       { return watch.ID }
+func (watch *derpiWatch) setItemID(id int)  { watch.ID = id }
+func (watch *derpiWatch) itemGuild() string { return watch.GuildID }
+
+// Holds every subscription and saves them to a JSON file so they survive restarts
+type watchStore struct {
+	*listStore[derpiWatch, *derpiWatch]
+}
+
+// Global subscription store (see initWatches)
+var watches *watchStore
+
+// Loads subscriptions from the given file; a missing file just means there aren't any yet
+func loadWatches(path string) (*watchStore, error) {
+	list, err := loadListStore[derpiWatch](path, "watches")
+	if err != nil {
+		return nil, err
+	}
+	return &watchStore{list}, nil
+}
+
+// Copies of the subscriptions due to be polled
+func (store *watchStore) due(now time.Time) []derpiWatch {
+	store.Lock()
+	defer store.Unlock()
+
+	list := []derpiWatch{}
+	for _, watch := range store.items {
+		if !now.Before(watch.nextPoll) {
+			list = append(list, *watch)
+		}
+	}
+	return list
+}
+
+// Records the result of polling a subscription; it may have been removed in the meantime
+func (store *watchStore) finishPoll(id int, lastSeenID int, pollErr error) {
+	store.Lock()
+	defer store.Unlock()
+
+	for _, watch := range store.items {
+		if watch.ID != id {
+			continue
+		}
+
+		// anything posted before an error still counts as seen
+		if lastSeenID > watch.LastSeenID {
+			watch.LastSeenID = lastSeenID
+			err := store.save()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+
+		if pollErr != nil {
+			// wait twice as long after each error in a row
+			watch.failures++
+			backoff := cfg.DerpiWatchInterval << uint(minInt(watch.failures, 10))
+			if backoff > maxWatchBackoff || backoff <= 0 {
+				backoff = maxWatchBackoff
+			}
+			watch.nextPoll = time.Now().Add(backoff)
+			DebugPrint("Watch #" + strconv.Itoa(id) + " failed; retrying in " + backoff.String())
+			return
+		}
+
+		watch.failures = 0
+		watch.nextPoll = time.Now().Add(cfg.DerpiWatchInterval)
+		return
+	}
+}
+
+// Loads subscriptions; polling starts once connected (see startWatchPoller)
+func initWatches() error {
+	var err error
+	watches, err = loadWatches(cfg.DerpiWatchFile)
+	return err
+}
+
+// Polls subscriptions in the background for as long as the bot runs
+func startWatchPoller(session *discordgo.Session) {
+	if cfg.DerpiWatchInterval <= 0 {
+		DebugPrint("Derpibooru watches disabled.")
+		return
+	}
+
+	go func() {
+		// check often enough to notice backoffs ending, but each watch is only polled once per interval
+		tick := time.Minute
+		if cfg.DerpiWatchInterval < tick {
+			tick = cfg.DerpiWatchInterval
+		}
+		for range time.Tick(tick) {
+			for _, watch := range watches.due(time.Now()) {
+				pollDueWatch(session, watch)
+			}
+		}
+	}()
+}
+
+// Polls one subscription and records how it went; a panic counts as a failed poll, so the watch backs off
+func pollDueWatch(session *discordgo.Session, watch derpiWatch) {
+	lastSeenID, err := watch.LastSeenID, errors.New("polling panicked")
+	defer func() {
+		watches.finishPoll(watch.ID, lastSeenID, err)
+	}()
+	defer recoverAndReport(session, "Derpibooru watch #"+strconv.Itoa(watch.ID))
+
+	lastSeenID, err = pollWatch(session, watch)
+	if err != nil {
+		fmt.Println("Error polling Derpibooru watch #" + strconv.Itoa(watch.ID) + ": " + err.Error())
+	}
+}
+
+// Searches for the newest uploads matching a query, skipping the cache and using the policy's filter if it has one
+func searchNewUploads(policy effectivePolicy, query string) (DerpiResults, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DerpiTimeout)
+	defer cancel()
+
+	return derpi.Search(ctx, DerpiSearchOptions{
+		Query:         query,
+		SortField:     DerpiSortCreated,
+		SortDirection: "desc",
+		FilterID:      policy.filter(0),
+		NoCache:       true,
+	})
+}
+
+// Posts a subscription's new images, returning the highest image ID seen
+func pollWatch(session *discordgo.Session, watch derpiWatch) (int, error) {
+	channel, err := GetChannel(session, watch.ChannelID)
+	if err != nil {
+		return watch.LastSeenID, err
+	}
+
+	// the channel's policy applies to the query and to each image (see policy.go)
+	policy := channelPolicy(channel)
+	query, err := policy.query(watch.Query)
+	if err != nil {
+		return watch.LastSeenID, err
+	}
+	results, err := searchNewUploads(policy, query)
+	if err != nil {
+		return watch.LastSeenID, err
+	}
+
+	newImages := []DerpiImage{}
+	highest := watch.LastSeenID
+	for _, image := range results.Search {
+		allowed, _ := policy.allows(image)
+		if image.ID > watch.LastSeenID && allowed {
+			newImages = append(newImages, image)
+		}
+		if image.ID > highest {
+			highest = image.ID
+		}
+	}
+	if len(newImages) == 0 {
+		return highest, nil
+	}
+
+	// post in upload order, keeping only the newest few
+	sort.Slice(newImages, func(i, j int) bool {
+		return newImages[i].ID < newImages[j].ID
+	})
+	if len(newImages) > maxWatchPosts {
+		DebugPrint("Watch #" + strconv.Itoa(watch.ID) + " skipped " + strconv.Itoa(len(newImages)-maxWatchPosts) + " images")
+		newImages = newImages[len(newImages)-maxWatchPosts:]
+	}
+
+	posted := watch.LastSeenID
+	for _, image := range newImages {
+		output := derpiImageOutput(image, "New upload for: "+watch.Query+" • watch #"+strconv.Itoa(watch.ID))
+		_, err := sendOutput(session, output, watch.ChannelID, "")
+		if err != nil {
+			// the channel may be gone or we can't post there; retry from the first image that didn't make it
+			return posted, err
+		}
+		posted = image.ID
+	}
+
+	return highest, nil
+}
+
+// Handles `.derpi watch`, `.derpi unwatch` and `.derpi watches`
+func derpiWatchCommand(subcommand string, rest string, channel *discordgo.Channel, msgEvent *discordgo.MessageCreate, session *discordgo.Session) *commandOutput {
+	if channel.GuildID == "" {
+		return &commandOutput{response: "Watches can only be used in a server."}
+	}
+
+	if subcommand == "watches" {
+		return listWatches(channel.GuildID)
+	}
+
+	if denied := requirePermission(session, msgEvent, channel, discordgo.PermissionManageChannels, "change watches"); denied != nil {
+		return denied
+	}
+
+	if subcommand == "unwatch" {
+		id, err := strconv.Atoi(strings.TrimPrefix(rest, "#"))
+		if err != nil {
+			return &commandOutput{response: "Which watch? Use its number from `derpi watches`, like `derpi unwatch 3`."}
+		}
+		removed, err := watches.remove(channel.GuildID, id)
+		if err != nil {
+			fmt.Println(err)
+			return &commandOutput{response: "Error saving watches"}
+		}
+		if !removed {
+			return &commandOutput{response: "There's no watch #" + strconv.Itoa(id) + " in this server."}
+		}
+		return &commandOutput{response: "Done! Watch #" + strconv.Itoa(id) + " removed."}
+	}
+
+	// watch
+	if rest == "" {
+		return &commandOutput{response: "What should I watch for? Give a query, like `derpi watch artist:foo, safe`."}
+	}
+	if len(watches.forGuild(channel.GuildID)) >= maxWatchesPerGuild {
+		return &commandOutput{response: "This server already has " + strconv.Itoa(maxWatchesPerGuild) + " watches; remove one first."}
+	}
+
+	// start from the newest existing image, so only future uploads are posted
+	policy := channelPolicy(channel)
+	query, err := policy.query(rest)
+	if err != nil {
+		return &commandOutput{response: describeQueryError(err, rest)}
+	}
+	results, err := searchNewUploads(policy, query)
+	if err != nil {
+		fmt.Println(err)
+		return &commandOutput{response: "Error: " + err.Error()}
+	}
+	lastSeenID := 0
+	for _, image := range results.Search {
+		if image.ID > lastSeenID {
+			lastSeenID = image.ID
+		}
+	}
+
+	watch := &derpiWatch{
+		GuildID:    channel.GuildID,
+		ChannelID:  channel.ID,
+		Query:      rest,
+		CreatedBy:  msgEvent.Author.ID,
+		LastSeenID: lastSeenID,
+		nextPoll:   time.Now().Add(cfg.DerpiWatchInterval),
+	}
+	err = watches.add(watch)
+	if err != nil {
+		fmt.Println(err)
+		return &commandOutput{response: "Error saving watches"}
+	}
+
+	response := "Okay! New uploads matching `" + rest + "` will be posted here (watch #" + strconv.Itoa(watch.ID) + ")."
+	response += "\nOnly images this channel's image policy allows will be posted (see `policy`)."
+	return &commandOutput{response: response}
+}
+
+// Lists a guild's subscriptions
+func listWatches(guildID string) *commandOutput {
+	list := watches.forGuild(guildID)
+	if len(list) == 0 {
+		return &commandOutput{response: "Nothing is being watched in this server."}
+	}
+
+	lines := []string{}
+	for _, watch := range list {
+		lines = append(lines, "**#"+strconv.Itoa(watch.ID)+"** `"+watch.Query+"` in <#"+watch.ChannelID+">")
+	}
+
+	embed := NewEmbed().
+		SetTitle("Derpibooru watches").
+		SetDescription(strings.Join(lines, "\n")).
+		SetColor(derpiEmbedColor)
+	return &commandOutput{embed: embed.Truncate().MessageEmbed}
+}